@@ -226,8 +226,11 @@ do
 
       if [ "$deploy_mode" != "test" ]; then
         echo -n "${CYAN}Building $servicename: "
-        # Disable C code, enable Go modules
+        # Disable C code, enable Go modules, unless the SQLite3 driver is used
         export CGO_ENABLED=0
+        if grep -q "go-sqlite3" go.mod ; then
+          export CGO_ENABLED=1
+        fi
         echo $PWD
         go build # since 14 we need this to ignore vendor directory
         echo "${GREEN}DONE$WHITE"
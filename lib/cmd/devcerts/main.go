@@ -0,0 +1,156 @@
+// Command devcerts makes a development PKI so the services can be run with
+// tls: true without a real CA.  It writes a CA and, for each service, a
+// certificate and key to services/<service>/certs, where AppConfig.CertFile,
+// KeyFile and CAFile look when cert_file, key_file and ca_file aren't set.
+// The certificates are valid for the hosts of the service's service_addr in
+// every cfg/defaultConfig.yaml and cfg/dockerConfig.yaml, and for localhost.
+//
+// Run it from lib:
+//
+//	go run ./cmd/devcerts
+//
+// The CA is kept in ../certs and used again by later runs, so only the
+// service certificates change unless -new-ca is given.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"lib/common"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// services are the service directories, which are also the names they load
+// their config for, and the keys other services find them under, e.g. the
+// frontend calls route-guide.service_addr
+var services = map[string][]string{
+	"book":          {"book"},
+	"frontend":      {"frontend"},
+	"routeguide":    {"route-guide", "routeguide"},
+	"systemservice": {"system"},
+}
+
+// configFiles are the configs whose service addresses the certificates are for
+var configFiles = []string{"defaultConfig.yaml", "dockerConfig.yaml"}
+
+func main() {
+	servicesDir := flag.String("services", "../services", "The directory of the services")
+	caDir := flag.String("ca", "../certs", "Where the CA certificate and key are kept")
+	newCA := flag.Bool("new-ca", false, "Make a new CA, rather than use the one in -ca")
+	validFor := flag.Duration("valid-for", 365*24*time.Hour, "How long the certificates are valid for")
+	flag.Parse()
+
+	ca, err := loadCA(*caDir, *newCA, *validFor)
+	if err != nil {
+		log.Fatalf("CA: %v", err)
+	}
+	hosts, err := serviceHosts(*servicesDir)
+	if err != nil {
+		log.Fatalf("Reading the configs: %v", err)
+	}
+	for _, name := range sortedServices() {
+		dir := filepath.Join(*servicesDir, name, common.CertDir)
+		if err := ca.WriteCA(filepath.Join(dir, "ca.pem"), ""); err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		certFile := filepath.Join(dir, name+".pem")
+		keyFile := filepath.Join(dir, name+".key")
+		if err := ca.WriteCert(name, hosts[name], *validFor, certFile, keyFile); err != nil {
+			log.Fatalf("%s: %v", name, err)
+		}
+		fmt.Printf("%s: %s for %s\n", name, certFile, strings.Join(hosts[name], ", "))
+	}
+}
+
+// loadCA reads the CA from dir, making it first if there isn't one
+func loadCA(dir string, newCA bool, validFor time.Duration) (*common.DevCA, error) {
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+	if !newCA {
+		ca, err := common.LoadDevCA(certFile, keyFile)
+		if err == nil {
+			fmt.Printf("Using the CA in %s\n", certFile)
+			return ca, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	ca, err := common.NewDevCA("microservices development CA", validFor)
+	if err != nil {
+		return nil, err
+	}
+	if err := ca.WriteCA(certFile, keyFile); err != nil {
+		return nil, err
+	}
+	fmt.Printf("Made a new CA in %s, services using the old one must get new certificates\n", certFile)
+	return ca, nil
+}
+
+// serviceHosts finds the hosts of each service in the service_addr keys of
+// the configs, e.g. book:4000 in the frontend's dockerConfig.yaml.  The
+// service's name and localhost are always among them.
+func serviceHosts(servicesDir string) (map[string][]string, error) {
+	hosts := map[string][]string{}
+	seen := map[string]bool{}
+	add := func(name, host string) {
+		if host != "" && !seen[name+" "+host] {
+			seen[name+" "+host] = true
+			hosts[name] = append(hosts[name], host)
+		}
+	}
+	for _, name := range sortedServices() {
+		add(name, name)
+		add(name, "localhost")
+		add(name, "127.0.0.1")
+	}
+	for _, dir := range sortedServices() {
+		for _, file := range configFiles {
+			path := filepath.Join(servicesDir, dir, "cfg", file)
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				continue
+			}
+			v := viper.New()
+			v.SetConfigFile(path)
+			if err := v.ReadInConfig(); err != nil {
+				return nil, err
+			}
+			for _, name := range sortedServices() {
+				for _, key := range services[name] {
+					add(name, addrHost(v.GetString(key+".service_addr")))
+				}
+			}
+		}
+	}
+	return hosts, nil
+}
+
+// addrHost is the host of an address such as book:4000 or http://127.0.0.1:8082
+func addrHost(addr string) string {
+	if strings.Contains(addr, "://") {
+		if u, err := url.Parse(addr); err == nil {
+			return u.Hostname()
+		}
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func sortedServices() []string {
+	var names []string
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,274 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ConfigErrors are all the keys Bind found missing or invalid, so they can
+// be fixed in one go rather than a restart each
+type ConfigErrors []error
+
+func (e ConfigErrors) Error() string {
+	var b strings.Builder
+	if len(e) == 1 {
+		b.WriteString("a config key is invalid:")
+	} else {
+		fmt.Fprintf(&b, "%d config keys are invalid:", len(e))
+	}
+	for _, err := range e {
+		b.WriteString("\n\t")
+		b.WriteString(err.Error())
+	}
+	return b.String()
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Bind fills the struct cfg points to from the keys of prefix, e.g. book, or
+// the top level keys if it is empty.  The environment variable, e.g.
+// BOOK_PORT, takes priority over the config files.  The fields are tagged
+// with their key and how it is checked, e.g.
+//
+//	type bookConfig struct {
+//		Port     int           `config:"port" required:"true" min:"1" max:"65535"`
+//		DBDriver string        `config:"db_driver" default:"memory" oneof:"memory sqlite3"`
+//		Timeout  time.Duration `config:"call_timeout" default:"5s" min:"1ms"`
+//		Secret   string        `config:"page_token_secret" secret:"true"`
+//	}
+//
+// A field can be a string, bool, int, float64, time.Duration such as 1.5s, or
+// []string from a list or comma separated values.  A value can be a reference
+// to a secret, e.g. secret://env/PAGE_TOKEN_SECRET, see Secrets.  Every key
+// is checked and the error is ConfigErrors if any are missing or invalid.
+// Unlike GetStringKey it doesn't use, or change, the KeyPrefix, but it looks
+// the keys up in the same order, see lookup.
+func (c *AppConfig) Bind(prefix string, cfg interface{}) error {
+	v := reflect.ValueOf(cfg)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Bind needs a pointer to a struct, not %T", cfg)
+	}
+	v = v.Elem()
+	var errs ConfigErrors
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		key := field.Tag.Get("config")
+		if key == "" || key == "-" {
+			continue
+		}
+		name := keyName(prefix, key)
+		if field.PkgPath != "" {
+			errs = append(errs, fmt.Errorf("%s: field %s isn't exported", name, field.Name))
+			continue
+		}
+		s, ok := c.lookup(prefix, key)
+		if !ok {
+			s = field.Tag.Get("default")
+		}
+		s, err := c.resolveValue(key, s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		if s == "" {
+			if field.Tag.Get("required") == "true" {
+				errs = append(errs, fmt.Errorf("%s is required", name))
+			}
+			v.Field(i).Set(reflect.Zero(field.Type))
+			continue
+		}
+		if err := setField(v.Field(i), s, field.Tag); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// keyName is the key with its prefix, if it has one, e.g. book.port
+func keyName(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+// lookup returns the value of the key of prefix, e.g. port of book, from the
+// environment, BOOK_PORT, or else book.port in the config, or else the top
+// level port in the config, which a shared file can set for every service.
+// Bind and GetStringKey both look keys up this way.  Lists are joined by
+// commas.
+func (c *AppConfig) lookup(prefix, key string) (string, bool) {
+	env := key
+	if prefix != "" {
+		env = prefix + "_" + key
+	}
+	if s := os.Getenv(strings.ToUpper(env)); s != "" {
+		return s, true
+	}
+	if s, ok := c.configValue(keyName(prefix, key)); ok || prefix == "" {
+		return s, ok
+	}
+	return c.configValue(key)
+}
+
+// configValue is the value of the key in the config files, or set by V.Set
+func (c *AppConfig) configValue(name string) (string, bool) {
+	if c.V == nil || !c.V.IsSet(name) {
+		return "", false
+	}
+	switch value := c.V.Get(name).(type) {
+	case nil:
+		return "", false
+	case []interface{}:
+		values := make([]string, len(value))
+		for i, v := range value {
+			values[i] = fmt.Sprint(v)
+		}
+		return strings.Join(values, ","), true
+	default:
+		return fmt.Sprint(value), true
+	}
+}
+
+// setField parses s into the field and checks it against the field's min, max
+// and oneof tags
+func setField(field reflect.Value, s string, tag reflect.StructTag) error {
+	switch {
+	case field.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%q isn't a duration, e.g. 1.5s", s)
+		}
+		if err := checkRange(tag, d, func(s string) (interface{}, error) { return time.ParseDuration(s) }); err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+	case field.Kind() == reflect.String:
+		if oneof := tag.Get("oneof"); oneof != "" {
+			values := strings.Fields(oneof)
+			if !containsFold(values, s) {
+				return fmt.Errorf("%q isn't one of %s", s, strings.Join(values, ", "))
+			}
+		}
+		field.SetString(s)
+	case field.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q isn't true or false", s)
+		}
+		field.SetBool(b)
+	case field.Kind() >= reflect.Int && field.Kind() <= reflect.Int64:
+		i, err := strconv.ParseInt(s, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q isn't a whole number", s)
+		}
+		if err := checkRange(tag, i, func(s string) (interface{}, error) { return strconv.ParseInt(s, 10, 64) }); err != nil {
+			return err
+		}
+		field.SetInt(i)
+	case field.Kind() == reflect.Float32 || field.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(s, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("%q isn't a number", s)
+		}
+		if err := checkRange(tag, f, func(s string) (interface{}, error) { return strconv.ParseFloat(s, 64) }); err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+		var values []string
+		for _, v := range strings.Split(s, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+		for i, v := range values {
+			slice.Index(i).SetString(v)
+		}
+		field.Set(slice)
+	default:
+		return fmt.Errorf("a %s can't be bound", field.Type())
+	}
+	return nil
+}
+
+// checkRange checks the value, an int64, float64 or time.Duration, is within
+// the min and max tags, which parse turns into the value's type
+func checkRange(tag reflect.StructTag, value interface{}, parse func(s string) (interface{}, error)) error {
+	for _, bound := range []string{"min", "max"} {
+		s := tag.Get(bound)
+		if s == "" {
+			continue
+		}
+		limit, err := parse(s)
+		if err != nil {
+			return fmt.Errorf("bad %s tag %q: %v", bound, s, err)
+		}
+		if bound == "min" && less(value, limit) {
+			return fmt.Errorf("%v is less than the min %v", value, limit)
+		}
+		if bound == "max" && less(limit, value) {
+			return fmt.Errorf("%v is more than the max %v", value, limit)
+		}
+	}
+	return nil
+}
+
+// less compares two values of the same type, an int64, float64 or
+// time.Duration
+func less(a, b interface{}) bool {
+	switch a := a.(type) {
+	case int64:
+		return a < b.(int64)
+	case float64:
+		return a < b.(float64)
+	case time.Duration:
+		return a < b.(time.Duration)
+	}
+	return false
+}
+
+func containsFold(values []string, s string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// FormatConfig is the config in the struct cfg points to, as bound by Bind, a
+// line per key, e.g. book.port = 8086.  The values of the fields tagged
+// secret:"true" are redacted.
+func FormatConfig(prefix string, cfg interface{}) string {
+	v := reflect.Indirect(reflect.ValueOf(cfg))
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+	var b strings.Builder
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		key := field.Tag.Get("config")
+		if key == "" || key == "-" || field.PkgPath != "" {
+			continue
+		}
+		value := v.Field(i).Interface()
+		if values, ok := value.([]string); ok {
+			value = strings.Join(values, ",")
+		}
+		s := fmt.Sprint(value)
+		if field.Tag.Get("secret") == "true" && s != "" {
+			s = redacted
+		}
+		fmt.Fprintf(&b, "%s = %s\n", keyName(prefix, key), s)
+	}
+	return b.String()
+}
@@ -11,7 +11,6 @@ import (
 	//"flag"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
-	"os"
 	"strings"
 	"time"
 )
@@ -34,8 +33,19 @@ type AppConfig struct {
 	CanaryColour string
 	// grpc Service connections
 	SvcConn map[string]*grpc.ClientConn
+	// The circuit breakers of the connections, see ConnStates
+	SvcBreaker map[string]*CircuitBreaker
+	// The name the config was loaded for, e.g. book, see CertFile
+	ServiceName string
 	// Prefix for key used to find config/environment variables
 	keyPrefix string
+	// What the config was loaded from, for reading it again
+	defaults    string
+	configPaths []string
+	// Reads the config again when it changes, see WatchConfig
+	watcher *ConfigWatcher
+	// Resolves the values that are references to secrets, see Secrets
+	secrets *Secrets
 }
 
 type PlatformDetails struct {
@@ -46,28 +56,55 @@ type PlatformDetails struct {
 // LoadConfig loads AppConfig from files, command line, environment etc.
 func LoadConfig(serviceName string, defaults string, configPaths ...string) (AppConfig, error) {
 	App.Ctx = context.Background()
+	App.ServiceName = serviceName
+	App.defaults, App.configPaths = defaults, configPaths
+	// Until ConfigureLogging has the keys the logger is set up from LOG_LEVEL,
+	// LOG_FORMAT and LOG_OUTPUT
 	log := logrus.New()
 	App.Log = log
-	log.Level = logrus.DebugLevel
-	log.Formatter = &logrus.TextFormatter{TimestampFormat: time.RFC822}
-	log.WithField("prefix", serviceName)
-	//log.Formatter = &logrus.JSONFormatter{
-	//	FieldMap: logrus.FieldMap{
-	//		logrus.FieldKeyTime:  "timestamp",
-	//		logrus.FieldKeyLevel: "severity",
-	//		logrus.FieldKeyMsg:   "message",
-	//	},
-	//	TimestampFormat: time.RFC3339Nano,
-	//}
-	log.Out = os.Stdout
+	if err := configureLogger(log, logEnv(), logFields(serviceName, "")); err != nil {
+		log.Warnf("Logging with the defaults: %v", err)
+	}
 
 	log.Debug("Loading the configuration")
+	v, err := readConfig(serviceName, defaults, configPaths, log)
+	App.V = v
+	if err != nil {
+		return App, err
+	}
 
+	// The top level secrets_dir and secrets_refresh, or SECRETS_DIR and
+	// SECRETS_REFRESH, as the references are resolved before the KeyPrefix
+	refreshKey, _ := App.lookup("", "secrets_refresh")
+	refresh, err := time.ParseDuration(refreshKey)
+	if err != nil && refreshKey != "" {
+		log.Warnf("secrets_refresh isn't a duration, the secrets are read again every %v: %v", DefaultSecretsRefresh, err)
+	}
+	secretsDir, _ := App.lookup("", "secrets_dir")
+	App.secrets = NewSecrets(secretsDir, refresh)
+
+	App.Mutex = &sync.Mutex{}
+
+	App.SvcConn = make(map[string]*grpc.ClientConn)
+	App.SvcBreaker = make(map[string]*CircuitBreaker)
+
+	//get env and render correct platform banner.
+	var env = App.GetStringKey("ENV_PLATFORM")
+	platform := PlatformDetails{}
+	platform.setPlatformDetails(strings.ToLower(env))
+	App.Platform = platform
+
+	App.CanaryColour, _ = App.lookup("", "CANARY_COLOUR") // Shown on web pages
+
+	return App, nil
+}
+
+// readConfig reads cfg/defaultConfig.yaml, the defaults and then
+// <serviceName>.yaml, from the configPaths or ./cfg, over it
+func readConfig(serviceName string, defaults string, configPaths []string, log *logrus.Logger) (*viper.Viper, error) {
 	// Use viper library to load the configuration
 	v := viper.New()
-	App.V = v
-	v.SetConfigType("yaml")
-	v.AutomaticEnv() // Automatically read environment variables
+	v.SetConfigType("yaml") // The environment variables are read by lookup
 
 	log.Debug("Adding the file paths:", configPaths)
 	for _, path := range configPaths {
@@ -94,60 +131,88 @@ func LoadConfig(serviceName string, defaults string, configPaths ...string) (App
 		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
 			log.Debug("No AppConfig file found")
 		} else {
-			return App, fmt.Errorf("failed to read the configuration file: %s:%w", configName, err)
+			return v, fmt.Errorf("failed to read the configuration file: %s:%w", configName, err)
 		}
 	}
 
 	settings := v.AllSettings()
-	log.Debug(settings)
+	log.Debug(redactSettings(settings))
 	if len(settings) == 0 {
-		return App, ErrNoConfigSettings
+		return v, ErrNoConfigSettings
 	}
-
-	App.Mutex = &sync.Mutex{}
-
-	App.SvcConn = make(map[string]*grpc.ClientConn)
-
-	//get env and render correct platform banner.
-	var env = App.GetStringKey("ENV_PLATFORM")
-	platform := PlatformDetails{}
-	platform.setPlatformDetails(strings.ToLower(env))
-	App.Platform = platform
-
-	App.CanaryColour = v.GetString("CANARY_COLOUR") // Shown on web pages
-
-	return App, nil
+	return v, nil
 }
 
-// Environment variables take priority
+// KeyPrefix is the section of the config, and the prefix of the environment
+// variables, the Get...Key methods read, e.g. book for book.port or BOOK_PORT
 func (c *AppConfig) KeyPrefix(p string) {
 	c.keyPrefix = p
-	c.V.SetEnvPrefix(p)
 	c.Log.Debug("+ ", c.keyPrefix)
 }
 
-// Environment variables take priority
+// withKeyPrefix is a copy of the config that reads the keys of another
+// prefix, e.g. a service it calls, without changing the prefix of c
+func (c *AppConfig) withKeyPrefix(p string) *AppConfig {
+	keys := *c
+	keys.keyPrefix = p
+	return &keys
+}
+
+// Environment variables take priority, then the key of the KeyPrefix and then
+// the top level key, as Bind, see lookup.  A reference to a secret, e.g.
+// secret://k8s/cookie-secret, is resolved, see Secrets
 func (c *AppConfig) GetStringKey(key string) string {
-	//c.V.SetEnvPrefix(c.KeyPrefix)
-	s := c.V.GetString(key)
-	if s == "" {
-		s = c.V.GetString(c.keyPrefix + "." + key)
+	s, _ := c.lookup(c.keyPrefix, key)
+	c.Log.Debug("+---- ", key, " = ", redactValue(key, s))
+	resolved, err := c.resolveValue(key, s)
+	if err != nil {
+		c.Log.Errorf("%s: %v", key, err)
+		return ""
 	}
-	c.Log.Debug("+---- ", key, " = ", s)
-	return s
+	return resolved
 }
 
-// Environment variables take priority
+// Environment variables take priority, a value that isn't a whole number is
+// logged and 0 returned, a key bound by Bind stops the service instead
 func (c *AppConfig) GetIntKey(key string) int {
-	i, _ := strconv.Atoi(c.GetStringKey(key))
+	s := c.GetStringKey(key)
+	i, err := strconv.Atoi(s)
+	if err != nil && s != "" {
+		c.Log.Warnf("%s: %q isn't a whole number, using 0", key, s)
+	}
 	return i
 }
 
-// Environment variables take priority
+// Environment variables take priority, a value that isn't true or false is
+// logged and false returned
 func (c *AppConfig) GetBoolKey(key string) bool {
-	b, _ := strconv.ParseBool(c.GetStringKey(key))
+	s := c.GetStringKey(key)
+	b, err := strconv.ParseBool(s)
+	if err != nil && s != "" {
+		c.Log.Warnf("%s: %q isn't true or false, using false", key, s)
+	}
 	return b
+}
 
+// Environment variables take priority, a value that isn't a number is logged
+// and 0 returned
+func (c *AppConfig) GetFloatKey(key string) float64 {
+	s := c.GetStringKey(key)
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil && s != "" {
+		c.Log.Warnf("%s: %q isn't a number, using 0", key, s)
+	}
+	return f
+}
+
+// Environment variables take priority, def is used if the key isn't a
+// positive duration such as 1.5s
+func (c *AppConfig) GetDurationKey(key string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(c.GetStringKey(key))
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
 }
 
 // The port to listen on
@@ -170,9 +235,10 @@ func (c *AppConfig) TLS() bool {
 	return c.GetBoolKey("tls")
 }
 
-// The file containing the CA root cert file
+// The TLS cert file, the server's certificate or the one a client presents,
+// certs/<service>.pem if not set
 func (c *AppConfig) CertFile() string {
-	return c.GetStringKey("ca_file")
+	return c.certPath("cert_file", c.ServiceName+".pem")
 }
 
 // The server name used to verify the hostname returned by the TLS handshake
@@ -180,9 +246,9 @@ func (c *AppConfig) HostOverride() string {
 	return c.GetStringKey("server_host_override")
 }
 
-// The TLS key file
+// The TLS key file, certs/<service>.key if not set
 func (c *AppConfig) KeyFile() string {
-	return c.GetStringKey("key_file")
+	return c.certPath("key_file", c.ServiceName+".key")
 }
 
 // The address to listen on?
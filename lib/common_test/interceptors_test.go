@@ -0,0 +1,86 @@
+package common_test_test
+
+import (
+	"context"
+	"io/ioutil"
+	"lib/common"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// callUnary calls handler through the server interceptors like grpc would
+func callUnary(ctx context.Context, handler grpc.UnaryHandler) (interface{}, error) {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	c := &common.AppConfig{Log: log}
+	info := &grpc.UnaryServerInfo{FullMethod: "/test.Test/Call"}
+	interceptors := c.UnaryServerInterceptors()
+	var next func(i int) grpc.UnaryHandler
+	next = func(i int) grpc.UnaryHandler {
+		if i == len(interceptors) {
+			return handler
+		}
+		return func(ctx context.Context, req interface{}) (interface{}, error) {
+			return interceptors[i](ctx, req, info, next(i+1))
+		}
+	}
+	return next(0)(ctx, "request")
+}
+
+func TestInterceptorRecoversPanic(t *testing.T) {
+	_, err := callUnary(context.Background(), func(ctx context.Context, req interface{}) (interface{}, error) {
+		panic("boom")
+	})
+	assert.Equal(t, codes.Internal, status.Code(err))
+}
+
+func TestInterceptorKeepsRequestID(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(common.RequestIDKey, "abc123"))
+	var got string
+	_, err := callUnary(ctx, func(ctx context.Context, req interface{}) (interface{}, error) {
+		got = common.RequestID(ctx)
+		return req, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "abc123", got)
+}
+
+func TestInterceptorCreatesRequestID(t *testing.T) {
+	var got string
+	_, err := callUnary(context.Background(), func(ctx context.Context, req interface{}) (interface{}, error) {
+		got = common.RequestID(ctx)
+		return req, nil
+	})
+	assert.Nil(t, err)
+	assert.Len(t, got, 32)
+}
+
+func TestInterceptorKeepsSessionID(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(common.SessionIDKey, "session1"))
+	var got string
+	_, err := callUnary(ctx, func(ctx context.Context, req interface{}) (interface{}, error) {
+		got = common.SessionID(ctx)
+		return req, nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "session1", got)
+}
+
+func TestClientMetadataForwardsIDs(t *testing.T) {
+	ctx := common.WithSessionID(common.WithRequestID(context.Background(), "abc123"), "session1")
+	var md metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}
+	err := common.UnaryClientMetadata(ctx, "/test.Test/Call", "request", nil, nil, invoker)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"abc123"}, md.Get(common.RequestIDKey))
+	assert.Equal(t, []string{"session1"}, md.Get(common.SessionIDKey))
+}
@@ -0,0 +1,89 @@
+package common_test_test
+
+import (
+	"context"
+	"io/ioutil"
+	"lib/common"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// scrape returns the metrics in the text format
+func scrape(t *testing.T, m *common.Metrics) string {
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, common.MetricsPath, nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	b, err := ioutil.ReadAll(w.Body)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	m := common.NewMetrics()
+	h := m.HTTP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/books/") {
+			common.SetRoute(r.Context(), "/books/{id}")
+		}
+		if strings.HasSuffix(r.URL.Path, "/boom") {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	for _, path := range []string{"/books/1", "/books/2", "/books/boom", "/nowhere"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	text := scrape(t, m)
+	assert.Contains(t, text, `http_requests_total{code="200",method="GET",route="/books/{id}"} 2`)
+	assert.Contains(t, text, `http_requests_total{code="200",method="GET",route="other"} 1`)
+	assert.Contains(t, text, `http_request_errors_total{code="500",method="GET",route="/books/{id}"} 1`)
+	assert.Contains(t, text, `http_request_duration_seconds_count{method="GET",route="/books/{id}"} 3`)
+	assert.Contains(t, text, "go_goroutines")
+}
+
+func TestServeMuxRoutes(t *testing.T) {
+	m := common.NewMetrics()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	h := m.HTTP(mux)
+	for _, path := range []string{"/version", "/a", "/b"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	text := scrape(t, m)
+	assert.Contains(t, text, `http_requests_total{code="200",method="GET",route="/version"} 1`)
+	assert.Contains(t, text, `http_requests_total{code="200",method="GET",route="/"} 2`)
+}
+
+func TestRPCMetrics(t *testing.T) {
+	m := common.NewMetrics()
+	info := &grpc.UnaryServerInfo{FullMethod: "/book.v1.BookService/GetBook"}
+	for _, code := range []codes.Code{codes.OK, codes.NotFound, codes.Internal} {
+		_, _ = m.Unary(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, status.Error(code, "test")
+		})
+	}
+
+	text := scrape(t, m)
+	assert.Contains(t, text, `grpc_server_handled_total{grpc_code="OK",grpc_method="GetBook",grpc_service="book.v1.BookService"} 1`)
+	assert.Contains(t, text, `grpc_server_handled_total{grpc_code="NotFound",grpc_method="GetBook",grpc_service="book.v1.BookService"} 1`)
+	assert.Contains(t, text, `grpc_server_errors_total{grpc_code="Internal",grpc_method="GetBook",grpc_service="book.v1.BookService"} 1`)
+	assert.NotContains(t, text, `grpc_server_errors_total{grpc_code="NotFound"`, "the client's fault")
+	assert.Contains(t, text, `grpc_server_handling_seconds_count{grpc_method="GetBook",grpc_service="book.v1.BookService"} 3`)
+}
+
+func TestGaugeFunc(t *testing.T) {
+	m := common.NewMetrics()
+	books := 0
+	m.GaugeFunc("book_count", "Books in the database.", func() float64 { return float64(books) })
+	books = 42
+	assert.Contains(t, scrape(t, m), "book_count 42")
+}
@@ -0,0 +1,128 @@
+package common_test_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"lib/common"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// spans keeps the spans that end
+type spans struct {
+	mu   sync.Mutex
+	data []*trace.SpanData
+}
+
+func (s *spans) ExportSpan(sd *trace.SpanData) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = append(s.data, sd)
+}
+
+func (s *spans) kind(kind int) *trace.SpanData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sd := range s.data {
+		if sd.SpanKind == kind {
+			return sd
+		}
+	}
+	return nil
+}
+
+func (s *spans) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.data)
+}
+
+func TestTracePropagation(t *testing.T) {
+	exported := &spans{}
+	trace.RegisterExporter(exported)
+	defer trace.UnregisterExporter(exported)
+
+	// Any method is answered with an empty message
+	s := grpc.NewServer(grpc.StatsHandler(common.ServerStatsHandler()),
+		grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+			return stream.SendMsg(&emptypb.Empty{})
+		}))
+	common.RegisterHealth(s).Serving("")
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(lis)
+	defer s.Stop()
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure(), grpc.WithStatsHandler(common.ClientStatsHandler()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, span := trace.StartSpan(context.Background(), "request", trace.WithSampler(trace.AlwaysSample()))
+	require.NoError(t, conn.Invoke(ctx, "/test.Test/Call", &emptypb.Empty{}, &emptypb.Empty{}))
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	span.End()
+
+	// The server span ends after the client has its answer
+	require.Eventually(t, func() bool { return exported.kind(trace.SpanKindServer) != nil }, time.Second, 10*time.Millisecond)
+	client, server := exported.kind(trace.SpanKindClient), exported.kind(trace.SpanKindServer)
+	require.NotNil(t, client)
+	assert.Equal(t, span.SpanContext().TraceID, client.TraceID)
+	assert.Equal(t, span.SpanContext().TraceID, server.TraceID, "the trace carries on in the server")
+	assert.Equal(t, client.SpanID, server.ParentSpanID)
+	assert.Equal(t, "test.Test.Call", server.Name)
+	assert.Equal(t, 3, exported.len(), "the health check isn't traced")
+}
+
+func TestTraceFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tracing_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "trace.json")
+	c := tlsConfig("book", map[string]string{"trace_exporter": "file", "trace_file": file})
+	closer, err := c.StartTracing("book")
+	require.NoError(t, err)
+
+	_, span := trace.StartSpan(context.Background(), "dao.GetBook", trace.WithSampler(trace.AlwaysSample()))
+	span.AddAttributes(trace.StringAttribute("book.id", "42"))
+	span.End()
+	require.NoError(t, closer.Close(context.Background()))
+
+	f, err := os.Open(file)
+	require.NoError(t, err)
+	defer f.Close()
+	lines := bufio.NewScanner(f)
+	require.True(t, lines.Scan())
+	var got map[string]interface{}
+	require.NoError(t, json.Unmarshal(lines.Bytes(), &got))
+	assert.Equal(t, "dao.GetBook", got["name"])
+	assert.Equal(t, span.SpanContext().TraceID.String(), got["trace_id"])
+	assert.Equal(t, map[string]interface{}{"book.id": "42"}, got["attributes"])
+}
+
+func TestTracingConfig(t *testing.T) {
+	for name, keys := range map[string]map[string]string{
+		"unknown exporter": {"trace_exporter": "carrier-pigeon"},
+		"no file":          {"trace_exporter": "file"},
+		"no jaeger":        {"trace_exporter": "jaeger"},
+		"sample rate":      {"trace_exporter": "stdout", "trace_sample_rate": "2"},
+	} {
+		_, err := tlsConfig("book", keys).StartTracing("book")
+		assert.Error(t, err, name)
+	}
+	closer, err := tlsConfig("book", nil).StartTracing("book")
+	require.NoError(t, err, "off by default")
+	assert.NoError(t, closer.Close(context.Background()))
+}
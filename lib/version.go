@@ -2,4 +2,4 @@ package lib
 
 // VERSION is the version of the library, if the library is updated in any copies
 // then update the version so the most recent version can be identified.
-var VERSION = "0.1.5" // **** DELETE THE lib directory from VENDOR before editing
+var VERSION = "0.1.31" // **** DELETE THE lib directory from VENDOR before editing
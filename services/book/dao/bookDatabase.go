@@ -3,22 +3,56 @@ package dao
 import (
 	pb "book/pb/pb_book_v1"
 	"context"
+	"fmt"
+)
+
+// Database drivers that can be used for the book.db_driver config key
+const (
+	DriverMemory = "memory"  // Books are lost when the service stops
+	DriverSQLite = "sqlite3" // Books are kept in the SQLite file given by book.db_dsn
 )
 
 // BookDatabase provides thread-safe access to a database of books.
+// Implementations must pass daotest.RunBookDatabaseSuite.
 type BookDatabase interface {
-	// ListBooks returns a list of books, ordered by title.
-	ListBooks(context.Context) ([]*pb.Book, error)
+	// ListBooks returns the books that match the options.
+	ListBooks(ctx context.Context, opts ListOptions) ([]*pb.Book, error)
 
 	// GetBook retrieves a book by its ID.
 	GetBook(ctx context.Context, id string) (*pb.Book, error)
 
-	// AddBook saves a given book, assigning it a new ID.
+	// AddBook saves a given book, assigning it a new ID and etag.
 	AddBook(ctx context.Context, book *pb.Book) (id string, err error)
 
-	// DeleteBook removes a given book by its ID.
-	DeleteBook(ctx context.Context, id string) error
+	// DeleteBook removes a given book by its ID. If the etag is not empty and
+	// the book has changed since then the error is ErrConflict.
+	DeleteBook(ctx context.Context, id, etag string) error
 
-	// UpdateBook updates the entry for a given book.
+	// UpdateBook updates the entry for a given book, the book must already exist.
+	// If the etag of the book is not empty and the book has changed since then
+	// the error is ErrConflict, otherwise the book is given a new etag.
 	UpdateBook(ctx context.Context, book *pb.Book) error
+
+	// Close releases the database, it can't be used afterwards.
+	Close(ctx context.Context) error
+}
+
+// ListOptions picks which books ListBooks returns
+type ListOptions struct {
+	Filter  *Filter // Only list books that match, nil lists every book
+	OrderBy OrderBy // The listing order, always followed by ID
+	After   *Cursor // Start after the cursor, nil starts from the beginning
+	Limit   int     // At most this many books, zero or less is every book
+}
+
+// NewBookDatabase opens the BookDatabase for the driver, the dsn is the data
+// source name for drivers that need one.  No driver means the memory driver.
+func NewBookDatabase(driver, dsn string) (BookDatabase, error) {
+	switch driver {
+	case "", DriverMemory:
+		return NewMemoryDB()
+	case DriverSQLite:
+		return NewSQLiteDB(dsn)
+	}
+	return nil, fmt.Errorf("unknown book database driver %q", driver)
 }
@@ -0,0 +1,36 @@
+package dao
+
+import (
+	pb "book/pb/pb_book_v1"
+	"fmt"
+)
+
+// Cursor marks a position in the book listing, it holds the values of the
+// fields of the listing order for the last book returned, which are enough to
+// carry on from where the previous page ended.
+type Cursor struct {
+	Keys []string
+}
+
+// CursorOf returns the cursor positioned on the given book.
+func CursorOf(b *pb.Book, order OrderBy) *Cursor {
+	keys := order.keys()
+	c := &Cursor{Keys: make([]string, len(keys))}
+	for i, f := range keys {
+		c.Keys[i] = bookFields[f.Field].value(b)
+	}
+	return c
+}
+
+// check makes sure the cursor came from a listing in the same order
+func (c *Cursor) check(order OrderBy) error {
+	if c != nil && len(c.Keys) != len(order.keys()) {
+		return fmt.Errorf("cursor does not match order %q: %w", order, ErrInvalidArgument)
+	}
+	return nil
+}
+
+// after reports whether the book is listed after the cursor.
+func (c *Cursor) after(b *pb.Book, order OrderBy) bool {
+	return c == nil || order.compare(b, c.Keys) > 0
+}
@@ -0,0 +1,568 @@
+// Package daotest is the contract every dao.BookDatabase implementation has to
+// keep.  Call RunBookDatabaseSuite from a test of the implementation, e.g.
+//
+//	func TestMyDB(t *testing.T) {
+//		daotest.RunBookDatabaseSuite(t, func(t *testing.T) dao.BookDatabase {
+//			db, err := NewMyDB(...)
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return db
+//		})
+//	}
+package daotest
+
+import (
+	"book/dao"
+	pb "book/pb/pb_book_v1"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Factory returns a new empty database for each test of the suite, it is
+// closed when the test ends.
+type Factory func(t *testing.T) dao.BookDatabase
+
+// RunBookDatabaseSuite runs every check of the BookDatabase contract as a sub test.
+func RunBookDatabaseSuite(t *testing.T, newDB Factory) {
+	tests := []struct {
+		name string
+		test func(*testing.T, dao.BookDatabase)
+	}{
+		{"AddAssignsID", testAddAssignsID},
+		{"AddKeepsCopy", testAddKeepsCopy},
+		{"GetNotFound", testGetNotFound},
+		{"DeleteBook", testDeleteBook},
+		{"DeleteNotFound", testDeleteNotFound},
+		{"UpdateBook", testUpdateBook},
+		{"UpdateNotFound", testUpdateNotFound},
+		{"EtagChanges", testEtagChanges},
+		{"StaleUpdate", testStaleUpdate},
+		{"StaleDelete", testStaleDelete},
+		{"ListOrder", testListOrder},
+		{"ListPages", testListPages},
+		{"ListFilter", testListFilter},
+		{"ListOrderBy", testListOrderBy},
+		{"ListOrderByPages", testListOrderByPages},
+		{"ConcurrentWriters", testConcurrentWriters},
+		{"ContextCancelled", testContextCancelled},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			db := newDB(t)
+			defer func() {
+				if err := db.Close(context.Background()); err != nil {
+					t.Errorf("Close() = %v", err)
+				}
+			}()
+			tt.test(t, db)
+		})
+	}
+}
+
+// addBook adds a book failing the test if it can't
+func addBook(t *testing.T, db dao.BookDatabase, title string) *pb.Book {
+	t.Helper()
+	b := &pb.Book{Title: title, Author: "Gopher", PublishedDate: "2020", Description: "About " + title}
+	if _, err := db.AddBook(context.Background(), b); err != nil {
+		t.Fatalf("AddBook(%q) = %v", title, err)
+	}
+	return b
+}
+
+// sameBook reports any differences between the fields of two books
+func sameBook(t *testing.T, got, want *pb.Book) {
+	t.Helper()
+	if got.Id != want.Id || got.Title != want.Title || got.Author != want.Author ||
+		got.PublishedDate != want.PublishedDate || got.ImageURL != want.ImageURL ||
+		got.Description != want.Description || got.Etag != want.Etag {
+		t.Errorf("got book %v, want %v", got, want)
+	}
+}
+
+func ids(books []*pb.Book) []string {
+	var s []string
+	for _, b := range books {
+		s = append(s, b.Id)
+	}
+	return s
+}
+
+func testAddAssignsID(t *testing.T, db dao.BookDatabase) {
+	ctx := context.Background()
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		b := &pb.Book{Id: "ignored", Title: fmt.Sprintf("Book %d", i), Author: "Gopher"}
+		id, err := db.AddBook(ctx, b)
+		if err != nil {
+			t.Fatalf("AddBook() = %v", err)
+		}
+		if id == "" || id == "ignored" {
+			t.Fatalf("AddBook() id = %q, want a new ID", id)
+		}
+		if b.Id != id {
+			t.Errorf("AddBook() set book ID to %q, want %q", b.Id, id)
+		}
+		if seen[id] {
+			t.Errorf("AddBook() id %q used twice", id)
+		}
+		seen[id] = true
+
+		got, err := db.GetBook(ctx, id)
+		if err != nil {
+			t.Fatalf("GetBook(%q) = %v", id, err)
+		}
+		sameBook(t, got, b)
+	}
+}
+
+func testAddKeepsCopy(t *testing.T, db dao.BookDatabase) {
+	b := addBook(t, db, "Original")
+	want := proto.Clone(b).(*pb.Book)
+	b.Title = "Changed after AddBook"
+	got, err := db.GetBook(context.Background(), b.Id)
+	if err != nil {
+		t.Fatalf("GetBook(%q) = %v", b.Id, err)
+	}
+	sameBook(t, got, want)
+	got.Title = "Changed after GetBook"
+	if got, _ = db.GetBook(context.Background(), b.Id); got.Title != want.Title {
+		t.Errorf("changing a book from GetBook changed the database, title = %q", got.Title)
+	}
+}
+
+func testGetNotFound(t *testing.T, db dao.BookDatabase) {
+	b := addBook(t, db, "Exists")
+	for _, id := range []string{"no-such-book", "", "0" + b.Id, b.Id + " ", "books/" + b.Id} {
+		if b, err := db.GetBook(context.Background(), id); !errors.Is(err, dao.ErrNotFound) {
+			t.Errorf("GetBook(%q) = %v, %v, want %v", id, b, err, dao.ErrNotFound)
+		}
+	}
+}
+
+func testDeleteBook(t *testing.T, db dao.BookDatabase) {
+	ctx := context.Background()
+	keep := addBook(t, db, "Keep")
+	gone := addBook(t, db, "Gone")
+	if err := db.DeleteBook(ctx, gone.Id, ""); err != nil {
+		t.Fatalf("DeleteBook(%q) = %v", gone.Id, err)
+	}
+	if _, err := db.GetBook(ctx, gone.Id); err == nil {
+		t.Errorf("GetBook(%q) found a deleted book", gone.Id)
+	}
+	if _, err := db.GetBook(ctx, keep.Id); err != nil {
+		t.Errorf("GetBook(%q) = %v after deleting another book", keep.Id, err)
+	}
+}
+
+func testDeleteNotFound(t *testing.T, db dao.BookDatabase) {
+	ctx := context.Background()
+	b := addBook(t, db, "Deleted twice")
+	if err := db.DeleteBook(ctx, b.Id, ""); err != nil {
+		t.Fatalf("DeleteBook(%q) = %v", b.Id, err)
+	}
+	if err := db.DeleteBook(ctx, b.Id, ""); !errors.Is(err, dao.ErrNotFound) {
+		t.Errorf("DeleteBook(%q) of a deleted book = %v, want %v", b.Id, err, dao.ErrNotFound)
+	}
+	if err := db.DeleteBook(ctx, "", ""); !errors.Is(err, dao.ErrInvalidArgument) {
+		t.Errorf("DeleteBook(\"\") = %v, want %v", err, dao.ErrInvalidArgument)
+	}
+}
+
+func testUpdateBook(t *testing.T, db dao.BookDatabase) {
+	ctx := context.Background()
+	b := addBook(t, db, "Before")
+	update := &pb.Book{Id: b.Id, Title: "After", Author: "Someone Else", ImageURL: "http://image"}
+	if err := db.UpdateBook(ctx, update); err != nil {
+		t.Fatalf("UpdateBook(%v) = %v", update, err)
+	}
+	got, err := db.GetBook(ctx, b.Id)
+	if err != nil {
+		t.Fatalf("GetBook(%q) = %v", b.Id, err)
+	}
+	sameBook(t, got, update)
+}
+
+func testUpdateNotFound(t *testing.T, db dao.BookDatabase) {
+	ctx := context.Background()
+	b := addBook(t, db, "Deleted")
+	if err := db.DeleteBook(ctx, b.Id, ""); err != nil {
+		t.Fatalf("DeleteBook(%q) = %v", b.Id, err)
+	}
+	for _, id := range []string{b.Id, "no-such-book"} {
+		if err := db.UpdateBook(ctx, &pb.Book{Id: id, Title: "Upserted"}); !errors.Is(err, dao.ErrNotFound) {
+			t.Errorf("UpdateBook() of missing ID %q = %v, want %v", id, err, dao.ErrNotFound)
+		}
+	}
+	if err := db.UpdateBook(ctx, &pb.Book{Title: "No ID"}); !errors.Is(err, dao.ErrInvalidArgument) {
+		t.Errorf("UpdateBook() with no ID = %v, want %v", err, dao.ErrInvalidArgument)
+	}
+	books, err := db.ListBooks(ctx, dao.ListOptions{})
+	if err != nil {
+		t.Fatalf("ListBooks() = %v", err)
+	}
+	if len(books) != 0 {
+		t.Errorf("UpdateBook() of a missing ID created books %v", ids(books))
+	}
+}
+
+func testEtagChanges(t *testing.T, db dao.BookDatabase) {
+	ctx := context.Background()
+	b := addBook(t, db, "Etag")
+	if b.Etag == "" {
+		t.Fatalf("AddBook() did not set the etag")
+	}
+	seen := map[string]bool{b.Etag: true}
+	for i := 0; i < 3; i++ {
+		b.Title = fmt.Sprintf("Etag %d", i)
+		if err := db.UpdateBook(ctx, b); err != nil {
+			t.Fatalf("UpdateBook(%v) = %v", b, err)
+		}
+		if seen[b.Etag] {
+			t.Errorf("UpdateBook() reused the etag %q", b.Etag)
+		}
+		seen[b.Etag] = true
+		got, err := db.GetBook(ctx, b.Id)
+		if err != nil {
+			t.Fatalf("GetBook(%q) = %v", b.Id, err)
+		}
+		sameBook(t, got, b)
+	}
+}
+
+func testStaleUpdate(t *testing.T, db dao.BookDatabase) {
+	ctx := context.Background()
+	b := addBook(t, db, "Stale")
+	mine := proto.Clone(b).(*pb.Book)
+	theirs := proto.Clone(b).(*pb.Book)
+	theirs.Title = "Theirs"
+	if err := db.UpdateBook(ctx, theirs); err != nil {
+		t.Fatalf("UpdateBook(%v) = %v", theirs, err)
+	}
+	mine.Title = "Mine"
+	if err := db.UpdateBook(ctx, mine); !errors.Is(err, dao.ErrConflict) {
+		t.Errorf("UpdateBook() with a stale etag = %v, want %v", err, dao.ErrConflict)
+	}
+	got, err := db.GetBook(ctx, b.Id)
+	if err != nil {
+		t.Fatalf("GetBook(%q) = %v", b.Id, err)
+	}
+	sameBook(t, got, theirs)
+}
+
+func testStaleDelete(t *testing.T, db dao.BookDatabase) {
+	ctx := context.Background()
+	b := addBook(t, db, "Stale")
+	stale := b.Etag
+	b.Title = "Changed"
+	if err := db.UpdateBook(ctx, b); err != nil {
+		t.Fatalf("UpdateBook(%v) = %v", b, err)
+	}
+	if err := db.DeleteBook(ctx, b.Id, stale); !errors.Is(err, dao.ErrConflict) {
+		t.Errorf("DeleteBook() with a stale etag = %v, want %v", err, dao.ErrConflict)
+	}
+	if _, err := db.GetBook(ctx, b.Id); err != nil {
+		t.Fatalf("GetBook(%q) = %v, DeleteBook with a stale etag deleted it", b.Id, err)
+	}
+	if err := db.DeleteBook(ctx, b.Id, b.Etag); err != nil {
+		t.Errorf("DeleteBook() with the current etag = %v", err)
+	}
+}
+
+func testListOrder(t *testing.T, db dao.BookDatabase) {
+	ctx := context.Background()
+	var want []*pb.Book
+	// Enough books for IDs past 9, which are in number rather than string order
+	for _, title := range []string{"Moby Dick", "", "Emma", "moby dick", "Emma", "Dracula", "Emma", "Emma", "Emma", "", "Emma", "Emma"} {
+		want = append(want, addBook(t, db, title))
+	}
+	sort.SliceStable(want, func(i, j int) bool {
+		if want[i].Title != want[j].Title {
+			return want[i].Title < want[j].Title
+		}
+		if len(want[i].Id) != len(want[j].Id) {
+			return len(want[i].Id) < len(want[j].Id)
+		}
+		return want[i].Id < want[j].Id
+	})
+	for i := 0; i < 2; i++ { // Same order every time
+		got, err := db.ListBooks(ctx, dao.ListOptions{})
+		if err != nil {
+			t.Fatalf("ListBooks() = %v", err)
+		}
+		if fmt.Sprint(ids(got)) != fmt.Sprint(ids(want)) {
+			t.Fatalf("ListBooks() = %v, want %v", ids(got), ids(want))
+		}
+		for i := range got {
+			sameBook(t, got[i], want[i])
+		}
+	}
+}
+
+func testListPages(t *testing.T, db dao.BookDatabase) {
+	ctx := context.Background()
+	for i := 0; i < 11; i++ {
+		addBook(t, db, fmt.Sprintf("Volume %d", i%4))
+	}
+	all, err := db.ListBooks(ctx, dao.ListOptions{})
+	if err != nil {
+		t.Fatalf("ListBooks() = %v", err)
+	}
+	if len(all) != 11 {
+		t.Fatalf("ListBooks() returned %d books, want 11", len(all))
+	}
+	var paged []*pb.Book
+	var after *dao.Cursor
+	for {
+		page, err := db.ListBooks(ctx, dao.ListOptions{After: after, Limit: 3})
+		if err != nil {
+			t.Fatalf("ListBooks(%v, 3) = %v", after, err)
+		}
+		if len(page) > 3 {
+			t.Fatalf("ListBooks(%v, 3) returned %d books", after, len(page))
+		}
+		if len(page) == 0 {
+			break
+		}
+		paged = append(paged, page...)
+		after = dao.CursorOf(page[len(page)-1], nil)
+	}
+	if fmt.Sprint(ids(paged)) != fmt.Sprint(ids(all)) {
+		t.Errorf("pages of ListBooks() = %v, want %v", ids(paged), ids(all))
+	}
+}
+
+// shelf adds books for the filter and order tests, the IDs are in the order of
+// the titles
+func shelf(t *testing.T, db dao.BookDatabase) map[string]*pb.Book {
+	books := map[string]*pb.Book{}
+	for _, b := range []*pb.Book{
+		{Title: "A Map of the World", Author: "Gopher", PublishedDate: "2015", Description: "Maps"},
+		{Title: "Emma", Author: "Jane Austen", PublishedDate: "1815-12-23", Description: "Matchmaking in RÉGENCY England"},
+		{Title: "Go Programming", Author: "Gopher", PublishedDate: "2015-10-26", Description: "Learn Go"},
+		{Title: "Persuasion", Author: "Jane Austen", PublishedDate: "1817", Description: "A second chance"},
+		{Title: "The Treasure MAP", Author: "Pirate", PublishedDate: "1999-01", Description: ""},
+	} {
+		if _, err := db.AddBook(context.Background(), b); err != nil {
+			t.Fatalf("AddBook(%v) = %v", b, err)
+		}
+		books[b.Title] = b
+	}
+	return books
+}
+
+func testListFilter(t *testing.T, db dao.BookDatabase) {
+	shelf(t, db)
+	tests := []struct {
+		filter string
+		want   []string // Titles in title order
+	}{
+		{``, []string{"A Map of the World", "Emma", "Go Programming", "Persuasion", "The Treasure MAP"}},
+		{`author="Gopher"`, []string{"A Map of the World", "Go Programming"}},
+		{`author = "gopher"`, nil},
+		{`author:"gopher"`, []string{"A Map of the World", "Go Programming"}},
+		{`author="Gopher" AND title:"map"`, []string{"A Map of the World"}},
+		{`title:map`, []string{"A Map of the World", "The Treasure MAP"}},
+		{`map`, []string{"A Map of the World", "The Treasure MAP"}},
+		{`"second chance"`, []string{"Persuasion"}},
+		{`author!="Gopher"`, []string{"Emma", "Persuasion", "The Treasure MAP"}},
+		{`NOT author="Gopher"`, []string{"Emma", "Persuasion", "The Treasure MAP"}},
+		{`-author="Gopher"`, []string{"Emma", "Persuasion", "The Treasure MAP"}},
+		{`author="Pirate" OR author="Jane Austen"`, []string{"Emma", "Persuasion", "The Treasure MAP"}},
+		{`publishedDate >= 2015`, []string{"A Map of the World", "Go Programming"}},
+		{`publishedDate < "1900"`, []string{"Emma", "Persuasion"}},
+		{`author:Austen publishedDate>1816`, []string{"Persuasion"}},
+		{`author="Gopher" AND title:Go OR title:Map`, []string{"A Map of the World", "Go Programming"}},
+		{`(author="Pirate" OR author="Gopher") AND NOT map`, []string{"Go Programming"}},
+		{`description=""`, []string{"The Treasure MAP"}},
+		// Only ASCII letters are folded, as SQLite's lower only folds those
+		{`description:"regency"`, nil},
+		{`description:"RÉGENCY"`, []string{"Emma"}},
+		{`description:"rÉgency"`, []string{"Emma"}},
+		{`description:"régency"`, nil},
+	}
+	for _, tt := range tests {
+		f, err := dao.ParseFilter(tt.filter)
+		if err != nil {
+			t.Fatalf("ParseFilter(%q) = %v", tt.filter, err)
+		}
+		got, err := db.ListBooks(context.Background(), dao.ListOptions{Filter: f})
+		if err != nil {
+			t.Fatalf("ListBooks(%q) = %v", tt.filter, err)
+		}
+		if fmt.Sprint(titles(got)) != fmt.Sprint(tt.want) {
+			t.Errorf("ListBooks(%q) = %q, want %q", tt.filter, titles(got), tt.want)
+		}
+	}
+}
+
+func titles(books []*pb.Book) []string {
+	var s []string
+	for _, b := range books {
+		s = append(s, b.Title)
+	}
+	return s
+}
+
+func testListOrderBy(t *testing.T, db dao.BookDatabase) {
+	shelf(t, db)
+	tests := []struct {
+		orderBy string
+		want    []string
+	}{
+		{`title desc`, []string{"The Treasure MAP", "Persuasion", "Go Programming", "Emma", "A Map of the World"}},
+		{`publishedDate`, []string{"Emma", "Persuasion", "The Treasure MAP", "A Map of the World", "Go Programming"}},
+		{`author desc, publishedDate desc`, []string{"The Treasure MAP", "Persuasion", "Emma", "Go Programming", "A Map of the World"}},
+		{`author, title desc`, []string{"Go Programming", "A Map of the World", "Persuasion", "Emma", "The Treasure MAP"}},
+		{`author, id`, []string{"A Map of the World", "Go Programming", "Emma", "Persuasion", "The Treasure MAP"}},
+	}
+	for _, tt := range tests {
+		order, err := dao.ParseOrderBy(tt.orderBy)
+		if err != nil {
+			t.Fatalf("ParseOrderBy(%q) = %v", tt.orderBy, err)
+		}
+		got, err := db.ListBooks(context.Background(), dao.ListOptions{OrderBy: order})
+		if err != nil {
+			t.Fatalf("ListBooks(%q) = %v", tt.orderBy, err)
+		}
+		if fmt.Sprint(titles(got)) != fmt.Sprint(tt.want) {
+			t.Errorf("ListBooks(%q) = %q, want %q", tt.orderBy, titles(got), tt.want)
+		}
+	}
+}
+
+func testListOrderByPages(t *testing.T, db dao.BookDatabase) {
+	ctx := context.Background()
+	for i := 0; i < 13; i++ {
+		b := &pb.Book{Title: fmt.Sprintf("Volume %d", i%3), Author: fmt.Sprintf("Author %d", i%4)}
+		if _, err := db.AddBook(ctx, b); err != nil {
+			t.Fatalf("AddBook(%v) = %v", b, err)
+		}
+	}
+	order, err := dao.ParseOrderBy("author desc, title")
+	if err != nil {
+		t.Fatalf("ParseOrderBy() = %v", err)
+	}
+	f, err := dao.ParseFilter(`-title="Volume 1"`)
+	if err != nil {
+		t.Fatalf("ParseFilter() = %v", err)
+	}
+	all, err := db.ListBooks(ctx, dao.ListOptions{Filter: f, OrderBy: order})
+	if err != nil {
+		t.Fatalf("ListBooks() = %v", err)
+	}
+	var paged []*pb.Book
+	var after *dao.Cursor
+	for {
+		page, err := db.ListBooks(ctx, dao.ListOptions{Filter: f, OrderBy: order, After: after, Limit: 2})
+		if err != nil {
+			t.Fatalf("ListBooks(%v, 2) = %v", after, err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		paged = append(paged, page...)
+		after = dao.CursorOf(page[len(page)-1], order)
+	}
+	if len(all) != 9 || fmt.Sprint(ids(paged)) != fmt.Sprint(ids(all)) {
+		t.Errorf("pages of ListBooks() = %v, want %v", ids(paged), ids(all))
+	}
+	if _, err := db.ListBooks(ctx, dao.ListOptions{After: after}); !errors.Is(err, dao.ErrInvalidArgument) {
+		t.Errorf("ListBooks() with a cursor from another order = %v, want %v", err, dao.ErrInvalidArgument)
+	}
+}
+
+func testConcurrentWriters(t *testing.T, db dao.BookDatabase) {
+	const writers, each = 8, 10
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	errs := make(chan error, writers*each)
+	idc := make(chan string, writers*each)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				b := &pb.Book{Title: fmt.Sprintf("Writer %d book %d", w, i)}
+				id, err := db.AddBook(ctx, b)
+				if err != nil {
+					errs <- err
+					continue
+				}
+				idc <- id
+				b.Author = "Updated"
+				if err := db.UpdateBook(ctx, b); err != nil {
+					errs <- err
+				}
+				if _, err := db.ListBooks(ctx, dao.ListOptions{Limit: 5}); err != nil {
+					errs <- err
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	close(idc)
+	for err := range errs {
+		t.Errorf("concurrent write: %v", err)
+	}
+	seen := map[string]bool{}
+	for id := range idc {
+		if seen[id] {
+			t.Errorf("ID %q given to two books", id)
+		}
+		seen[id] = true
+	}
+	books, err := db.ListBooks(ctx, dao.ListOptions{})
+	if err != nil {
+		t.Fatalf("ListBooks() = %v", err)
+	}
+	if len(books) != writers*each {
+		t.Errorf("ListBooks() returned %d books, want %d", len(books), writers*each)
+	}
+	for _, b := range books {
+		if b.Author != "Updated" {
+			t.Errorf("book %q lost its update", b.Id)
+		}
+	}
+}
+
+func testContextCancelled(t *testing.T, db dao.BookDatabase) {
+	b := addBook(t, db, "Cancelled")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	check := func(op string, err error) {
+		t.Helper()
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("%s with a cancelled context = %v, want %v", op, err, context.Canceled)
+		}
+	}
+	_, err := db.GetBook(ctx, b.Id)
+	check("GetBook", err)
+	_, err = db.ListBooks(ctx, dao.ListOptions{})
+	check("ListBooks", err)
+	_, err = db.AddBook(ctx, &pb.Book{Title: "Not added"})
+	check("AddBook", err)
+	check("UpdateBook", db.UpdateBook(ctx, &pb.Book{Id: b.Id, Title: "Not updated"}))
+	check("DeleteBook", db.DeleteBook(ctx, b.Id, ""))
+
+	got, err := db.GetBook(context.Background(), b.Id)
+	if err != nil {
+		t.Fatalf("GetBook(%q) = %v, cancelled DeleteBook deleted it", b.Id, err)
+	}
+	sameBook(t, got, b)
+	books, err := db.ListBooks(context.Background(), dao.ListOptions{})
+	if err != nil {
+		t.Fatalf("ListBooks() = %v", err)
+	}
+	if len(books) != 1 {
+		t.Errorf("ListBooks() = %v, cancelled AddBook added a book", ids(books))
+	}
+}
@@ -17,11 +17,12 @@ package dao
 import (
 	pb "book/pb/pb_book_v1"
 	"context"
-	"errors"
 	"fmt"
 	"sort"
 	"strconv"
 	"sync"
+
+	"google.golang.org/protobuf/proto"
 )
 
 var _ BookDatabase = &memoryDB{}
@@ -40,6 +41,13 @@ func NewMemoryDB() (*memoryDB, error) {
 	}, nil
 }
 
+// Len is the number of books, for the book_memorydb_books metric
+func (db *memoryDB) Len() int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return len(db.books)
+}
+
 // Close closes the database.
 func (db *memoryDB) Close(context.Context) error {
 	db.mu.Lock()
@@ -50,72 +58,140 @@ func (db *memoryDB) Close(context.Context) error {
 	return nil
 }
 
+// copyBook stops callers sharing the books held in the map, so they can't
+// change a book without the lock
+func copyBook(b *pb.Book) *pb.Book {
+	return proto.Clone(b).(*pb.Book)
+}
+
 // GetBook retrieves a book by its ID.
-func (db *memoryDB) GetBook(_ context.Context, id string) (*pb.Book, error) {
+func (db *memoryDB) GetBook(ctx context.Context, id string) (*pb.Book, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("memorydb: could not get book with ID %q: %w", id, err)
+	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	if db.books == nil {
+		return nil, fmt.Errorf("memorydb: could not get book with ID %q: %w", id, ErrUnavailable)
+	}
 	book, ok := db.books[id]
 	if !ok {
-		return nil, fmt.Errorf("memorydb: book not found with ID %q", id)
+		return nil, fmt.Errorf("memorydb: book with ID %q: %w", id, ErrNotFound)
 	}
-	return book, nil
+	return copyBook(book), nil
 }
 
 // AddBook saves a given book, assigning it a new ID.
-func (db *memoryDB) AddBook(_ context.Context, b *pb.Book) (id string, err error) {
+func (db *memoryDB) AddBook(ctx context.Context, b *pb.Book) (id string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", fmt.Errorf("memorydb: could not add book: %w", err)
+	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	if db.books == nil {
+		return "", fmt.Errorf("memorydb: could not add book: %w", ErrUnavailable)
+	}
 	b.Id = strconv.FormatInt(db.nextID, 10)
-	db.books[b.Id] = b
+	b.Etag = nextEtag("")
+	db.books[b.Id] = copyBook(b)
 
 	db.nextID++
 
 	return b.Id, nil
 }
 
-// DeleteBook removes a given book by its ID.
-func (db *memoryDB) DeleteBook(_ context.Context, id string) error {
+// DeleteBook removes a given book by its ID, if the etag is set it must match.
+func (db *memoryDB) DeleteBook(ctx context.Context, id, etag string) error {
 	if id == "" {
-		return errors.New("memorydb: book with unassigned ID passed into DeleteBook")
+		return fmt.Errorf("memorydb: book with unassigned ID passed into DeleteBook: %w", ErrInvalidArgument)
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("memorydb: could not delete book with ID %q: %w", id, err)
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	if _, ok := db.books[id]; !ok {
-		return fmt.Errorf("memorydb: could not delete book with ID %q, does not exist", id)
+	if db.books == nil {
+		return fmt.Errorf("memorydb: could not delete book with ID %q: %w", id, ErrUnavailable)
+	}
+	book, ok := db.books[id]
+	if !ok {
+		return fmt.Errorf("memorydb: could not delete book with ID %q: %w", id, ErrNotFound)
+	}
+	if etag != "" && etag != book.Etag {
+		return fmt.Errorf("memorydb: could not delete book with ID %q: %w", id, ErrConflict)
 	}
 	delete(db.books, id)
 	return nil
 }
 
-// UpdateBook updates the entry for a given book.
-func (db *memoryDB) UpdateBook(_ context.Context, b *pb.Book) error {
+// UpdateBook updates the entry for a given book, which must already exist
+// and have the same etag if the etag of the book is set.
+func (db *memoryDB) UpdateBook(ctx context.Context, b *pb.Book) error {
 	if b.Id == "" {
-		return errors.New("memorydb: book with unassigned ID passed into UpdateBook")
+		return fmt.Errorf("memorydb: book with unassigned ID passed into UpdateBook: %w", ErrInvalidArgument)
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("memorydb: could not update book with ID %q: %w", b.Id, err)
 	}
 
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
-	db.books[b.Id] = b
+	if db.books == nil {
+		return fmt.Errorf("memorydb: could not update book with ID %q: %w", b.Id, ErrUnavailable)
+	}
+	book, ok := db.books[b.Id]
+	if !ok {
+		return fmt.Errorf("memorydb: could not update book with ID %q: %w", b.Id, ErrNotFound)
+	}
+	if b.Etag != "" && b.Etag != book.Etag {
+		return fmt.Errorf("memorydb: could not update book with ID %q: %w", b.Id, ErrConflict)
+	}
+	b.Etag = nextEtag(book.Etag)
+	db.books[b.Id] = copyBook(b)
 	return nil
 }
 
-// ListBooks returns a list of books, ordered by title.
-func (db *memoryDB) ListBooks(_ context.Context) ([]*pb.Book, error) {
+// ListBooks returns the books that match the options.
+func (db *memoryDB) ListBooks(ctx context.Context, opts ListOptions) ([]*pb.Book, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("memorydb: could not list books: %w", err)
+	}
+	if err := opts.After.check(opts.OrderBy); err != nil {
+		return nil, fmt.Errorf("memorydb: could not list books: %w", err)
+	}
+
 	db.mu.Lock()
 	defer db.mu.Unlock()
 
+	if db.books == nil {
+		return nil, fmt.Errorf("memorydb: could not list books: %w", ErrUnavailable)
+	}
 	var books []*pb.Book
 	for _, b := range db.books {
-		books = append(books, b)
+		if opts.After.after(b, opts.OrderBy) && opts.Filter.Match(b) {
+			books = append(books, copyBook(b))
+		}
 	}
 
 	sort.Slice(books, func(i, j int) bool {
-		return books[i].Title < books[j].Title
+		return opts.OrderBy.Less(books[i], books[j])
 	})
+	if opts.Limit > 0 && len(books) > opts.Limit {
+		books = books[:opts.Limit]
+	}
 	return books, nil
 }
+
+// nextEtag returns the etag of the next revision of a book, the etag of a
+// book is its revision number which starts at 1
+func nextEtag(etag string) string {
+	rev, _ := strconv.ParseInt(etag, 10, 64)
+	return strconv.FormatInt(rev+1, 10)
+}
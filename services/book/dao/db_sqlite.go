@@ -0,0 +1,362 @@
+package dao
+
+import (
+	pb "book/pb/pb_book_v1"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/mattn/go-sqlite3" // Registers the sqlite3 database/sql driver, needs CGO
+)
+
+var _ BookDatabase = &sqliteDB{}
+
+// sqliteDB is a persistence layer for books backed by a SQLite database file.
+type sqliteDB struct {
+	db     *sql.DB
+	closed int32 // Set by Close, atomic
+}
+
+// errClosed is the cause of ErrUnavailable once the database is closed
+var errClosed = errors.New("the database is closed")
+
+// migrations are applied in order to bring the schema up to date, the version of
+// a schema is the number of migrations applied to it.  Only ever add to the end
+// of this list, never change a migration that has been released.
+var migrations = []string{
+	// 1: The books table, the ID is a number and books are listed in ID order
+	`CREATE TABLE books (
+		id             INTEGER PRIMARY KEY AUTOINCREMENT,
+		title          TEXT NOT NULL DEFAULT '',
+		author         TEXT NOT NULL DEFAULT '',
+		published_date TEXT NOT NULL DEFAULT '',
+		image_url      TEXT NOT NULL DEFAULT '',
+		description    TEXT NOT NULL DEFAULT ''
+	)`,
+	// 2: Listing books walks the title index, which has the ID as its rowid
+	`CREATE INDEX books_title ON books (title)`,
+	// 3: The revision is the etag of a book, it goes up by one on every update
+	`ALTER TABLE books ADD COLUMN revision INTEGER NOT NULL DEFAULT 1`,
+}
+
+// NewSQLiteDB opens the SQLite database given by dsn, e.g. "book.db" or
+// "file::memory:?cache=shared", and migrates the schema to the latest version.
+func NewSQLiteDB(dsn string) (*sqliteDB, error) {
+	if dsn == "" {
+		return nil, errors.New("sqlitedb: no data source name")
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("sqlitedb: could not open %q: %w", dsn, err)
+	}
+	// SQLite only allows one writer at a time, a single connection queues
+	// the writers up rather than failing with "database is locked"
+	db.SetMaxOpenConns(1)
+	s := &sqliteDB{db: db}
+	if err := s.migrate(context.Background()); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrate applies any migrations that are newer than the schema version of the database.
+func (s *sqliteDB) migrate(ctx context.Context) error {
+	if _, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`); err != nil {
+		return fmt.Errorf("sqlitedb: could not create schema_version: %w", err)
+	}
+	var version int
+	err := s.db.QueryRowContext(ctx, `SELECT version FROM schema_version`).Scan(&version)
+	switch {
+	case err == sql.ErrNoRows:
+		if _, err := s.db.ExecContext(ctx, `INSERT INTO schema_version (version) VALUES (0)`); err != nil {
+			return fmt.Errorf("sqlitedb: could not initialise schema_version: %w", err)
+		}
+	case err != nil:
+		return fmt.Errorf("sqlitedb: could not read schema_version: %w", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("sqlitedb: schema version %d is newer than this service (%d)", version, len(migrations))
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("sqlitedb: migration %d: %w", i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlitedb: migration %d: %w", i+1, err)
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE schema_version SET version = ?`, i+1); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("sqlitedb: migration %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("sqlitedb: migration %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// Close closes the database.
+func (s *sqliteDB) Close(context.Context) error {
+	atomic.StoreInt32(&s.closed, 1)
+	return s.db.Close()
+}
+
+// checkOpen is ErrUnavailable if the database has been closed, which is
+// checked before a query as database/sql has no error to tell it apart
+func (s *sqliteDB) checkOpen() error {
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return &sqliteError{kind: ErrUnavailable, err: errClosed}
+	}
+	return nil
+}
+
+const bookColumns = `CAST(id AS TEXT), title, author, published_date, image_url, description, CAST(revision AS TEXT)`
+
+// scanBook reads a row of bookColumns
+func scanBook(row interface{ Scan(...interface{}) error }) (*pb.Book, error) {
+	b := &pb.Book{}
+	err := row.Scan(&b.Id, &b.Title, &b.Author, &b.PublishedDate, &b.ImageURL, &b.Description, &b.Etag)
+	return b, err
+}
+
+// rowID is the primary key of the book with the ID, an ID that isn't one the
+// database gives out names no book
+func rowID(id string) (int64, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || strconv.FormatInt(n, 10) != id {
+		return 0, ErrNotFound
+	}
+	return n, nil
+}
+
+// GetBook retrieves a book by its ID.
+func (s *sqliteDB) GetBook(ctx context.Context, id string) (*pb.Book, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, fmt.Errorf("sqlitedb: could not get book %q: %w", id, err)
+	}
+	n, err := rowID(id)
+	if err != nil {
+		return nil, fmt.Errorf("sqlitedb: book with ID %q: %w", id, err)
+	}
+	book, err := scanBook(s.db.QueryRowContext(ctx, `SELECT `+bookColumns+` FROM books WHERE id = ?`, n))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("sqlitedb: book with ID %q: %w", id, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sqlitedb: could not get book %q: %w", id, classify(err))
+	}
+	return book, nil
+}
+
+// AddBook saves a given book, assigning it a new ID.
+func (s *sqliteDB) AddBook(ctx context.Context, b *pb.Book) (id string, err error) {
+	if err := s.checkOpen(); err != nil {
+		return "", fmt.Errorf("sqlitedb: could not add book: %w", err)
+	}
+	res, err := s.db.ExecContext(ctx,
+		`INSERT INTO books (title, author, published_date, image_url, description, revision) VALUES (?, ?, ?, ?, ?, 1)`,
+		b.Title, b.Author, b.PublishedDate, b.ImageURL, b.Description)
+	if err != nil {
+		return "", fmt.Errorf("sqlitedb: could not add book: %w", classify(err))
+	}
+	n, err := res.LastInsertId()
+	if err != nil {
+		return "", fmt.Errorf("sqlitedb: could not get ID of new book: %w", err)
+	}
+	b.Id = strconv.FormatInt(n, 10)
+	b.Etag = "1"
+	return b.Id, nil
+}
+
+// DeleteBook removes a given book by its ID, if the etag is set it must match.
+func (s *sqliteDB) DeleteBook(ctx context.Context, id, etag string) error {
+	if err := s.checkOpen(); err != nil {
+		return fmt.Errorf("sqlitedb: could not delete book with ID %q: %w", id, err)
+	}
+	if id == "" {
+		return fmt.Errorf("sqlitedb: book with unassigned ID passed into DeleteBook: %w", ErrInvalidArgument)
+	}
+	n, err := rowID(id)
+	if err != nil {
+		return fmt.Errorf("sqlitedb: could not delete book with ID %q: %w", id, err)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("sqlitedb: could not delete book with ID %q: %w", id, classify(err))
+	}
+	defer tx.Rollback()
+	if err := checkEtag(ctx, tx, n, etag); err != nil {
+		return fmt.Errorf("sqlitedb: could not delete book with ID %q: %w", id, err)
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM books WHERE id = ?`, n); err != nil {
+		return fmt.Errorf("sqlitedb: could not delete book with ID %q: %w", id, classify(err))
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("sqlitedb: could not delete book with ID %q: %w", id, classify(err))
+	}
+	return nil
+}
+
+// UpdateBook updates the entry for a given book, which must already exist
+// and have the same etag if the etag of the book is set.
+func (s *sqliteDB) UpdateBook(ctx context.Context, b *pb.Book) error {
+	if err := s.checkOpen(); err != nil {
+		return fmt.Errorf("sqlitedb: could not update book with ID %q: %w", b.GetId(), err)
+	}
+	if b.Id == "" {
+		return fmt.Errorf("sqlitedb: book with unassigned ID passed into UpdateBook: %w", ErrInvalidArgument)
+	}
+	n, err := rowID(b.Id)
+	if err != nil {
+		return fmt.Errorf("sqlitedb: could not update book with ID %q: %w", b.Id, err)
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("sqlitedb: could not update book with ID %q: %w", b.Id, classify(err))
+	}
+	defer tx.Rollback()
+	if err := checkEtag(ctx, tx, n, b.Etag); err != nil {
+		return fmt.Errorf("sqlitedb: could not update book with ID %q: %w", b.Id, err)
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE books SET title = ?, author = ?, published_date = ?, image_url = ?, description = ?, revision = revision + 1 WHERE id = ?`,
+		b.Title, b.Author, b.PublishedDate, b.ImageURL, b.Description, n); err != nil {
+		return fmt.Errorf("sqlitedb: could not update book with ID %q: %w", b.Id, classify(err))
+	}
+	var etag string
+	if err := tx.QueryRowContext(ctx, `SELECT CAST(revision AS TEXT) FROM books WHERE id = ?`, n).Scan(&etag); err != nil {
+		return fmt.Errorf("sqlitedb: could not update book with ID %q: %w", b.Id, classify(err))
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("sqlitedb: could not update book with ID %q: %w", b.Id, classify(err))
+	}
+	b.Etag = etag
+	return nil
+}
+
+// checkEtag makes sure the book exists and, if etag is set, that it hasn't changed
+func checkEtag(ctx context.Context, tx *sql.Tx, id int64, etag string) error {
+	var current string
+	err := tx.QueryRowContext(ctx, `SELECT CAST(revision AS TEXT) FROM books WHERE id = ?`, id).Scan(&current)
+	switch {
+	case err == sql.ErrNoRows:
+		return ErrNotFound
+	case err != nil:
+		return classify(err)
+	case etag != "" && etag != current:
+		return ErrConflict
+	}
+	return nil
+}
+
+// ListBooks returns the books that match the options.
+func (s *sqliteDB) ListBooks(ctx context.Context, opts ListOptions) ([]*pb.Book, error) {
+	if err := s.checkOpen(); err != nil {
+		return nil, fmt.Errorf("sqlitedb: could not list books: %w", err)
+	}
+	if err := opts.After.check(opts.OrderBy); err != nil {
+		return nil, fmt.Errorf("sqlitedb: could not list books: %w", err)
+	}
+	where, args := opts.Filter.SQL()
+	if opts.After != nil {
+		after, afterArgs := afterSQL(opts.After, opts.OrderBy)
+		where += ` AND ` + after
+		args = append(args, afterArgs...)
+	}
+	query := `SELECT ` + bookColumns + ` FROM books WHERE ` + where + ` ORDER BY ` + orderSQL(opts.OrderBy)
+	if opts.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, opts.Limit)
+	}
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("sqlitedb: could not list books: %w", classify(err))
+	}
+	defer rows.Close()
+
+	var books []*pb.Book
+	for rows.Next() {
+		b, err := scanBook(rows)
+		if err != nil {
+			return nil, fmt.Errorf("sqlitedb: could not read book: %w", classify(err))
+		}
+		books = append(books, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("sqlitedb: could not list books: %w", classify(err))
+	}
+	return books, nil
+}
+
+// orderSQL is the ORDER BY clause for the listing order
+func orderSQL(order OrderBy) string {
+	keys := order.keys()
+	parts := make([]string, len(keys))
+	for i, f := range keys {
+		parts[i] = orderColumn(f.Field)
+		if f.Desc {
+			parts[i] += ` DESC`
+		}
+	}
+	return strings.Join(parts, `, `)
+}
+
+// afterSQL is the condition for the books listed after the cursor, e.g. for
+// title order it is title > ? OR (title = ? AND id > ?)
+func afterSQL(c *Cursor, order OrderBy) (string, []interface{}) {
+	keys := order.keys()
+	var ors []string
+	var args []interface{}
+	for i, f := range keys {
+		var ands []string
+		for j := 0; j < i; j++ {
+			ands = append(ands, orderColumn(keys[j].Field)+` = ?`)
+			args = append(args, c.Keys[j])
+		}
+		op := ` > ?`
+		if f.Desc {
+			op = ` < ?`
+		}
+		ands = append(ands, orderColumn(f.Field)+op)
+		args = append(args, c.Keys[i])
+		ors = append(ors, `(`+strings.Join(ands, ` AND `)+`)`)
+	}
+	return `(` + strings.Join(ors, ` OR `) + `)`, args
+}
+
+// sqliteError keeps the error from SQLite but is also one of the dao errors
+type sqliteError struct {
+	kind error
+	err  error
+}
+
+func (e *sqliteError) Error() string        { return e.err.Error() }
+func (e *sqliteError) Unwrap() error        { return e.err }
+func (e *sqliteError) Is(target error) bool { return target == e.kind }
+
+// classify marks the errors from SQLite that have a matching dao error
+func classify(err error) error {
+	var sqlErr sqlite3.Error
+	switch {
+	case errors.As(err, &sqlErr):
+		switch sqlErr.Code {
+		case sqlite3.ErrBusy, sqlite3.ErrLocked, sqlite3.ErrCantOpen, sqlite3.ErrIoErr, sqlite3.ErrReadonly, sqlite3.ErrFull:
+			return &sqliteError{kind: ErrUnavailable, err: err}
+		case sqlite3.ErrConstraint:
+			if sqlErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqlErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+				return &sqliteError{kind: ErrAlreadyExists, err: err}
+			}
+			return &sqliteError{kind: ErrInvalidArgument, err: err}
+		}
+	case errors.Is(err, sql.ErrConnDone):
+		return &sqliteError{kind: ErrUnavailable, err: err}
+	}
+	return err
+}
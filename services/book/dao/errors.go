@@ -0,0 +1,14 @@
+package dao
+
+import "errors"
+
+// Every BookDatabase implementation wraps these errors so the book service can
+// tell the client what went wrong without knowing which database is in use,
+// check them with errors.Is
+var (
+	ErrNotFound        = errors.New("book not found")
+	ErrAlreadyExists   = errors.New("book already exists")
+	ErrInvalidArgument = errors.New("invalid book")
+	ErrUnavailable     = errors.New("book database unavailable")
+	ErrConflict        = errors.New("book has changed, the etag is out of date")
+)
@@ -0,0 +1,360 @@
+package dao
+
+import (
+	pb "book/pb/pb_book_v1"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Filter picks the books to list, it is parsed from an AIP-160 filter such as
+// `author="Gopher" AND title:"map"`.  memoryDB matches books with Match and
+// sqliteDB turns the filter into a WHERE clause.
+type Filter struct {
+	expr filterExpr
+}
+
+// globalFields are searched by a term on its own, e.g. `map`
+var globalFields = []string{"title", "author", "description"}
+
+// filterExpr is a node of a parsed filter
+type filterExpr interface {
+	match(b *pb.Book) bool
+	sql() (string, []interface{})
+}
+
+type andExpr []filterExpr
+type orExpr []filterExpr
+type notExpr struct{ expr filterExpr }
+
+// restriction compares a field with a value, op is one of = != < <= > >= :
+type restriction struct {
+	field string
+	op    string
+	value string
+}
+
+func (e andExpr) match(b *pb.Book) bool {
+	for _, x := range e {
+		if !x.match(b) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e orExpr) match(b *pb.Book) bool {
+	for _, x := range e {
+		if x.match(b) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e notExpr) match(b *pb.Book) bool { return !e.expr.match(b) }
+
+func (r restriction) match(b *pb.Book) bool {
+	v := bookFields[r.field].value(b)
+	switch r.op {
+	case "=":
+		return v == r.value
+	case "!=":
+		return v != r.value
+	case "<":
+		return v < r.value
+	case "<=":
+		return v <= r.value
+	case ">":
+		return v > r.value
+	case ">=":
+		return v >= r.value
+	}
+	return strings.Contains(lowerASCII(v), lowerASCII(r.value))
+}
+
+// lowerASCII folds only the ASCII letters, as SQLite's lower does, so ":"
+// matches the same books in every database
+func lowerASCII(s string) string {
+	return strings.Map(func(r rune) rune {
+		if 'A' <= r && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		return r
+	}, s)
+}
+
+func (e andExpr) sql() (string, []interface{}) { return joinSQL(" AND ", e) }
+func (e orExpr) sql() (string, []interface{})  { return joinSQL(" OR ", e) }
+
+func (e notExpr) sql() (string, []interface{}) {
+	s, args := e.expr.sql()
+	return "NOT " + s, args
+}
+
+func (r restriction) sql() (string, []interface{}) {
+	column := bookFields[r.field].column
+	if r.op == ":" {
+		// SQLite's lower only folds ASCII letters, as lowerASCII does
+		return "instr(lower(" + column + "), lower(?)) > 0", []interface{}{r.value}
+	}
+	return column + " " + r.op + " ?", []interface{}{r.value}
+}
+
+func joinSQL(sep string, exprs []filterExpr) (string, []interface{}) {
+	parts := make([]string, len(exprs))
+	var args []interface{}
+	for i, x := range exprs {
+		var a []interface{}
+		parts[i], a = x.sql()
+		args = append(args, a...)
+	}
+	return "(" + strings.Join(parts, sep) + ")", args
+}
+
+// Match reports if the book matches the filter, a nil filter matches every book.
+func (f *Filter) Match(b *pb.Book) bool {
+	return f == nil || f.expr.match(b)
+}
+
+// SQL returns the filter as a SQL condition on the books table with its
+// arguments, a nil filter is always true.
+func (f *Filter) SQL() (string, []interface{}) {
+	if f == nil {
+		return "1", nil
+	}
+	return f.expr.sql()
+}
+
+// ParseFilter parses an AIP-160 filter, an empty filter returns nil which
+// matches every book.  The grammar is
+//
+//	expression  = sequence {"AND" sequence}
+//	sequence    = factor {factor}
+//	factor      = term {"OR" term}
+//	term        = ["NOT" | "-"] simple
+//	simple      = restriction | "(" expression ")"
+//	restriction = value [comparator value]
+//
+// so OR binds tighter than AND, as AIP-160 says.
+func ParseFilter(s string) (*Filter, error) {
+	toks, err := lexFilter(s)
+	if err != nil {
+		return nil, fmt.Errorf("filter %q: %v: %w", s, err, ErrInvalidArgument)
+	}
+	if len(toks) == 0 {
+		return nil, nil
+	}
+	p := &filterParser{toks: toks}
+	expr, err := p.expression()
+	if err == nil && !p.done() {
+		err = fmt.Errorf("unexpected %q", p.peek().text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("filter %q: %v: %w", s, err, ErrInvalidArgument)
+	}
+	return &Filter{expr: expr}, nil
+}
+
+type tokenKind int
+
+const (
+	tokWord tokenKind = iota
+	tokString
+	tokComparator
+	tokLParen
+	tokRParen
+	tokMinus
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// lexFilter splits a filter into tokens
+func lexFilter(s string) ([]token, error) {
+	var toks []token
+	rs := []rune(s)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			toks = append(toks, token{tokLParen, "("})
+			i++
+		case r == ')':
+			toks = append(toks, token{tokRParen, ")"})
+			i++
+		case r == '-':
+			toks = append(toks, token{tokMinus, "-"})
+			i++
+		case r == '"' || r == '\'':
+			var sb strings.Builder
+			j := i + 1
+			for ; j < len(rs) && rs[j] != r; j++ {
+				if rs[j] == '\\' && j+1 < len(rs) {
+					j++
+				}
+				sb.WriteRune(rs[j])
+			}
+			if j == len(rs) {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			toks = append(toks, token{tokString, sb.String()})
+			i = j + 1
+		case strings.ContainsRune("=!<>:", r):
+			op := string(r)
+			if i+1 < len(rs) && rs[i+1] == '=' && r != '=' && r != ':' {
+				op += "="
+			}
+			if op == "!" {
+				return nil, fmt.Errorf("unexpected '!' at %d", i)
+			}
+			toks = append(toks, token{tokComparator, op})
+			i += len(op)
+		default:
+			j := i
+			for ; j < len(rs) && !unicode.IsSpace(rs[j]) && !strings.ContainsRune(`()"'=!<>:`, rs[j]); j++ {
+			}
+			toks = append(toks, token{tokWord, string(rs[i:j])})
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+type filterParser struct {
+	toks []token
+	pos  int
+}
+
+func (p *filterParser) done() bool { return p.pos >= len(p.toks) }
+
+func (p *filterParser) peek() token {
+	if p.done() {
+		return token{kind: -1}
+	}
+	return p.toks[p.pos]
+}
+
+func (p *filterParser) keyword(k string) bool {
+	if t := p.peek(); t.kind == tokWord && t.text == k {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) expression() (filterExpr, error) {
+	and := andExpr{}
+	for {
+		seq, err := p.sequence()
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, seq)
+		if !p.keyword("AND") {
+			break
+		}
+	}
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+// sequence is factors next to each other, which must all match
+func (p *filterParser) sequence() (filterExpr, error) {
+	seq := andExpr{}
+	for {
+		f, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, f)
+		if t := p.peek(); p.done() || t.kind == tokRParen || (t.kind == tokWord && t.text == "AND") {
+			break
+		}
+	}
+	if len(seq) == 1 {
+		return seq[0], nil
+	}
+	return seq, nil
+}
+
+func (p *filterParser) factor() (filterExpr, error) {
+	or := orExpr{}
+	for {
+		t, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, t)
+		if !p.keyword("OR") {
+			break
+		}
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+func (p *filterParser) term() (filterExpr, error) {
+	if p.keyword("NOT") || p.peek().kind == tokMinus {
+		if p.peek().kind == tokMinus {
+			p.pos++
+		}
+		e, err := p.simple()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{e}, nil
+	}
+	return p.simple()
+}
+
+func (p *filterParser) simple() (filterExpr, error) {
+	t := p.peek()
+	switch {
+	case p.done():
+		return nil, fmt.Errorf("unexpected end of filter")
+	case t.kind == tokLParen:
+		p.pos++
+		e, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != tokRParen {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		p.pos++
+		return e, nil
+	case t.kind == tokWord && (t.text == "AND" || t.text == "OR" || t.text == "NOT"):
+		return nil, fmt.Errorf("unexpected %s", t.text)
+	case t.kind != tokWord && t.kind != tokString:
+		return nil, fmt.Errorf("unexpected %q", t.text)
+	}
+	p.pos++
+	if p.peek().kind != tokComparator {
+		// A term on its own searches the global fields
+		or := orExpr{}
+		for _, field := range globalFields {
+			or = append(or, restriction{field: field, op: ":", value: t.text})
+		}
+		return or, nil
+	}
+	op := p.peek().text
+	p.pos++
+	if _, ok := bookFields[t.text]; !ok || t.kind != tokWord {
+		return nil, fmt.Errorf("unknown field %q", t.text)
+	}
+	v := p.peek()
+	if v.kind != tokWord && v.kind != tokString {
+		return nil, fmt.Errorf("missing value for %s%s", t.text, op)
+	}
+	p.pos++
+	return restriction{field: t.text, op: op, value: v.text}, nil
+}
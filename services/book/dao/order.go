@@ -0,0 +1,124 @@
+package dao
+
+import (
+	pb "book/pb/pb_book_v1"
+	"fmt"
+	"strings"
+)
+
+// bookField is a field of a book that books can be filtered and ordered on,
+// named as in book_v1.proto
+type bookField struct {
+	column string // The SQL expression for the field
+	value  func(b *pb.Book) string
+}
+
+var bookFields = map[string]bookField{
+	"id":            {`CAST(id AS TEXT)`, func(b *pb.Book) string { return b.Id }},
+	"title":         {`title`, func(b *pb.Book) string { return b.Title }},
+	"author":        {`author`, func(b *pb.Book) string { return b.Author }},
+	"publishedDate": {`published_date`, func(b *pb.Book) string { return b.PublishedDate }},
+	"description":   {`description`, func(b *pb.Book) string { return b.Description }},
+	"imageURL":      {`image_url`, func(b *pb.Book) string { return b.ImageURL }},
+}
+
+// OrderField is one field of an OrderBy
+type OrderField struct {
+	Field string
+	Desc  bool
+}
+
+// OrderBy is the order books are listed in, books that are equal on every
+// field are listed in ID order.  No fields is the same as title order.
+type OrderBy []OrderField
+
+// ParseOrderBy parses an AIP-132 order_by, e.g. "author, publishedDate desc"
+func ParseOrderBy(s string) (OrderBy, error) {
+	var order OrderBy
+	if strings.TrimSpace(s) == "" {
+		return order, nil
+	}
+	seen := map[string]bool{}
+	for _, part := range strings.Split(s, ",") {
+		words := strings.Fields(part)
+		if len(words) == 0 || len(words) > 2 || (len(words) == 2 && words[1] != "desc" && words[1] != "asc") {
+			return nil, fmt.Errorf("order by %q: %w", part, ErrInvalidArgument)
+		}
+		if _, ok := bookFields[words[0]]; !ok {
+			return nil, fmt.Errorf("order by unknown field %q: %w", words[0], ErrInvalidArgument)
+		}
+		if seen[words[0]] {
+			return nil, fmt.Errorf("order by %q more than once: %w", words[0], ErrInvalidArgument)
+		}
+		seen[words[0]] = true
+		order = append(order, OrderField{Field: words[0], Desc: len(words) == 2 && words[1] == "desc"})
+	}
+	return order, nil
+}
+
+// String is the order in the form ParseOrderBy reads
+func (o OrderBy) String() string {
+	parts := make([]string, len(o))
+	for i, f := range o {
+		parts[i] = f.Field
+		if f.Desc {
+			parts[i] += " desc"
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// keys is the full listing order, which always ends with the ID so that no two
+// books are equal
+func (o OrderBy) keys() OrderBy {
+	keys := o
+	if len(keys) == 0 {
+		keys = OrderBy{{Field: "title"}}
+	}
+	for _, f := range keys {
+		if f.Field == "id" {
+			return keys
+		}
+	}
+	return append(keys[:len(keys):len(keys)], OrderField{Field: "id"})
+}
+
+// orderColumn is the SQL expression books are ordered by for the field.  IDs are
+// filtered as strings but ordered as the numbers they are, so that listing
+// walks the primary key.
+func orderColumn(field string) string {
+	if field == "id" {
+		return `id`
+	}
+	return bookFields[field].column
+}
+
+// lessValue orders two values of the field, IDs by their number, which for
+// the IDs the databases give out is shorter first and then string order
+func lessValue(field, a, b string) bool {
+	if field == "id" && len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// compare returns -1, 0 or +1 as the book sorts before, level with or after the
+// key values of a cursor
+func (o OrderBy) compare(b *pb.Book, values []string) int {
+	for i, f := range o.keys() {
+		v := bookFields[f.Field].value(b)
+		if v == values[i] {
+			continue
+		}
+		if lessValue(f.Field, v, values[i]) != f.Desc {
+			return -1
+		}
+		return +1
+	}
+	return 0
+}
+
+// Less is the listing order shared by every BookDatabase implementation.
+func (o OrderBy) Less(a, b *pb.Book) bool {
+	return o.compare(a, CursorOf(b, o).Keys) < 0
+}
@@ -0,0 +1,101 @@
+package dao
+
+import (
+	pb "book/pb/pb_book_v1"
+	"context"
+	"errors"
+
+	"go.opencensus.io/trace"
+)
+
+// tracedDB makes a span of every call to a BookDatabase, a child of the span
+// of the RPC the call is made for
+type tracedDB struct {
+	db     BookDatabase
+	driver string
+}
+
+// Traced wraps the database so every call to it is a span named after the
+// method, e.g. dao.GetBook, with the driver as the db.system attribute
+func Traced(db BookDatabase, driver string) BookDatabase {
+	if driver == "" {
+		driver = DriverMemory
+	}
+	return &tracedDB{db: db, driver: driver}
+}
+
+func (t *tracedDB) start(ctx context.Context, method string, attrs ...trace.Attribute) (context.Context, *trace.Span) {
+	ctx, span := trace.StartSpan(ctx, "dao."+method, trace.WithSpanKind(trace.SpanKindClient))
+	span.AddAttributes(append(attrs, trace.StringAttribute("db.system", t.driver))...)
+	return ctx, span
+}
+
+// end ends the span with the status of the error
+func end(span *trace.Span, err error) {
+	if err != nil {
+		span.SetStatus(trace.Status{Code: statusCode(err), Message: err.Error()})
+	}
+	span.End()
+}
+
+// statusCode is the span's status, a gRPC code, for a database error
+func statusCode(err error) int32 {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return trace.StatusCodeNotFound
+	case errors.Is(err, ErrAlreadyExists):
+		return trace.StatusCodeAlreadyExists
+	case errors.Is(err, ErrInvalidArgument):
+		return trace.StatusCodeInvalidArgument
+	case errors.Is(err, ErrUnavailable):
+		return trace.StatusCodeUnavailable
+	case errors.Is(err, ErrConflict):
+		return trace.StatusCodeAborted
+	case errors.Is(err, context.DeadlineExceeded):
+		return trace.StatusCodeDeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return trace.StatusCodeCancelled
+	}
+	return trace.StatusCodeUnknown
+}
+
+func (t *tracedDB) ListBooks(ctx context.Context, opts ListOptions) ([]*pb.Book, error) {
+	ctx, span := t.start(ctx, "ListBooks", trace.Int64Attribute("db.limit", int64(opts.Limit)))
+	books, err := t.db.ListBooks(ctx, opts)
+	span.AddAttributes(trace.Int64Attribute("db.books", int64(len(books))))
+	end(span, err)
+	return books, err
+}
+
+func (t *tracedDB) GetBook(ctx context.Context, id string) (*pb.Book, error) {
+	ctx, span := t.start(ctx, "GetBook", trace.StringAttribute("book.id", id))
+	book, err := t.db.GetBook(ctx, id)
+	end(span, err)
+	return book, err
+}
+
+func (t *tracedDB) AddBook(ctx context.Context, book *pb.Book) (string, error) {
+	ctx, span := t.start(ctx, "AddBook")
+	id, err := t.db.AddBook(ctx, book)
+	span.AddAttributes(trace.StringAttribute("book.id", id))
+	end(span, err)
+	return id, err
+}
+
+func (t *tracedDB) DeleteBook(ctx context.Context, id, etag string) error {
+	ctx, span := t.start(ctx, "DeleteBook", trace.StringAttribute("book.id", id))
+	err := t.db.DeleteBook(ctx, id, etag)
+	end(span, err)
+	return err
+}
+
+func (t *tracedDB) UpdateBook(ctx context.Context, book *pb.Book) error {
+	ctx, span := t.start(ctx, "UpdateBook", trace.StringAttribute("book.id", book.GetId()))
+	err := t.db.UpdateBook(ctx, book)
+	end(span, err)
+	return err
+}
+
+func (t *tracedDB) Close(ctx context.Context) error {
+	return t.db.Close(ctx)
+}
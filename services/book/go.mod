@@ -4,7 +4,9 @@ go 1.14
 
 require (
 	github.com/golang/protobuf v1.4.2
+	github.com/mattn/go-sqlite3 v1.14.0
 	github.com/sirupsen/logrus v1.6.0
+	go.opencensus.io v0.22.4
 	google.golang.org/genproto v0.0.0-20200608115520-7c474a2e3482
 	google.golang.org/grpc v1.29.1
 	google.golang.org/protobuf v1.24.0
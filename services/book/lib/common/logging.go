@@ -0,0 +1,224 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Log formats for the log_format config key
+const (
+	LogText = "text" // A line of key=value pairs for people, the default
+	LogJSON = "json" // A JSON object per line
+	LogGCP  = "gcp"  // A JSON object per line with the fields Google Cloud Logging reads
+)
+
+// LogLevelPath serves the log level on the admin port, a POST or PUT with
+// level=debug changes it
+const LogLevelPath = "/loglevel"
+
+// defaultLogLevel is used if log_level isn't set
+const defaultLogLevel = logrus.InfoLevel
+
+// logConfig are the logging keys, they have no defaults as LOG_LEVEL and so
+// on are used for the ones that aren't set
+type logConfig struct {
+	Level  string `config:"log_level" oneof:"trace debug info warn warning error"`
+	Format string `config:"log_format" oneof:"text json gcp"`
+	Output string `config:"log_output"`
+}
+
+// logSettings are the values of the logging keys
+type logSettings struct {
+	level, format, output string
+}
+
+// logEnv are the settings from LOG_LEVEL, LOG_FORMAT and LOG_OUTPUT, used
+// before the config is loaded and for the keys that aren't set
+func logEnv() logSettings {
+	return logSettings{level: os.Getenv("LOG_LEVEL"), format: os.Getenv("LOG_FORMAT"), output: os.Getenv("LOG_OUTPUT")}
+}
+
+// settings are the keys' settings, or the environment's if they aren't set
+func (cfg *logConfig) settings() logSettings {
+	s := logEnv()
+	if cfg.Level != "" {
+		s.level = cfg.Level
+	}
+	if cfg.Format != "" {
+		s.format = cfg.Format
+	}
+	if cfg.Output != "" {
+		s.output = cfg.Output
+	}
+	return s
+}
+
+// ConfigureLogging sets c.Log up from log_level, debug to error, log_format,
+// text, json or gcp, and log_output, stdout, stderr or a file the entries are
+// appended to.  Every entry has the service, version and instance, the host
+// name or pod, fields.  Like the other keys they can be set by e.g.
+// BOOK_LOG_LEVEL, otherwise LOG_LEVEL, LOG_FORMAT and LOG_OUTPUT are used.
+// If the config is watched the logging changes with it.
+func (c *AppConfig) ConfigureLogging(version string) error {
+	var cfg logConfig
+	if err := c.Bind(c.keyPrefix, &cfg); err != nil {
+		return err
+	}
+	fields := logFields(c.ServiceName, version)
+	if err := configureLogger(c.Log, cfg.settings(), fields); err != nil {
+		return err
+	}
+	return c.OnConfigChange(c.keyPrefix, func(cfg *logConfig) {
+		if err := configureLogger(c.Log, cfg.settings(), fields); err != nil {
+			c.Log.Errorf("Cannot change the logging, it is unchanged: %v", err)
+			return
+		}
+		c.Log.Infof("The logging changed, the level is %s", c.Log.GetLevel())
+	})
+}
+
+// logFields are the fields of every entry
+func logFields(serviceName, version string) logrus.Fields {
+	instance, _ := os.Hostname()
+	fields := logrus.Fields{"service": serviceName, "instance": instance}
+	if version != "" {
+		fields["version"] = version
+	}
+	return fields
+}
+
+// configureLogger changes the logger in place, as every copy of the AppConfig
+// shares it.  A file output is reopened, so a log rotated before a SIGHUP
+// carries on in a new file.
+func configureLogger(log *logrus.Logger, s logSettings, fields logrus.Fields) error {
+	level := defaultLogLevel
+	if s.level != "" {
+		l, err := logrus.ParseLevel(s.level)
+		if err != nil {
+			return fmt.Errorf("log_level: %w", err)
+		}
+		level = l
+	}
+
+	var formatter logrus.Formatter
+	switch strings.ToLower(s.format) {
+	case "", LogText:
+		formatter = &logrus.TextFormatter{TimestampFormat: time.RFC822}
+	case LogJSON:
+		formatter = &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano}
+	case LogGCP:
+		formatter = gcpFormatter{}
+	default:
+		return fmt.Errorf("unknown log_format %q", s.format)
+	}
+
+	var out io.Writer
+	switch strings.ToLower(s.output) {
+	case "", "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	default:
+		f, err := os.OpenFile(s.output, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("log_output: %w", err)
+		}
+		out = f
+	}
+
+	prev := log.Out
+	log.SetFormatter(&fieldsFormatter{Formatter: formatter, fields: fields})
+	log.SetOutput(out)
+	log.SetLevel(level)
+	if f, ok := prev.(*os.File); ok && f != os.Stdout && f != os.Stderr && f != out {
+		f.Close()
+	}
+	return nil
+}
+
+// fieldsFormatter adds the service's fields to every entry.  It isn't a hook
+// as a hook would write them to the data of entries shared by goroutines.
+type fieldsFormatter struct {
+	logrus.Formatter
+	fields logrus.Fields
+}
+
+func (f *fieldsFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	data := make(logrus.Fields, len(f.fields)+len(e.Data))
+	for k, v := range f.fields {
+		data[k] = v
+	}
+	for k, v := range e.Data {
+		data[k] = v
+	}
+	entry := *e
+	entry.Data = data
+	return f.Formatter.Format(&entry)
+}
+
+// gcpFormatter writes the JSON of Google Cloud Logging's structured logs, the
+// timestamp, severity and message fields it turns into those of the entry
+type gcpFormatter struct{}
+
+// gcpSeverity is the LogSeverity of each level
+var gcpSeverity = map[logrus.Level]string{
+	logrus.PanicLevel: "ALERT",
+	logrus.FatalLevel: "CRITICAL",
+	logrus.ErrorLevel: "ERROR",
+	logrus.WarnLevel:  "WARNING",
+	logrus.InfoLevel:  "INFO",
+	logrus.DebugLevel: "DEBUG",
+	logrus.TraceLevel: "DEBUG",
+}
+
+func (gcpFormatter) Format(e *logrus.Entry) ([]byte, error) {
+	data := make(map[string]interface{}, len(e.Data)+3)
+	for k, v := range e.Data {
+		if err, ok := v.(error); ok {
+			v = err.Error() // errors don't marshal
+		}
+		data[k] = v
+	}
+	data["timestamp"] = e.Time.Format(time.RFC3339Nano)
+	data["severity"] = gcpSeverity[e.Level]
+	data["message"] = e.Message
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal the log entry: %w", err)
+	}
+	return append(b, '\n'), nil
+}
+
+// LogLevelHandler serves the log level, a POST or PUT with a level, e.g.
+// curl -d level=debug localhost:9090/loglevel, changes it until the service
+// restarts or the logging keys change
+func (c *AppConfig) LogLevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost, http.MethodPut:
+			level, err := logrus.ParseLevel(r.FormValue("level"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if level != c.Log.GetLevel() {
+				c.Log.Infof("The log level is now %s, was %s", level, c.Log.GetLevel())
+				c.Log.SetLevel(level)
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST, PUT")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, c.Log.GetLevel())
+	})
+}
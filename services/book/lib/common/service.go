@@ -0,0 +1,340 @@
+package common
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opencensus.io/plugin/ochttp"
+	"go.opencensus.io/plugin/ochttp/propagation/b3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/reflection"
+)
+
+// Service is the main() of a microservice.  It parses the flags, loads and
+// checks the configuration and then serves either gRPC, with TLS, auth, interceptors,
+// health, reflection, metrics and tracing, or HTTP, with metrics on /metrics
+// and tracing, until it is shut down by SIGTERM, e.g.
+//
+//	common.NewService("book", version).
+//		RegisterGRPC(func(svc *common.Service, s *grpc.Server) error {
+//			pb.RegisterBookServiceServer(s, newServer())
+//			return nil
+//		}).
+//		Run()
+type Service struct {
+	Name    string    // The name of the config file, e.g. book for cfg/book.yaml
+	Version string    // Shown by -version
+	Config  AppConfig // Loaded by Run before the callbacks are called
+	Health  *Health   // The health of a gRPC service, set by Run
+	Metrics *Metrics  // Served on /metrics, the callbacks can add gauges
+	// The feature flags in the features key, they change with the config
+	Features *Features
+
+	keyPrefix    string
+	configs      []interface{} // Bound by Run, see BindConfig
+	registerGRPC []func(svc *Service, s *grpc.Server) error
+	handleHTTP   func(svc *Service) (http.Handler, error)
+	unary        []grpc.UnaryServerInterceptor
+	stream       []grpc.StreamServerInterceptor
+	closers      []Closer
+	tracing      Closer // Flushes the spans, after the other closers
+}
+
+// NewService starts building the named service, its config keys are prefixed
+// with the name unless KeyPrefix says otherwise
+func NewService(name, version string) *Service {
+	return &Service{Name: name, Version: version, keyPrefix: name}
+}
+
+// KeyPrefix sets the prefix of the service's config keys, e.g. route-guide
+func (svc *Service) KeyPrefix(p string) *Service {
+	svc.keyPrefix = p
+	return svc
+}
+
+// serverConfig are the keys every service reads, bound by Run with the
+// logging keys and features so a bad value stops the service as it starts
+// rather than when the key is read
+type serverConfig struct {
+	Port            int           `config:"port" required:"true" min:"1" max:"65535"`
+	AdminPort       int           `config:"admin_port" min:"0" max:"65535"`
+	ListenAddr      string        `config:"listen_addr"`
+	ShutdownTimeout time.Duration `config:"shutdown_timeout" default:"10s" min:"1ms"`
+	ShutdownDrain   time.Duration `config:"shutdown_drain" default:"5s" min:"0s"`
+	TLS             bool          `config:"tls"`
+	TraceExporter   string        `config:"trace_exporter" oneof:"none stdout file jaeger"`
+	TraceSampleRate float64       `config:"trace_sample_rate" default:"1" min:"0" max:"1"`
+	WatchConfig     bool          `config:"watch_config" default:"true"`
+}
+
+// boundConfigs are the structs Run binds, the keys every service reads and
+// then the BindConfig ones
+func (svc *Service) boundConfigs(server *serverConfig) []interface{} {
+	return append([]interface{}{server, &logConfig{}, &featuresConfig{}}, svc.configs...)
+}
+
+// BindConfig adds a struct, cfg points to, that Run fills from the service's
+// keys before the callbacks are called, see AppConfig.Bind.  The service
+// doesn't start if a key is missing or invalid.  The struct doesn't change
+// with the config, the keys that can are subscribed to with OnConfigChange.
+func (svc *Service) BindConfig(cfg interface{}) *Service {
+	svc.configs = append(svc.configs, cfg)
+	return svc
+}
+
+// OnConfigChange subscribes onChange, a func(cfg *T), to the service's keys,
+// see AppConfig.OnConfigChange.  The callbacks call it for the keys that can
+// change, e.g. a secret that is rotated.
+func (svc *Service) OnConfigChange(onChange interface{}) error {
+	return svc.Config.OnConfigChange(svc.keyPrefix, onChange)
+}
+
+// RegisterGRPC adds a callback that registers gRPC services on the server.  It
+// must load everything the services need, e.g. open their database, as they
+// are reported SERVING by the health service once every callback returns.
+func (svc *Service) RegisterGRPC(register func(svc *Service, s *grpc.Server) error) *Service {
+	svc.registerGRPC = append(svc.registerGRPC, register)
+	return svc
+}
+
+// HandleHTTP sets the callback that makes the handler of an HTTP service
+func (svc *Service) HandleHTTP(handler func(svc *Service) (http.Handler, error)) *Service {
+	svc.handleHTTP = handler
+	return svc
+}
+
+// UnaryInterceptor adds interceptors to the unary RPCs of a gRPC service, they
+// are called in the order they are added
+func (svc *Service) UnaryInterceptor(interceptors ...grpc.UnaryServerInterceptor) *Service {
+	svc.unary = append(svc.unary, interceptors...)
+	return svc
+}
+
+// StreamInterceptor adds interceptors to the streaming RPCs of a gRPC service,
+// they are called in the order they are added
+func (svc *Service) StreamInterceptor(interceptors ...grpc.StreamServerInterceptor) *Service {
+	svc.stream = append(svc.stream, interceptors...)
+	return svc
+}
+
+// CloseOnShutdown closes resources such as a database after the server stops
+func (svc *Service) CloseOnShutdown(closers ...Closer) {
+	svc.closers = append(svc.closers, closers...)
+}
+
+// Run runs the service until it is shut down, it exits if the service can't
+// start or fails
+func (svc *Service) Run() {
+	showversion := flag.Bool("version", false, "display version")
+	showconfig := flag.Bool("config", false, "display the config, with the secrets redacted, and exit")
+	flag.Parse()
+	if *showversion {
+		fmt.Printf("Version %s\n", svc.Version)
+		return
+	}
+
+	c, err := LoadConfig(svc.Name, "")
+	if err != nil {
+		fmt.Printf("Cannot load the configuration: %s", err)
+	}
+	svc.Config = c
+	svc.Config.KeyPrefix(svc.keyPrefix)
+	server, config, err := svc.bindConfig()
+	var invalid ConfigErrors
+	if errors.As(err, &invalid) {
+		for _, err := range invalid {
+			svc.Config.Log.Error(err) // A line each, rather than one that is hard to read
+		}
+		svc.Config.Log.Fatalf("%s: cannot start with an invalid config, see the keys above", svc.Name)
+	} else if err != nil {
+		svc.Config.Log.Fatalf("%s: %v", svc.Name, err)
+	}
+	if *showconfig {
+		fmt.Print(config)
+		return
+	}
+	svc.Config.Log.Debugf("The config is\n%s", config)
+	if err := svc.watchConfig(server); err != nil {
+		svc.Config.Log.Fatalf("%s: watching the config: %v", svc.Name, err)
+	}
+	if err := svc.Config.ConfigureLogging(svc.Version); err != nil {
+		svc.Config.Log.Fatalf("%s: logging: %v", svc.Name, err)
+	}
+	if svc.Features, err = svc.Config.Features(svc.keyPrefix); err != nil {
+		svc.Config.Log.Fatalf("%s: features: %v", svc.Name, err)
+	}
+	svc.Metrics = NewMetrics()
+	if svc.tracing, err = svc.Config.StartTracing(svc.Name); err != nil {
+		svc.Config.Log.Fatalf("%s: tracing: %v", svc.Name, err)
+	}
+
+	switch {
+	case len(svc.registerGRPC) > 0 && svc.handleHTTP != nil:
+		err = errors.New("a service serves either gRPC or HTTP")
+	case len(svc.registerGRPC) > 0:
+		err = svc.serveGRPC()
+	case svc.handleHTTP != nil:
+		err = svc.serveHTTP()
+	default:
+		err = errors.New("nothing to serve, call RegisterGRPC or HandleHTTP")
+	}
+	if err != nil {
+		svc.Config.Log.Fatalf("%s: %v", svc.Name, err)
+	}
+}
+
+// bindConfig binds the keys every service reads and then the BindConfig
+// structs, it returns the config they hold or every key that is invalid
+func (svc *Service) bindConfig() (*serverConfig, string, error) {
+	server := &serverConfig{}
+	var errs ConfigErrors
+	var config strings.Builder
+	for _, cfg := range svc.boundConfigs(server) {
+		err := svc.Config.Bind(svc.keyPrefix, cfg)
+		var invalid ConfigErrors
+		switch {
+		case errors.As(err, &invalid):
+			errs = append(errs, invalid...)
+		case err != nil:
+			return nil, "", err
+		}
+		config.WriteString(FormatConfig(svc.keyPrefix, cfg))
+	}
+	if len(errs) > 0 {
+		return nil, "", errs
+	}
+	return server, config.String(), nil
+}
+
+// watchConfig reads the config again on SIGHUP and, unless watch_config is
+// false, when its files change.  A change isn't used unless the keys of the
+// BindConfig structs are still valid, though they are only read at start.
+func (svc *Service) watchConfig(server *serverConfig) error {
+	w := svc.Config.WatchConfig()
+	svc.CloseOnShutdown(w)
+	for _, cfg := range svc.boundConfigs(server) {
+		if err := w.check(svc.keyPrefix, cfg); err != nil {
+			return err
+		}
+	}
+	// A rotated secret is used by the subscriptions its keys are bound to, even
+	// if the files aren't watched
+	svc.CloseOnShutdown(svc.Config.secretStore().Watch(func(refs []string) {
+		w.reload(fmt.Sprintf("the secrets %s were rotated", strings.Join(refs, ", ")), false)
+	}))
+	if !server.WatchConfig {
+		svc.Config.Log.Info("The config files aren't watched, SIGHUP reads them again")
+		return nil
+	}
+	if err := w.WatchFiles(ConfigDebounce); err != nil {
+		svc.Config.Log.Warnf("The config files aren't watched, SIGHUP reads them again: %v", err)
+	}
+	return nil
+}
+
+func (svc *Service) serveGRPC() error {
+	c := &svc.Config
+	// Logging, request IDs, panic recovery, metrics and then auth come before
+	// the service's own interceptors
+	unary := append(c.UnaryServerInterceptors(), svc.Metrics.Unary)
+	stream := append(c.StreamServerInterceptors(), svc.Metrics.Stream)
+	auth, err := c.Auth()
+	if err != nil {
+		return fmt.Errorf("auth: %w", err)
+	}
+	if auth != nil {
+		unary, stream = append(unary, auth.Unary), append(stream, auth.Stream)
+		c.Log.Info("Callers must have tokens, see auth_policy")
+	}
+	opts := []grpc.ServerOption{
+		grpc.StatsHandler(ServerStatsHandler()), // opencensus tracing and metrics
+		// Let clients ping idle connections, see ClientConfig.KeepaliveTime
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: 10 * time.Second, PermitWithoutStream: true}),
+		grpc.ChainUnaryInterceptor(append(unary, svc.unary...)...),
+		grpc.ChainStreamInterceptor(append(stream, svc.stream...)...),
+	}
+	if c.TLS() {
+		creds, err := c.ServerCredentials()
+		if err != nil {
+			return err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	s := grpc.NewServer(opts...)
+	for _, register := range svc.registerGRPC {
+		if err := register(svc, s); err != nil {
+			return err
+		}
+	}
+	services := make([]string, 0, len(s.GetServiceInfo()))
+	for name := range s.GetServiceInfo() {
+		services = append(services, name)
+	}
+	sort.Strings(services)
+	svc.Health = RegisterHealth(s, services...)
+	reflection.Register(s)
+
+	lis, err := net.Listen("tcp", fmt.Sprintf("%s:%v", c.ListenAddress(), c.Port()))
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	if err := svc.serveAdmin(); err != nil {
+		return err
+	}
+	for _, name := range services {
+		svc.Health.Serving(name)
+	}
+	c.Log.Infof("%s %s serving gRPC on %s:%v", svc.Name, svc.Version, GetLocalIP(), c.Port())
+	return c.ServeGRPC(s, lis, svc.Health, append(svc.closers, svc.tracing)...)
+}
+
+// serveAdmin serves the metrics, log level and health of a gRPC service over
+// HTTP on the AdminPort, if there is one, until the service stops
+func (svc *Service) serveAdmin() error {
+	c := &svc.Config
+	if c.AdminPort() == 0 {
+		c.Log.Info("No admin_port, the metrics, log level and health aren't served over HTTP")
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, svc.Metrics.Handler())
+	mux.Handle(LogLevelPath, c.LogLevelHandler())
+	mux.Handle(HealthPath, svc.Health.Handler())
+	lis, err := net.Listen("tcp", fmt.Sprintf("%s:%v", c.ListenAddress(), c.AdminPort()))
+	if err != nil {
+		return fmt.Errorf("failed to listen on the admin port: %w", err)
+	}
+	srv := &http.Server{Handler: mux}
+	go func() {
+		if err := srv.Serve(lis); !errors.Is(err, http.ErrServerClosed) {
+			c.Log.Errorf("The admin server failed: %v", err)
+		}
+	}()
+	svc.CloseOnShutdown(CloserFunc(srv.Shutdown))
+	c.Log.Infof("Serving metrics on http://%s:%v%s, the log level on %s and the health on %s",
+		GetLocalIP(), c.AdminPort(), MetricsPath, LogLevelPath, HealthPath)
+	return nil
+}
+
+func (svc *Service) serveHTTP() error {
+	c := &svc.Config
+	handler, err := svc.handleHTTP(svc)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, svc.Metrics.Handler())
+	mux.Handle("/", &ochttp.Handler{ // opencensus tracing
+		Handler:     svc.Metrics.HTTP(handler),
+		Propagation: &b3.HTTPFormat{}})
+	srv := &http.Server{Addr: fmt.Sprintf("%s:%v", c.ListenAddress(), c.Port()), Handler: mux}
+	c.Log.Infof("%s %s listening on http://%s:%v", svc.Name, svc.Version, GetLocalIP(), c.Port())
+	return c.ListenAndServe(srv, append(svc.closers, svc.tracing)...)
+}
@@ -0,0 +1,50 @@
+package common_test_test
+
+import (
+	"lib/common"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+)
+
+// getHealth is the status code and body of the health handler for target
+func getHealth(h *common.Health, target string) (int, string) {
+	w := httptest.NewRecorder()
+	h.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+	return w.Code, strings.TrimSpace(w.Body.String())
+}
+
+func TestHealthHandler(t *testing.T) {
+	h := common.RegisterHealth(grpc.NewServer(), "test.A", "test.B")
+	for _, test := range []struct {
+		serving []string // The services marked SERVING
+		target  string
+		code    int
+		body    string
+	}{
+		{nil, common.HealthPath, http.StatusServiceUnavailable, "NOT_SERVING"},
+		{[]string{"test.A"}, common.HealthPath, http.StatusServiceUnavailable, "NOT_SERVING"},
+		{nil, common.HealthPath + "?service=test.A", http.StatusOK, "SERVING"},
+		{nil, common.HealthPath + "?service=test.B", http.StatusServiceUnavailable, "NOT_SERVING"},
+		{[]string{"test.B"}, common.HealthPath, http.StatusOK, "SERVING"},
+		{nil, common.HealthPath + "?service=test.C", http.StatusNotFound, ""},
+	} {
+		for _, s := range test.serving {
+			h.Serving(s)
+		}
+		code, body := getHealth(h, test.target)
+		assert.Equal(t, test.code, code, test.target)
+		if test.body != "" {
+			assert.Equal(t, test.body, body, test.target)
+		}
+	}
+
+	h.Shutdown()
+	code, body := getHealth(h, common.HealthPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code, "after Shutdown")
+	assert.Equal(t, "NOT_SERVING", body, "after Shutdown")
+}
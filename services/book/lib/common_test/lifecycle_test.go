@@ -0,0 +1,149 @@
+package common_test_test
+
+import (
+	"context"
+	"lib/common"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// closed records when a closer was called and if its context was still live
+type closed struct {
+	ctx    context.Context
+	err    error // ctx.Err() when it was called
+	health int   // The code of the health handler when it was called
+}
+
+// stop sends the test process SIGTERM, which the server under test catches
+func stop(t *testing.T) {
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+}
+
+func TestServeGRPCShutdown(t *testing.T) {
+	c := tlsConfig("test", map[string]string{"shutdown_timeout": "200ms", "shutdown_drain": "50ms"})
+	s := grpc.NewServer()
+	h := common.RegisterHealth(s, "test.Service")
+	h.Serving("test.Service")
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	var got []closed
+	closer := func(ctx context.Context) error {
+		code, _ := getHealth(h, common.HealthPath)
+		got = append(got, closed{ctx, ctx.Err(), code})
+		return nil
+	}
+	served := make(chan error, 1)
+	go func() { served <- c.ServeGRPC(s, lis, h, common.CloserFunc(closer), common.CloserFunc(closer)) }()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure(), grpc.WithBlock())
+	require.NoError(t, err)
+	defer conn.Close()
+	// A Watch is an RPC in flight that doesn't end by itself, so the server
+	// has to cancel it at the shutdown deadline
+	watch, err := healthpb.NewHealthClient(conn).Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	resp, err := watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, resp.Status)
+
+	start := time.Now()
+	stop(t)
+	resp, err = watch.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, resp.Status, "the health on shutdown")
+	// The server still takes RPCs while the probes see it is NOT_SERVING
+	check, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err, "an RPC while draining")
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check.Status, "the health while draining")
+
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeGRPC didn't return after SIGTERM")
+	}
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(200*time.Millisecond), "the Watch was given shutdown_timeout")
+	require.Len(t, got, 2, "closers called")
+	for _, cl := range got {
+		_, ok := cl.ctx.Deadline()
+		assert.True(t, ok, "the closers have a deadline")
+		assert.NoError(t, cl.err, "the closers run before the deadline")
+		assert.Equal(t, http.StatusServiceUnavailable, cl.health, "the health while closing")
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	for _, test := range []struct {
+		keys map[string]string
+		want time.Duration
+	}{
+		{nil, common.DefaultShutdownDrain},
+		{map[string]string{"shutdown_drain": "2s"}, 2 * time.Second},
+		{map[string]string{"shutdown_drain": "0s"}, 0},
+		{map[string]string{"shutdown_drain": "soon"}, common.DefaultShutdownDrain},
+		{map[string]string{"shutdown_drain": "-1s"}, common.DefaultShutdownDrain},
+		{map[string]string{"shutdown_timeout": "4s", "shutdown_drain": "3s"}, 2 * time.Second},
+		{map[string]string{"shutdown_timeout": "1s"}, 500 * time.Millisecond},
+	} {
+		assert.Equal(t, test.want, tlsConfig("test", test.keys).ShutdownDrain(), "%v", test.keys)
+	}
+}
+
+func TestListenAndServeShutdown(t *testing.T) {
+	c := tlsConfig("test", map[string]string{"shutdown_timeout": "5s"})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := lis.Addr().String()
+	lis.Close()
+
+	started := make(chan struct{})
+	var done int32 // The request in flight has finished, atomic
+	srv := &http.Server{Addr: addr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		atomic.StoreInt32(&done, 1)
+		w.WriteHeader(http.StatusNoContent)
+	})}
+	var finished bool // The request had finished when the closer was called
+	var closerErr error
+	closer := func(ctx context.Context) error {
+		finished = atomic.LoadInt32(&done) == 1
+		closerErr = ctx.Err()
+		return nil
+	}
+	served := make(chan error, 1)
+	go func() { served <- c.ListenAndServe(srv, common.CloserFunc(closer)) }()
+
+	go func() {
+		for {
+			resp, err := http.Get("http://" + addr)
+			if err == nil {
+				resp.Body.Close()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	<-started
+	stop(t)
+
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe didn't return after SIGTERM")
+	}
+	assert.True(t, finished, "the request in flight finished before the closers")
+	assert.NoError(t, closerErr, "the closer runs before the deadline")
+}
@@ -0,0 +1,107 @@
+package common_test_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"lib/common"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// logTo configures the logging of the book service to a file and returns the
+// lines written by log
+func logTo(t *testing.T, keys map[string]string, log func(c *common.AppConfig)) []string {
+	dir, err := ioutil.TempDir("", "logging_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "book.log")
+	keys["log_output"] = file
+	c := tlsConfig("book", keys)
+	c.ServiceName = "book"
+	require.NoError(t, c.ConfigureLogging("1.2.3"))
+	log(c)
+	c.Log.SetOutput(ioutil.Discard)
+	b, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSpace(string(b)), "\n")
+}
+
+func TestLogFormats(t *testing.T) {
+	hostname, _ := os.Hostname()
+	for format, levelField := range map[string]string{common.LogJSON: "level", common.LogGCP: "severity"} {
+		lines := logTo(t, map[string]string{"log_format": format}, func(c *common.AppConfig) {
+			c.Log.Debug("Not at the default level")
+			c.Log.WithError(errors.New("disk full")).WithField("book_id", "42").Warn("Cannot save")
+		})
+		require.Len(t, lines, 1, format)
+		var got map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(lines[0]), &got), format)
+		assert.Equal(t, "book", got["service"], format)
+		assert.Equal(t, "1.2.3", got["version"], format)
+		assert.Equal(t, hostname, got["instance"], format)
+		assert.Equal(t, "42", got["book_id"], format)
+		assert.Equal(t, "disk full", got["error"], format)
+		if format == common.LogGCP {
+			assert.Equal(t, "WARNING", got[levelField])
+			assert.Equal(t, "Cannot save", got["message"])
+			assert.Contains(t, got, "timestamp")
+		} else {
+			assert.Equal(t, "warning", got[levelField])
+			assert.Equal(t, "Cannot save", got["msg"])
+		}
+	}
+}
+
+func TestLogText(t *testing.T) {
+	lines := logTo(t, map[string]string{"log_level": "debug"}, func(c *common.AppConfig) {
+		c.Log.Debug("Loading")
+	})
+	require.Len(t, lines, 1)
+	assert.Contains(t, lines[0], "level=debug")
+	assert.Contains(t, lines[0], "service=book")
+	assert.Contains(t, lines[0], "version=1.2.3")
+}
+
+func TestLogConfig(t *testing.T) {
+	for name, keys := range map[string]map[string]string{
+		"level":  {"log_level": "chatty"},
+		"format": {"log_format": "xml"},
+		"output": {"log_output": "/no/such/dir/book.log"},
+	} {
+		c := tlsConfig("book", keys)
+		assert.Error(t, c.ConfigureLogging(""), name)
+	}
+}
+
+func TestLogLevelHandler(t *testing.T) {
+	c := tlsConfig("book", nil)
+	c.Log.SetLevel(logrus.InfoLevel)
+	h := c.LogLevelHandler()
+	serve := func(method, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, common.LogLevelPath, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve(http.MethodGet, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "info\n", w.Body.String())
+	w = serve(http.MethodPost, "level=debug")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "debug\n", w.Body.String())
+	assert.Equal(t, logrus.DebugLevel, c.Log.GetLevel())
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPut, "level=chatty").Code)
+	assert.Equal(t, logrus.DebugLevel, c.Log.GetLevel(), "unchanged by a bad level")
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(http.MethodDelete, "").Code)
+}
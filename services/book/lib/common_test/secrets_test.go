@@ -0,0 +1,147 @@
+package common_test_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"lib/common"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// secretsDir is a directory like a mounted Kubernetes secret, with the file db
+func secretsDir(t *testing.T, value string) string {
+	dir, err := ioutil.TempDir("", "secrets_test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "db"), []byte(value), 0600))
+	return dir
+}
+
+func TestSecrets(t *testing.T) {
+	dir := secretsDir(t, "hunter2\n")
+	os.Setenv("SECRETS_TEST_TOKEN", "t0k3n")
+	defer os.Unsetenv("SECRETS_TEST_TOKEN")
+	s := common.NewSecrets(dir, 10*time.Millisecond)
+
+	for ref, want := range map[string]string{
+		"secret://k8s/db":                 "hunter2",
+		"secret://file" + dir + "/db":     "hunter2",
+		"secret://env/SECRETS_TEST_TOKEN": "t0k3n",
+	} {
+		got, err := s.Resolve(ref)
+		require.NoError(t, err, ref)
+		assert.Equal(t, want, got, ref)
+	}
+	for _, ref := range []string{"hunter2", "secret://env/SECRETS_TEST_UNSET", "secret://vault/db", "secret://k8s/../db", "secret://k8s/", "secret://k8s/missing"} {
+		_, err := s.Resolve(ref)
+		assert.Error(t, err, ref)
+	}
+	path, err := s.Path("secret://k8s/db")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "db"), path)
+	_, err = s.Path("secret://env/SECRETS_TEST_TOKEN")
+	assert.Error(t, err, "an environment variable isn't a file")
+
+	rotated := make(chan []string, 1)
+	w := s.Watch(func(refs []string) { rotated <- refs })
+	defer w.Close(context.Background())
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "db"), []byte("hunter3\n"), 0600))
+	select {
+	case refs := <-rotated:
+		assert.Equal(t, []string{"secret://file" + dir + "/db", "secret://k8s/db"}, refs)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the rotation wasn't noticed")
+	}
+	got, err := s.Resolve("secret://k8s/db")
+	require.NoError(t, err)
+	assert.Equal(t, "hunter3", got)
+}
+
+type secretConfig struct {
+	Secret  string `config:"page_token_secret" secret:"true"`
+	KeyFile string `config:"auth_key_file"`
+}
+
+func TestSecretKeys(t *testing.T) {
+	file := filepath.Join(secretsDir(t, "hunter2\n"), "db")
+	c := tlsConfig("book", map[string]string{"page_token_secret": "secret://file" + file, "auth_key_file": "secret://file" + file})
+	assert.Equal(t, "hunter2", c.GetStringKey("page_token_secret"))
+	assert.Equal(t, file, c.GetStringKey("auth_key_file"), "a file key is the path of the secret")
+
+	var cfg secretConfig
+	require.NoError(t, c.Bind("book", &cfg))
+	assert.Equal(t, secretConfig{Secret: "hunter2", KeyFile: file}, cfg)
+	assert.Contains(t, common.FormatConfig("book", &cfg), "book.page_token_secret = <redacted>")
+
+	c.V.Set("book.page_token_secret", "secret://env/SECRETS_TEST_UNSET")
+	var invalid common.ConfigErrors
+	require.True(t, errors.As(c.Bind("book", &cfg), &invalid))
+	assert.Len(t, invalid, 1)
+	assert.Equal(t, "", c.GetStringKey("page_token_secret"))
+}
+
+func TestSecretsNotLogged(t *testing.T) {
+	dir := secretsDir(t, "")
+	logFile := filepath.Join(dir, "book.log")
+	config := "book:\n  port: 8086\n  page_token_secret: hunter2\n  db_dsn: book:hunter3@tcp(db)/books\n  cookie_secret: secret://k8s/db\n" +
+		"  auth_key: hunter4\n  auth_key_file: /etc/auth.pem\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "book.yaml"), []byte(config), 0644))
+	os.Setenv("LOG_LEVEL", "debug")
+	os.Setenv("LOG_OUTPUT", logFile)
+	defer os.Unsetenv("LOG_LEVEL")
+	defer os.Unsetenv("LOG_OUTPUT")
+
+	c, err := common.LoadConfig("book", "", dir)
+	require.NoError(t, err)
+	c.KeyPrefix("book")
+	c.GetStringKey("page_token_secret")
+	c.Log.SetOutput(ioutil.Discard)
+
+	b, err := ioutil.ReadFile(logFile)
+	require.NoError(t, err)
+	log := string(b)
+	assert.Contains(t, log, "port:8086")
+	assert.Contains(t, log, "<redacted>")
+	assert.Contains(t, log, "secret://k8s/db", "a reference isn't a secret")
+	assert.NotContains(t, log, "hunter2")
+	assert.NotContains(t, log, "hunter3")
+	assert.NotContains(t, log, "hunter4")
+	assert.Contains(t, log, "/etc/auth.pem", "a file isn't a secret")
+}
+
+type rotatedConfig struct {
+	Secret string `config:"page_token_secret" secret:"true"`
+}
+
+func TestSecretRotation(t *testing.T) {
+	dir := secretsDir(t, "hunter2\n")
+	config := "book:\n  port: 8086\n  page_token_secret: secret://k8s/db\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "book.yaml"), []byte(config), 0644))
+	os.Setenv("SECRETS_DIR", dir)
+	os.Setenv("SECRETS_REFRESH", "10ms")
+	defer os.Unsetenv("SECRETS_DIR")
+	defer os.Unsetenv("SECRETS_REFRESH")
+
+	c, err := common.LoadConfig("book", "", dir)
+	require.NoError(t, err)
+	c.Log.SetOutput(ioutil.Discard)
+	c.KeyPrefix("book")
+	assert.Equal(t, "hunter2", c.GetStringKey("page_token_secret"))
+	w := c.WatchConfig()
+	defer w.Close(context.Background())
+	secrets := make(chan string, 1)
+	require.NoError(t, c.OnConfigChange("book", func(cfg *rotatedConfig) { secrets <- cfg.Secret }))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "db"), []byte("hunter3\n"), 0600))
+	time.Sleep(20 * time.Millisecond) // The cached value is then read again
+	changed, err := w.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, 1, changed)
+	assert.Equal(t, "hunter3", <-secrets)
+}
@@ -0,0 +1,87 @@
+package common_test_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"lib/common"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type watchedConfig struct {
+	Colour string `config:"colour" oneof:"blue green"`
+}
+
+func TestWatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "watch_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "watched.yaml")
+	write := func(config string) {
+		require.NoError(t, ioutil.WriteFile(file, []byte(config), 0644))
+	}
+	logFile := filepath.Join(dir, "watched.log")
+	write("watched:\n  colour: blue\n  log_level: info\n  log_output: " + logFile + "\n")
+
+	c, err := common.LoadConfig("watched", "", dir)
+	require.NoError(t, err)
+	c.KeyPrefix("watched")
+	w := c.WatchConfig()
+	defer w.Close(context.Background())
+	require.NoError(t, w.WatchFiles(20*time.Millisecond))
+	require.NoError(t, c.ConfigureLogging(""))
+	features, err := c.Features("watched")
+	require.NoError(t, err)
+	colours := make(chan string, 10)
+	require.NoError(t, c.OnConfigChange("watched", func(cfg *watchedConfig) { colours <- cfg.Colour }))
+
+	write("watched:\n  colour: green\n  log_level: debug\n  log_output: " + logFile + "\n  features: [bulk_import]\n")
+	select {
+	case colour := <-colours:
+		assert.Equal(t, "green", colour)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the change wasn't noticed")
+	}
+	assert.Equal(t, logrus.DebugLevel, c.Log.GetLevel())
+	assert.True(t, features.Enabled("bulk_import"))
+
+	write("watched:\n  colour: red\n  log_level: warn\n  log_output: " + logFile + "\n")
+	_, err = w.Reload()
+	var invalid common.ConfigErrors
+	require.True(t, errors.As(err, &invalid), "%v", err)
+	assert.Equal(t, logrus.DebugLevel, c.Log.GetLevel(), "none of an invalid config is used")
+	assert.True(t, features.Enabled("bulk_import"))
+
+	write("watched:\n  colour: green\n  log_level: debug\n  log_output: " + logFile + "\n  features: [bulk_import]\n")
+	changed, err := w.Reload()
+	require.NoError(t, err)
+	assert.Equal(t, 0, changed, "only the subscriptions that changed are called")
+	for len(colours) > 0 {
+		assert.Equal(t, "green", <-colours)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	w := tlsConfig("watched", nil).WatchConfig()
+	defer w.Close(context.Background())
+	for _, onChange := range []interface{}{nil, "colour", func(cfg watchedConfig) {}, func(cfg *string) {}} {
+		assert.Error(t, w.Subscribe("watched", onChange), "%T", onChange)
+	}
+	assert.NoError(t, w.Subscribe("watched", func(cfg *watchedConfig) {}))
+}
+
+func TestFeatures(t *testing.T) {
+	f := common.NewFeatures("b", "a")
+	assert.True(t, f.Enabled("a"))
+	assert.False(t, f.Enabled("c"))
+	assert.Equal(t, []string{"a", "b"}, f.Names())
+	var none *common.Features
+	assert.False(t, none.Enabled("a"))
+}
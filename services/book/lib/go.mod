@@ -4,9 +4,14 @@ go 1.14
 
 require (
 	cloud.google.com/go v0.58.0
+	contrib.go.opencensus.io/exporter/jaeger v0.2.1
+	github.com/fsnotify/fsnotify v1.4.7
+	github.com/golang-jwt/jwt/v4 v4.5.2
+	github.com/prometheus/client_golang v1.7.1
 	github.com/sirupsen/logrus v1.6.0
 	github.com/spf13/viper v1.7.0
 	github.com/stretchr/testify v1.6.1
-	go.opencensus.io v0.22.3
+	go.opencensus.io v0.22.4
 	google.golang.org/grpc v1.29.1
+	google.golang.org/protobuf v1.24.0
 )
@@ -5,16 +5,15 @@ import (
 	pb "book/pb/pb_book_v1"
 	"context"
 	"errors"
-	"flag"
 	"fmt"
 	"github.com/golang/protobuf/ptypes/empty"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/testdata"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"lib/common"
-	"net"
-	"net/http"
+	"strings"
 )
 
 const (
@@ -24,125 +23,236 @@ const (
 
 type bookServer struct {
 	pb.UnimplementedBookServiceServer
-	DB    dao.BookDatabase
-	log   *logrus.Logger
-	empty empty.Empty
+	DB       dao.BookDatabase
+	log      *logrus.Logger
+	empty    empty.Empty
+	tokens   *pageTokens
+	features *common.Features
+}
+
+// featureReadOnly is the feature flag that stops the books being changed, e.g.
+// while the database is moved, features: [read_only] turns it on
+const featureReadOnly = "read_only"
+
+// writable returns UNAVAILABLE if the books can't be changed, so clients try
+// again later
+func (b *bookServer) writable(ctx context.Context) error {
+	if b.features.Enabled(featureReadOnly) {
+		b.logger(ctx).Warn("could not change the books as they are read only")
+		return status.Error(codes.Unavailable, "the books are read only for now, try again later")
+	}
+	return nil
+}
+
+// logger logs with the request and session IDs of the RPC, which are also in
+// the logs of the frontend request that made it
+func (b *bookServer) logger(ctx context.Context) *logrus.Entry {
+	return b.log.WithFields(common.LogFields(ctx))
 }
 
 // getBook retrieves a book from the database given a book ID
 var ErrNoIdForBook = errors.New("All books have an ID")
 
+// bookID accepts either the ID of a book or its resource name, books/{id},
+// which is what the REST routes of the google.api.http annotations pass in
+func bookID(id string) string {
+	return strings.TrimPrefix(id, "books/")
+}
+
 // Gets a book. Returns NOT_FOUND if the book does not exist.
 func (b *bookServer) GetBook(ctx context.Context, req *pb.GetBookRequest) (*pb.Book, error) {
-	if req.Id == "" {
-		b.log.Error(ErrNoIdForBook)
-		return nil, ErrNoIdForBook
+	id := bookID(req.Id)
+	if id == "" {
+		b.logger(ctx).Error(ErrNoIdForBook)
+		return nil, badRequest(violation("id", ErrNoIdForBook.Error()))
 	}
-	book, err := b.DB.GetBook(ctx, req.Id)
+	book, err := b.DB.GetBook(ctx, id)
 	if err != nil {
-		b.log.Errorf("could not find book: %v", err)
-		return nil, fmt.Errorf("could not find book: %w", err)
+		b.logger(ctx).Errorf("could not find book: %v", err)
+		return nil, statusError(err, "could not find book")
 	}
 	return book, nil
 }
 
 // Lists books. The order is unspecified but deterministic. Newly created
 // books will not necessarily appear at the end of this list.
-// ListBooks lists all books
+// ListBooks lists one page of the books that match the filter in the order
+// asked for, the next_page_token is empty on the last page
 func (b *bookServer) ListBooks(ctx context.Context, req *pb.ListBooksRequest) (*pb.ListBooksResponse, error) {
-	books, err := b.DB.ListBooks(ctx)
+	if req.PageSize < 0 {
+		b.logger(ctx).Errorf("could not list books: %v: negative page size", req)
+		return nil, badRequest(violation("page_size", "must not be negative"))
+	}
+	filter, err := dao.ParseFilter(req.Filter)
 	if err != nil {
-		b.log.Errorf("could not list books: %v:%v", req, err)
-		return nil, fmt.Errorf("could not list books: %v:%w", req, err)
+		b.logger(ctx).Errorf("could not list books: %v:%v", req, err)
+		return nil, badRequest(violation("filter", err.Error()))
 	}
-	return &pb.ListBooksResponse{Books: books}, nil
+	order, err := dao.ParseOrderBy(req.OrderBy)
+	if err != nil {
+		b.logger(ctx).Errorf("could not list books: %v:%v", req, err)
+		return nil, badRequest(violation("order_by", err.Error()))
+	}
+	query := listQuery(req)
+	after, err := b.tokens.decode(req.PageToken, query)
+	if err != nil {
+		b.logger(ctx).Errorf("could not list books: %v:%v", req, err)
+		return nil, badRequest(violation("page_token", err.Error()))
+	}
+	pageSize := req.PageSize
+	if pageSize == 0 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+	// Ask for one extra book to find out if there is another page
+	books, err := b.DB.ListBooks(ctx, dao.ListOptions{Filter: filter, OrderBy: order, After: after, Limit: int(pageSize) + 1})
+	if err != nil {
+		b.logger(ctx).Errorf("could not list books: %v:%v", req, err)
+		return nil, statusError(err, "could not list books")
+	}
+	resp := &pb.ListBooksResponse{Books: books}
+	if len(books) > int(pageSize) {
+		resp.Books = books[:pageSize]
+		if resp.NextPageToken, err = b.tokens.encode(dao.CursorOf(resp.Books[pageSize-1], order), query); err != nil {
+			b.logger(ctx).Errorf("could not create page token: %v:%v", req, err)
+			return nil, status.Errorf(codes.Internal, "could not create page token: %v", err)
+		}
+	}
+	return resp, nil
 }
 
 // Creates a book, and returns the new Book.
 func (b *bookServer) CreateBook(ctx context.Context, req *pb.CreateBookRequest) (*pb.Book, error) {
+	if err := b.writable(ctx); err != nil {
+		return nil, err
+	}
+	if vs := validateBook("book.", req.GetBook()); len(vs) > 0 {
+		b.logger(ctx).Errorf("could not save book: %v : %v", req.GetBook(), vs)
+		return nil, badRequest(vs...)
+	}
 	id, err := b.DB.AddBook(ctx, req.GetBook())
 	if err != nil {
-		b.log.Errorf("could not save book: %v : %v", req.GetBook(), err)
-		return nil, fmt.Errorf("could not save book: %v : %w", req.GetBook(), err)
+		b.logger(ctx).Errorf("could not save book: %v : %v", req.GetBook(), err)
+		return nil, statusError(err, "could not save book")
 	}
 	return b.GetBook(ctx, &pb.GetBookRequest{Id: id})
 }
 
-// Deletes a book. Returns NOT_FOUND if the book does not exist.
+// Deletes a book. Returns NOT_FOUND if the book does not exist and
+// ABORTED if the etag is out of date.
 func (b *bookServer) DeleteBook(ctx context.Context, req *pb.DeleteBookRequest) (*empty.Empty, error) {
-	if err := b.DB.DeleteBook(ctx, req.Id); err != nil {
-		b.log.Errorf("could not delete book: %s : %v", req.Id, err)
-		return nil, fmt.Errorf("could not deete book: %s : %w", req.Id, err)
+	if err := b.writable(ctx); err != nil {
+		return nil, err
+	}
+	id := bookID(req.Id)
+	if err := b.DB.DeleteBook(ctx, id, req.Etag); err != nil {
+		b.logger(ctx).Errorf("could not delete book: %s : %v", id, err)
+		return nil, statusError(err, "could not delete book %s", id)
 	}
 	return &b.empty, nil
 }
 
-// Updates a book. Returns INVALID_ARGUMENT if the name of the book
-// is non-empty and does not equal the existing name.
+// Updates a book. Returns INVALID_ARGUMENT if the id of the book
+// is non-empty and does not equal the id of the request, and NOT_FOUND
+// if there is no book with that id. Only the fields in the update mask
+// are changed, see UpdateBookRequest.update_mask. Returns ABORTED if the
+// etag of the book is set and out of date.
 func (b *bookServer) UpdateBook(ctx context.Context, req *pb.UpdateBookRequest) (*pb.Book, error) {
-	if err := b.DB.UpdateBook(ctx, req.GetBook()); err != nil {
-		b.log.Errorf("could not update book: %v : %v", req.GetBook(), err)
-		return nil, fmt.Errorf("could not update book: %v : %w", req.GetBook(), err)
+	if err := b.writable(ctx); err != nil {
+		return nil, err
+	}
+	var vs []*errdetails.BadRequest_FieldViolation
+	id := bookID(req.Id)
+	if id == "" {
+		vs = append(vs, violation("id", ErrNoIdForBook.Error()))
 	}
-	return req.GetBook(), nil
+	if bid := bookID(req.GetBook().GetId()); bid != "" && bid != id {
+		vs = append(vs, violation("book.id", fmt.Sprintf("must be empty or match the id %q", id)))
+	}
+	if req.Book == nil {
+		vs = append(vs, violation("book", "a book is required"))
+	}
+	paths, pathErrs := maskPaths(req.GetBook(), req.GetUpdateMask())
+	vs = append(vs, pathErrs...)
+	if len(vs) > 0 {
+		b.logger(ctx).Errorf("could not update book: %v : %v", req, vs)
+		return nil, badRequest(vs...)
+	}
+	book, err := b.DB.GetBook(ctx, id)
+	if err != nil {
+		b.logger(ctx).Errorf("could not update book: %v : %v", req, err)
+		return nil, statusError(err, "could not update book")
+	}
+	applyMask(book, req.Book, paths)
+	if req.Book.Etag != "" {
+		// Only update the book if it hasn't changed since the client read it,
+		// otherwise the etag from GetBook stops changes since then being lost
+		book.Etag = req.Book.Etag
+	}
+	if vs := validateBook("book.", book); len(vs) > 0 {
+		b.logger(ctx).Errorf("could not update book: %v : %v", book, vs)
+		return nil, badRequest(vs...)
+	}
+	if err := b.DB.UpdateBook(ctx, book); err != nil {
+		b.logger(ctx).Errorf("could not update book: %v : %v", book, err)
+		return nil, statusError(err, "could not update book")
+	}
+	return book, nil
 }
 
 func serialize(book *pb.Book) string {
 	return fmt.Sprintf("%s %s", book.Id, book.Title)
 }
 
-func newServer(db dao.BookDatabase, log *logrus.Logger) *bookServer {
-	b := &bookServer{DB: db, log: log}
+func newServer(db dao.BookDatabase, log *logrus.Logger, tokens *pageTokens, features *common.Features) *bookServer {
+	b := &bookServer{DB: db, log: log, tokens: tokens, features: features}
 	return b
 }
 
+// bookConfig are the book service's own keys
+type bookConfig struct {
+	DBDriver        string `config:"db_driver" default:"memory" oneof:"memory sqlite3"`
+	DBDSN           string `config:"db_dsn" secret:"true"` // The SQLite database file
+	PageTokenSecret string `config:"page_token_secret" secret:"true"`
+}
+
 func main() {
-	// Command line stuff
-	showversion := flag.Bool("version", false, "display version")
-	flag.Parse()
-	if *showversion {
-		fmt.Printf("Version %s\n", version)
-		return
-	}
+	var cfg bookConfig
+	common.NewService(serviceName, version).
+		BindConfig(&cfg).
+		RegisterGRPC(func(svc *common.Service, s *grpc.Server) error {
+			return registerBookService(svc, s, &cfg)
+		}).
+		Run()
+}
 
-	// Service details
-	c, err := common.LoadConfig(serviceName, "")
+// registerBookService opens the book database and registers the BookService
+func registerBookService(svc *common.Service, s *grpc.Server, cfg *bookConfig) error {
+	c := &svc.Config
+	db, err := dao.NewBookDatabase(cfg.DBDriver, cfg.DBDSN)
 	if err != nil {
-		fmt.Printf("Cannot load the configuration: %s", err)
+		return fmt.Errorf("NewBookDatabase: %w", err)
 	}
-
-	http.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "%s\n", version)
-	})
-
-	c.KeyPrefix("book")
-	c.Log.Info(common.GetLocalIP(), ":", c.Port())
-
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%v", c.Port()))
+	svc.CloseOnShutdown(db)
+	if mem, ok := db.(interface{ Len() int }); ok {
+		svc.Metrics.GaugeFunc("book_memorydb_books", "Books in the in-memory database.",
+			func() float64 { return float64(mem.Len()) })
+	}
+	db = dao.Traced(db, cfg.DBDriver)
+	tokens, err := newPageTokens(cfg.PageTokenSecret)
 	if err != nil {
-		c.Log.Fatalf("failed to listen: %v", err)
+		return fmt.Errorf("newPageTokens: %w", err)
 	}
-	var opts []grpc.ServerOption
-	if c.TLS() {
-		certFile := c.CertFile()
-		if certFile == "" {
-			certFile = testdata.Path("server1.pem")
-		}
-		keyFile := c.KeyFile()
-		if keyFile == "" {
-			keyFile = testdata.Path("server1.key")
-		}
-		creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
-		if err != nil {
-			c.Log.Fatalf("Failed to generate credentials %v", err)
+	err = svc.OnConfigChange(func(cfg *pageTokenConfig) {
+		if tokens.rotate(cfg.Secret) {
+			c.Log.Info("The page token secret was rotated")
 		}
-		opts = []grpc.ServerOption{grpc.Creds(creds)}
-	}
-	grpcServer := grpc.NewServer(opts...)
-	db, err := dao.NewMemoryDB()
+	})
 	if err != nil {
-		c.Log.Fatalf("newFirestoreDB: %v", err)
+		return err
 	}
-	pb.RegisterBookServiceServer(grpcServer, newServer(db, c.Log))
-	grpcServer.Serve(lis)
+	pb.RegisterBookServiceServer(s, newServer(db, c.Log, tokens, svc.Features))
+	return nil
 }
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"book/dao"
+	pb "book/pb/pb_book_v1"
+	"context"
+	"io/ioutil"
+	"lib/common"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTestServer is a book server with an in-memory database
+func newTestServer(t *testing.T, features *common.Features) *bookServer {
+	db, err := dao.NewMemoryDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	tokens, err := newPageTokens("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newServer(db, log, tokens, features)
+}
+
+func TestReadOnly(t *testing.T) {
+	b := newTestServer(t, nil)
+	ctx := context.Background()
+	book, err := b.CreateBook(ctx, &pb.CreateBookRequest{Book: &pb.Book{Title: "Emma"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b = newServer(b.DB, b.log, b.tokens, common.NewFeatures(featureReadOnly))
+	for name, call := range map[string]func() error{
+		"CreateBook": func() error {
+			_, err := b.CreateBook(ctx, &pb.CreateBookRequest{Book: &pb.Book{Title: "Persuasion"}})
+			return err
+		},
+		"UpdateBook": func() error {
+			_, err := b.UpdateBook(ctx, &pb.UpdateBookRequest{Id: book.Id, Book: &pb.Book{Title: "Persuasion"}})
+			return err
+		},
+		"DeleteBook": func() error {
+			_, err := b.DeleteBook(ctx, &pb.DeleteBookRequest{Id: book.Id})
+			return err
+		},
+	} {
+		if code := status.Code(call()); code != codes.Unavailable {
+			t.Errorf("%s = %v while read only, want %v", name, code, codes.Unavailable)
+		}
+	}
+	if got, err := b.GetBook(ctx, &pb.GetBookRequest{Id: book.Id}); err != nil || got.Title != "Emma" {
+		t.Errorf("GetBook = %v, %v while read only, want Emma unchanged", got, err)
+	}
+}
+
+func TestListBooksPageSize(t *testing.T) {
+	b := newTestServer(t, nil)
+	ctx := context.Background()
+	for _, title := range []string{"Emma", "Persuasion"} {
+		if _, err := b.CreateBook(ctx, &pb.CreateBookRequest{Book: &pb.Book{Title: title}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		pageSize int32
+		books    int
+		code     codes.Code
+	}{
+		{-1, 0, codes.InvalidArgument},
+		{0, 2, codes.OK},
+		{1, 1, codes.OK},
+		{maxPageSize + 1, 2, codes.OK},
+	} {
+		resp, err := b.ListBooks(ctx, &pb.ListBooksRequest{PageSize: test.pageSize})
+		if code := status.Code(err); code != test.code || len(resp.GetBooks()) != test.books {
+			t.Errorf("ListBooks(page_size %d) = %d books, %v, want %d, %v", test.pageSize, len(resp.GetBooks()), code, test.books, test.code)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	pb "book/pb/pb_book_v1"
+	"fmt"
+	"sort"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/genproto/protobuf/field_mask"
+	"google.golang.org/protobuf/proto"
+)
+
+// bookFields copies each field of a book that an update mask can name, the
+// paths are the field names in book_v1.proto.  The id can't be updated.
+var bookFields = map[string]func(dst, src *pb.Book){
+	"title":         func(dst, src *pb.Book) { dst.Title = src.GetTitle() },
+	"author":        func(dst, src *pb.Book) { dst.Author = src.GetAuthor() },
+	"publishedDate": func(dst, src *pb.Book) { dst.PublishedDate = src.GetPublishedDate() },
+	"imageURL":      func(dst, src *pb.Book) { dst.ImageURL = src.GetImageURL() },
+	"description":   func(dst, src *pb.Book) { dst.Description = src.GetDescription() },
+}
+
+// maskPaths returns the fields to update, with no mask it is the fields that are
+// set in src and "*" is every field.
+func maskPaths(src *pb.Book, mask *field_mask.FieldMask) ([]string, []*errdetails.BadRequest_FieldViolation) {
+	paths := mask.GetPaths()
+	if len(paths) == 0 {
+		for path, copyField := range bookFields {
+			field := &pb.Book{}
+			copyField(field, src)
+			if proto.Size(field) > 0 {
+				paths = append(paths, path)
+			}
+		}
+		sort.Strings(paths)
+		return paths, nil
+	}
+	if len(paths) == 1 && paths[0] == "*" {
+		paths = make([]string, 0, len(bookFields))
+		for path := range bookFields {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		return paths, nil
+	}
+	var vs []*errdetails.BadRequest_FieldViolation
+	for _, path := range paths {
+		if _, ok := bookFields[path]; !ok {
+			vs = append(vs, violation("update_mask", fmt.Sprintf("%q is not a field of a book that can be updated", path)))
+		}
+	}
+	return paths, vs
+}
+
+// applyMask updates the fields of dst named in paths from src
+func applyMask(dst, src *pb.Book, paths []string) {
+	for _, path := range paths {
+		bookFields[path](dst, src)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	pb "book/pb/pb_book_v1"
+	"reflect"
+	"testing"
+
+	"google.golang.org/genproto/protobuf/field_mask"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMaskPaths(t *testing.T) {
+	src := &pb.Book{Title: "Emma", Author: "Jane Austen"}
+	all := []string{"author", "description", "imageURL", "publishedDate", "title"}
+	for _, test := range []struct {
+		name       string
+		mask       *field_mask.FieldMask
+		paths      []string
+		violations int
+	}{
+		{"no mask", nil, []string{"author", "title"}, 0},
+		{"empty mask", &field_mask.FieldMask{}, []string{"author", "title"}, 0},
+		{"star", &field_mask.FieldMask{Paths: []string{"*"}}, all, 0},
+		{"paths", &field_mask.FieldMask{Paths: []string{"description", "title"}}, []string{"description", "title"}, 0},
+		{"unknown path", &field_mask.FieldMask{Paths: []string{"title", "colour"}}, nil, 1},
+		{"id", &field_mask.FieldMask{Paths: []string{"id"}}, nil, 1},
+		{"proto name", &field_mask.FieldMask{Paths: []string{"published_date"}}, nil, 1},
+		{"star and a path", &field_mask.FieldMask{Paths: []string{"*", "title"}}, nil, 1},
+	} {
+		paths, vs := maskPaths(src, test.mask)
+		if len(vs) != test.violations {
+			t.Errorf("%s: %d violations %v, want %d", test.name, len(vs), vs, test.violations)
+			continue
+		}
+		if len(vs) > 0 {
+			if vs[0].Field != "update_mask" {
+				t.Errorf("%s: the violation is of %q, want update_mask", test.name, vs[0].Field)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(paths, test.paths) {
+			t.Errorf("%s: paths = %v, want %v", test.name, paths, test.paths)
+		}
+	}
+}
+
+func TestApplyMask(t *testing.T) {
+	book := func() *pb.Book {
+		return &pb.Book{Id: "1", Title: "Emma", Author: "Jane Austen", Description: "Matchmaking", Etag: "e1"}
+	}
+	src := &pb.Book{Id: "2", Title: "Persuasion", PublishedDate: "1817", Etag: "e2"}
+	for _, test := range []struct {
+		paths []string
+		want  *pb.Book
+	}{
+		{nil, book()},
+		{[]string{"title"}, &pb.Book{Id: "1", Title: "Persuasion", Author: "Jane Austen", Description: "Matchmaking", Etag: "e1"}},
+		{[]string{"description", "publishedDate"}, &pb.Book{Id: "1", Title: "Emma", Author: "Jane Austen", PublishedDate: "1817", Etag: "e1"}},
+		{[]string{"author", "description", "imageURL", "publishedDate", "title"}, &pb.Book{Id: "1", Title: "Persuasion", PublishedDate: "1817", Etag: "e1"}},
+	} {
+		dst := book()
+		applyMask(dst, src, test.paths)
+		if !proto.Equal(dst, test.want) {
+			t.Errorf("applyMask(%v) = %v, want %v", test.paths, dst, test.want)
+		}
+	}
+}
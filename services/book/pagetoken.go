@@ -0,0 +1,133 @@
+package main
+
+import (
+	"book/dao"
+	pb "book/pb/pb_book_v1"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultPageSize int32 = 20  // Used when the client doesn't ask for a page size
+	maxPageSize     int32 = 100 // Larger requests are quietly trimmed to this
+)
+
+var ErrBadPageToken = errors.New("invalid page token")
+
+// pageTokens signs the cursors handed out as ListBooksResponse.next_page_token
+// so a client can hand them back but can't forge or edit them.
+type pageTokens struct {
+	mu     sync.RWMutex
+	secret string // The secret the key was made from, empty for a random key
+	key    []byte
+	prev   []byte // The key before the secret was rotated, its tokens still decode
+}
+
+// pageTokenConfig is the key of the secret, which can be rotated
+type pageTokenConfig struct {
+	Secret string `config:"page_token_secret" secret:"true"`
+}
+
+// pageToken is the payload of a page token, kept short as it ends up in URLs
+type pageToken struct {
+	Keys  []string `json:"k"`
+	Query string   `json:"q"` // A hash of the filter and order of the listing
+}
+
+// listQuery identifies the books a listing is of, a page token can only be used
+// to carry on listing the same books in the same order
+func listQuery(req *pb.ListBooksRequest) string {
+	sum := sha256.Sum256([]byte(req.Filter + "\x00" + req.OrderBy))
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+// newPageTokens signs tokens with the secret, if there is no secret then a random
+// one is made up which means tokens don't survive a restart of the service.
+func newPageTokens(secret string) (*pageTokens, error) {
+	key, err := pageTokenKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &pageTokens{secret: secret, key: key}, nil
+}
+
+func pageTokenKey(secret string) ([]byte, error) {
+	if secret != "" {
+		return []byte(secret), nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// rotate signs tokens with a new secret, the tokens signed before are still
+// accepted until the next rotation so a listing isn't cut short.  It is false
+// if the secret is the same, or empty which keeps the key there is.
+func (p *pageTokens) rotate(secret string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if secret == "" || secret == p.secret {
+		return false
+	}
+	p.secret, p.key, p.prev = secret, []byte(secret), p.key
+	return true
+}
+
+// encode turns a cursor into an opaque token, <payload>.<signature>
+func (p *pageTokens) encode(c *dao.Cursor, query string) (string, error) {
+	payload, err := json.Marshal(pageToken{Keys: c.Keys, Query: query})
+	if err != nil {
+		return "", err
+	}
+	b64 := base64.RawURLEncoding
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return b64.EncodeToString(payload) + "." + b64.EncodeToString(sign(p.key, payload)), nil
+}
+
+// decode checks the signature of the token and that it is for the same query
+// and returns the cursor inside it, an empty token is the first page so has no cursor
+func (p *pageTokens) decode(token, query string) (*dao.Cursor, error) {
+	if token == "" {
+		return nil, nil
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrBadPageToken
+	}
+	b64 := base64.RawURLEncoding
+	payload, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrBadPageToken
+	}
+	sig, err := b64.DecodeString(parts[1])
+	if err != nil || !p.verify(payload, sig) {
+		return nil, ErrBadPageToken
+	}
+	var t pageToken
+	if err := json.Unmarshal(payload, &t); err != nil || t.Query != query {
+		return nil, ErrBadPageToken
+	}
+	return &dao.Cursor{Keys: t.Keys}, nil
+}
+
+// verify checks the signature with the key, or the one before it
+func (p *pageTokens) verify(payload, sig []byte) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return hmac.Equal(sig, sign(p.key, payload)) || (p.prev != nil && hmac.Equal(sig, sign(p.prev, payload)))
+}
+
+func sign(key, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"book/dao"
+	pb "book/pb/pb_book_v1"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPageTokens(t *testing.T) {
+	p, err := newPageTokens("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &pb.ListBooksRequest{Filter: `author="Austen"`, OrderBy: "title"}
+	query := listQuery(req)
+	cursor := &dao.Cursor{Keys: []string{"Emma", "2"}}
+	token, err := p.encode(cursor, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	payload, sig := parts[0], parts[1]
+	other, err := newPageTokens("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := other.encode(cursor, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := "A" + sig[1:]
+	if sig[0] == 'A' {
+		tampered = "B" + sig[1:]
+	}
+
+	for _, test := range []struct {
+		name  string
+		token string
+		query string
+		want  *dao.Cursor // nil if the token is the first page or invalid
+		err   error
+	}{
+		{"round trip", token, query, cursor, nil},
+		{"first page", "", query, nil, nil},
+		{"tampered signature", payload + "." + tampered, query, nil, ErrBadPageToken},
+		{"tampered payload", "x" + token, query, nil, ErrBadPageToken},
+		{"another secret", forged, query, nil, ErrBadPageToken},
+		{"filter changed", token, listQuery(&pb.ListBooksRequest{Filter: `author="Bronte"`, OrderBy: "title"}), nil, ErrBadPageToken},
+		{"order_by changed", token, listQuery(&pb.ListBooksRequest{Filter: `author="Austen"`, OrderBy: "title desc"}), nil, ErrBadPageToken},
+		{"truncated payload", payload[:len(payload)-1] + "." + sig, query, nil, ErrBadPageToken},
+		{"truncated signature", payload + "." + sig[:len(sig)-1], query, nil, ErrBadPageToken},
+		{"no signature", payload, query, nil, ErrBadPageToken},
+		{"not base64", "!!." + sig, query, nil, ErrBadPageToken},
+	} {
+		got, err := p.decode(test.token, test.query)
+		if err != test.err || !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: decode(%q) = %v, %v, want %v, %v", test.name, test.token, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestPageTokenRotation(t *testing.T) {
+	p, err := newPageTokens("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cursor := &dao.Cursor{Keys: []string{"Emma", "2"}}
+	first, err := p.encode(cursor, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.rotate("second") {
+		t.Fatal("rotate(second) = false, want true")
+	}
+	second, err := p.encode(cursor, "q")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatal("the token is signed with the old secret after rotating it")
+	}
+	for _, token := range []string{first, second} {
+		if got, err := p.decode(token, "q"); err != nil || !reflect.DeepEqual(got, cursor) {
+			t.Errorf("decode(%q) = %v, %v after one rotation, want %v", token, got, err, cursor)
+		}
+	}
+	if !p.rotate("third") {
+		t.Fatal("rotate(third) = false, want true")
+	}
+	if _, err := p.decode(first, "q"); err != ErrBadPageToken {
+		t.Errorf("decode(%q) = %v two rotations later, want %v", first, err, ErrBadPageToken)
+	}
+}
+
+func TestPageTokenReloadWithoutSecret(t *testing.T) {
+	for _, secret := range []string{"", "secret"} {
+		p, err := newPageTokens(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cursor := &dao.Cursor{Keys: []string{"Emma", "2"}}
+		token, err := p.encode(cursor, "q")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// A reload, e.g. SIGHUP to change the log level, calls rotate with the
+		// secret there is, or none
+		for _, reload := range []string{secret, "", secret, ""} {
+			if p.rotate(reload) {
+				t.Errorf("rotate(%q) = true with the secret %q, want false", reload, secret)
+			}
+		}
+		if got, err := p.decode(token, "q"); err != nil || !reflect.DeepEqual(got, cursor) {
+			t.Errorf("decode = %v, %v after reloads with the secret %q, want %v", got, err, secret, cursor)
+		}
+	}
+}
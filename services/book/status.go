@@ -0,0 +1,60 @@
+package main
+
+import (
+	"book/dao"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// codeOf picks the gRPC code for an error from the book database
+func codeOf(err error) codes.Code {
+	switch {
+	case errors.Is(err, dao.ErrNotFound):
+		return codes.NotFound
+	case errors.Is(err, dao.ErrInvalidArgument):
+		return codes.InvalidArgument
+	case errors.Is(err, dao.ErrAlreadyExists):
+		return codes.AlreadyExists
+	case errors.Is(err, dao.ErrUnavailable):
+		return codes.Unavailable
+	case errors.Is(err, dao.ErrConflict):
+		return codes.Aborted
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	}
+	return codes.Internal
+}
+
+// statusError turns an error from the book database into a gRPC status error so
+// the client sees NOT_FOUND etc. rather than UNKNOWN
+func statusError(err error, format string, a ...interface{}) error {
+	return status.Errorf(codeOf(err), "%s: %v", fmt.Sprintf(format, a...), err)
+}
+
+// violation says which field of a request is wrong and why
+func violation(field, description string) *errdetails.BadRequest_FieldViolation {
+	return &errdetails.BadRequest_FieldViolation{Field: field, Description: description}
+}
+
+// badRequest is an INVALID_ARGUMENT status error with a BadRequest detail that
+// lists the violations, a client can show them next to the fields
+func badRequest(violations ...*errdetails.BadRequest_FieldViolation) error {
+	msgs := make([]string, len(violations))
+	for i, v := range violations {
+		msgs[i] = v.Field + ": " + v.Description
+	}
+	st := status.New(codes.InvalidArgument, "invalid request: "+strings.Join(msgs, ", "))
+	ds, err := st.WithDetails(&errdetails.BadRequest{FieldViolations: violations})
+	if err != nil {
+		return st.Err()
+	}
+	return ds.Err()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"book/dao"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestStatusError(t *testing.T) {
+	for _, test := range []struct {
+		err  error
+		code codes.Code
+	}{
+		{dao.ErrNotFound, codes.NotFound},
+		{dao.ErrInvalidArgument, codes.InvalidArgument},
+		{dao.ErrAlreadyExists, codes.AlreadyExists},
+		{dao.ErrUnavailable, codes.Unavailable},
+		{dao.ErrConflict, codes.Aborted},
+		{context.Canceled, codes.Canceled},
+		{context.DeadlineExceeded, codes.DeadlineExceeded},
+		{fmt.Errorf("book 42: %w", dao.ErrNotFound), codes.NotFound},
+		{errors.New("disk full"), codes.Internal},
+	} {
+		err := statusError(test.err, "could not get book %s", "42")
+		st := status.Convert(err)
+		if st.Code() != test.code {
+			t.Errorf("statusError(%v) code = %v, want %v", test.err, st.Code(), test.code)
+		}
+		if want := "could not get book 42: " + test.err.Error(); st.Message() != want {
+			t.Errorf("statusError(%v) message = %q, want %q", test.err, st.Message(), want)
+		}
+	}
+}
+
+func TestBadRequest(t *testing.T) {
+	st := status.Convert(badRequest(violation("book.title", "the title is required"), violation("book.author", "too long")))
+	if st.Code() != codes.InvalidArgument {
+		t.Errorf("code = %v, want %v", st.Code(), codes.InvalidArgument)
+	}
+	if !strings.Contains(st.Message(), "book.title: the title is required, book.author: too long") {
+		t.Errorf("message = %q, want the violations", st.Message())
+	}
+	details := st.Details()
+	if len(details) != 1 {
+		t.Fatalf("%d details, want a BadRequest", len(details))
+	}
+	br, ok := details[0].(*errdetails.BadRequest)
+	if !ok {
+		t.Fatalf("the detail is a %T, want a BadRequest", details[0])
+	}
+	vs := br.GetFieldViolations()
+	if len(vs) != 2 || vs[0].Field != "book.title" || vs[0].Description != "the title is required" || vs[1].Field != "book.author" {
+		t.Errorf("violations = %v, want book.title and book.author", vs)
+	}
+}
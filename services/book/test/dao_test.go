@@ -0,0 +1,79 @@
+package book_test
+
+import (
+	"book/dao"
+	"book/dao/daotest"
+	pb "book/pb/pb_book_v1"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryDB(t *testing.T) {
+	daotest.RunBookDatabaseSuite(t, func(t *testing.T) dao.BookDatabase {
+		db, err := dao.NewBookDatabase(dao.DriverMemory, "")
+		if err != nil {
+			t.Fatalf("NewBookDatabase(%q) = %v", dao.DriverMemory, err)
+		}
+		return db
+	})
+}
+
+func TestSQLiteDB(t *testing.T) {
+	dir := t.TempDir()
+	daotest.RunBookDatabaseSuite(t, func(t *testing.T) dao.BookDatabase {
+		dsn := filepath.Join(dir, t.Name()[len("TestSQLiteDB/"):]+".db")
+		db, err := dao.NewBookDatabase(dao.DriverSQLite, dsn)
+		if err != nil {
+			t.Fatalf("NewBookDatabase(%q, %q) = %v", dao.DriverSQLite, dsn, err)
+		}
+		return db
+	})
+}
+
+func TestSQLiteDBClosed(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "closed.db")
+	db, err := dao.NewBookDatabase(dao.DriverSQLite, dsn)
+	if err != nil {
+		t.Fatalf("NewBookDatabase(%q, %q) = %v", dao.DriverSQLite, dsn, err)
+	}
+	ctx := context.Background()
+	id, err := db.AddBook(ctx, &pb.Book{Title: "Emma"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for name, call := range map[string]func() error{
+		"GetBook": func() error {
+			_, err := db.GetBook(ctx, id)
+			return err
+		},
+		"AddBook": func() error {
+			_, err := db.AddBook(ctx, &pb.Book{Title: "Persuasion"})
+			return err
+		},
+		"UpdateBook": func() error { return db.UpdateBook(ctx, &pb.Book{Id: id, Title: "Persuasion"}) },
+		"DeleteBook": func() error { return db.DeleteBook(ctx, id, "") },
+		"ListBooks": func() error {
+			_, err := db.ListBooks(ctx, dao.ListOptions{})
+			return err
+		},
+	} {
+		if err := call(); !errors.Is(err, dao.ErrUnavailable) {
+			t.Errorf("%s = %v once closed, want %v", name, err, dao.ErrUnavailable)
+		}
+	}
+}
+
+func TestTracedDB(t *testing.T) {
+	daotest.RunBookDatabaseSuite(t, func(t *testing.T) dao.BookDatabase {
+		db, err := dao.NewBookDatabase(dao.DriverMemory, "")
+		if err != nil {
+			t.Fatalf("NewBookDatabase(%q) = %v", dao.DriverMemory, err)
+		}
+		return dao.Traced(db, dao.DriverMemory)
+	})
+}
@@ -0,0 +1,45 @@
+package book_test
+
+import (
+	"book/dao"
+	"errors"
+	"testing"
+)
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, filter := range []string{
+		`title=`,
+		`=title`,
+		`colour="red"`,
+		`"title"="Emma"`,
+		`title:"unterminated`,
+		`(title:map`,
+		`title:map)`,
+		`AND title:map`,
+		`title:map OR`,
+		`NOT`,
+		`title!map`,
+	} {
+		if f, err := dao.ParseFilter(filter); !errors.Is(err, dao.ErrInvalidArgument) {
+			t.Errorf("ParseFilter(%q) = %v, %v, want %v", filter, f, err, dao.ErrInvalidArgument)
+		}
+	}
+}
+
+func TestParseOrderBy(t *testing.T) {
+	for orderBy, want := range map[string]string{
+		``:                                ``,
+		`title`:                           `title`,
+		` author desc ,publishedDate asc`: `author desc, publishedDate`,
+	} {
+		got, err := dao.ParseOrderBy(orderBy)
+		if err != nil || got.String() != want {
+			t.Errorf("ParseOrderBy(%q) = %q, %v, want %q", orderBy, got, err, want)
+		}
+	}
+	for _, orderBy := range []string{`colour`, `title,`, `title descending`, `title, title desc`, `title desc asc`} {
+		if got, err := dao.ParseOrderBy(orderBy); !errors.Is(err, dao.ErrInvalidArgument) {
+			t.Errorf("ParseOrderBy(%q) = %q, %v, want %v", orderBy, got, err, dao.ErrInvalidArgument)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	pb "book/pb/pb_book_v1"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+)
+
+const (
+	maxTitleLength  = 200
+	maxAuthorLength = 100
+)
+
+// publishedDateLayouts are the accepted forms of publishedDate, a year on its
+// own is fine as that is often all that is known
+var publishedDateLayouts = []string{"2006", "2006-01", "2006-01-02"}
+
+// validateBook checks the fields of a book, field names in the violations are
+// prefixed with prefix e.g. "book."
+func validateBook(prefix string, b *pb.Book) []*errdetails.BadRequest_FieldViolation {
+	if b == nil {
+		return []*errdetails.BadRequest_FieldViolation{violation(strings.TrimSuffix(prefix, "."), "a book is required")}
+	}
+	var vs []*errdetails.BadRequest_FieldViolation
+	switch n := utf8.RuneCountInString(b.Title); {
+	case strings.TrimSpace(b.Title) == "":
+		vs = append(vs, violation(prefix+"title", "the title is required"))
+	case n > maxTitleLength:
+		vs = append(vs, violation(prefix+"title", fmt.Sprintf("the title must be at most %d characters", maxTitleLength)))
+	}
+	switch n := utf8.RuneCountInString(b.Author); {
+	case b.Author != "" && strings.TrimSpace(b.Author) == "":
+		vs = append(vs, violation(prefix+"author", "the author must not be blank"))
+	case n > maxAuthorLength:
+		vs = append(vs, violation(prefix+"author", fmt.Sprintf("the author must be at most %d characters", maxAuthorLength)))
+	}
+	if b.PublishedDate != "" && !validDate(b.PublishedDate) {
+		vs = append(vs, violation(prefix+"publishedDate", "the published date must be YYYY, YYYY-MM or YYYY-MM-DD"))
+	}
+	return vs
+}
+
+func validDate(s string) bool {
+	for _, layout := range publishedDateLayouts {
+		if _, err := time.Parse(layout, s); err == nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	pb "book/pb/pb_book_v1"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateBook(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		book   *pb.Book
+		fields []string // The fields with violations
+	}{
+		{"no book", nil, []string{"book"}},
+		{"title only", &pb.Book{Title: "Emma"}, nil},
+		{"no title", &pb.Book{Author: "Jane Austen"}, []string{"book.title"}},
+		{"blank title", &pb.Book{Title: " \t"}, []string{"book.title"}},
+		{"longest title", &pb.Book{Title: strings.Repeat("a", maxTitleLength)}, nil},
+		{"title too long", &pb.Book{Title: strings.Repeat("a", maxTitleLength+1)}, []string{"book.title"}},
+		{"longest multibyte title", &pb.Book{Title: strings.Repeat("é", maxTitleLength)}, nil},
+		{"multibyte title too long", &pb.Book{Title: strings.Repeat("語", maxTitleLength+1)}, []string{"book.title"}},
+		{"longest author", &pb.Book{Title: "Emma", Author: strings.Repeat("ß", maxAuthorLength)}, nil},
+		{"author too long", &pb.Book{Title: "Emma", Author: strings.Repeat("a", maxAuthorLength+1)}, []string{"book.author"}},
+		{"blank author", &pb.Book{Title: "Emma", Author: "  "}, []string{"book.author"}},
+		{"year", &pb.Book{Title: "Emma", PublishedDate: "1815"}, nil},
+		{"month", &pb.Book{Title: "Emma", PublishedDate: "1815-12"}, nil},
+		{"day", &pb.Book{Title: "Emma", PublishedDate: "1815-12-23"}, nil},
+		{"no such day", &pb.Book{Title: "Emma", PublishedDate: "1815-02-30"}, []string{"book.publishedDate"}},
+		{"no such month", &pb.Book{Title: "Emma", PublishedDate: "1815-13"}, []string{"book.publishedDate"}},
+		{"short year", &pb.Book{Title: "Emma", PublishedDate: "815"}, []string{"book.publishedDate"}},
+		{"other form", &pb.Book{Title: "Emma", PublishedDate: "23/12/1815"}, []string{"book.publishedDate"}},
+		{"everything wrong", &pb.Book{Title: "", Author: " ", PublishedDate: "soon"},
+			[]string{"book.title", "book.author", "book.publishedDate"}},
+	} {
+		var fields []string
+		for _, v := range validateBook("book.", test.book) {
+			fields = append(fields, v.Field)
+		}
+		if !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%s: violations of %v, want %v", test.name, fields, test.fields)
+		}
+	}
+}
@@ -12,8 +12,10 @@ import (
 	"io/ioutil"
 	"lib/common"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"strings"
 
 	pb "frontend/pb/pb_book_v1"
 )
@@ -23,21 +25,48 @@ var (
 	ErrNeedBookID = errors.New("Need a book ID")
 )
 
-// listHandler displays a list of books in the database.
+// listHandler displays a page of books in the database, the books can be
+// searched with an AIP-160 filter in the "filter" query parameter and sorted
+// with the "order_by" parameter.
+// The book service only hands out tokens for the next page, so the tokens of the
+// pages already seen are carried along in the "prev" query parameter to be able
+// to step back through them.
 func (fe *frontendServer) listBook(w http.ResponseWriter, r *http.Request) {
 	fe.log.Debug("List books")
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	ctx := r.Context()
-	books, err := fe.ListBooks(ctx)
-	if err != nil {
+	query := r.URL.Query()
+	pageToken := query.Get("page_token")
+	prev := query["prev"]
+	filter, orderBy := query.Get("filter"), query.Get("order_by")
+	list := url.Values{}
+	if filter != "" {
+		list.Set("filter", filter)
+	}
+	if orderBy != "" {
+		list.Set("order_by", orderBy)
+	}
+	books, nextPageToken, err := fe.ListBooks(ctx, pageToken, filter, orderBy)
+	invalid := fieldViolations(err)
+	if err != nil && invalid == nil {
 		renderHTTPError(r, w, fmt.Errorf("could not retrieve books. %w", err))
 		return
 	}
+	if invalid != nil {
+		w.WriteHeader(http.StatusBadRequest)
+	}
 	if err := bookTemplates.ExecuteTemplate(w, "list", map[string]interface{}{
 		"session_id":    sessionID(r),
-		"request_id":    r.Context().Value(ctxKeyRequestID{}),
-		"banner_color":  common.App.CanaryColour, // illustrates canary deployments
+		"request_id":    common.RequestID(r.Context()),
+		"visitor":       visitorOf(r),
+		"banner_color":  bannerColour(), // illustrates canary deployments
 		"books":         books,
+		"filter":        filter,
+		"order_by":      orderBy,
+		"order_bys":     bookOrderBys,
+		"invalid":       invalid,
+		"next_url":      nextPageURL(list, nextPageToken, pageToken, prev),
+		"prev_url":      prevPageURL(list, prev),
 		"platform_url":  common.App.Platform.Url,
 		"platform_name": common.App.Platform.Provider,
 	}); err != nil {
@@ -45,14 +74,62 @@ func (fe *frontendServer) listBook(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// bookOrderBys are the orders the list of books can be sorted in
+var bookOrderBys = []struct{ OrderBy, Name string }{
+	{"", "Title"},
+	{"title desc", "Title, Z to A"},
+	{"author, title", "Author"},
+	{"publishedDate desc, title", "Newest"},
+	{"publishedDate, title", "Oldest"},
+}
+
+// nextPageURL is the link to the next page of books, empty if on the last page.
+// list holds the query parameters that pick the books listed.
+func nextPageURL(list url.Values, nextPageToken, pageToken string, prev []string) string {
+	if nextPageToken == "" {
+		return ""
+	}
+	q := copyValues(list)
+	q.Set("page_token", nextPageToken)
+	q["prev"] = append(append([]string{}, prev...), pageToken)
+	return "/books?" + q.Encode()
+}
+
+// prevPageURL is the link to the previous page of books, empty if on the first page
+func prevPageURL(list url.Values, prev []string) string {
+	if len(prev) == 0 {
+		return ""
+	}
+	q := copyValues(list)
+	if pageToken := prev[len(prev)-1]; pageToken != "" {
+		q.Set("page_token", pageToken)
+	}
+	if len(prev) > 1 {
+		q["prev"] = prev[:len(prev)-1]
+	}
+	if len(q) == 0 {
+		return "/books"
+	}
+	return "/books?" + q.Encode()
+}
+
+func copyValues(v url.Values) url.Values {
+	c := url.Values{}
+	for k, vs := range v {
+		c[k] = append([]string{}, vs...)
+	}
+	return c
+}
+
 // addBook displays a blank edit form that captures details of a new book to add
 func (fe *frontendServer) addBook(w http.ResponseWriter, r *http.Request) {
 	fe.log.Debug("Add Book")
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	if err := bookTemplates.ExecuteTemplate(w, "edit", map[string]interface{}{
 		"session_id":    sessionID(r),
-		"request_id":    r.Context().Value(ctxKeyRequestID{}),
-		"banner_color":  common.App.CanaryColour, // illustrates canary deployments
+		"request_id":    common.RequestID(r.Context()),
+		"visitor":       visitorOf(r),
+		"banner_color":  bannerColour(), // illustrates canary deployments
 		"platform_url":  common.App.Platform.Url,
 		"platform_name": common.App.Platform.Provider,
 	}); err != nil {
@@ -71,8 +148,9 @@ func (fe *frontendServer) bookDetail(w http.ResponseWriter, r *http.Request) {
 	}
 	if err := bookTemplates.ExecuteTemplate(w, "detail.gohtml", map[string]interface{}{
 		"session_id":    sessionID(r),
-		"request_id":    r.Context().Value(ctxKeyRequestID{}),
-		"banner_color":  common.App.CanaryColour, // illustrates canary deployments
+		"request_id":    common.RequestID(r.Context()),
+		"visitor":       visitorOf(r),
+		"banner_color":  bannerColour(), // illustrates canary deployments
 		"book":          book,
 		"platform_url":  common.App.Platform.Url,
 		"platform_name": common.App.Platform.Provider,
@@ -101,24 +179,53 @@ func (fe *frontendServer) bookFromRequest(r *http.Request) (*pb.Book, error) {
 // editBook shows the details of a given book to edit.
 func (fe *frontendServer) editBook(w http.ResponseWriter, r *http.Request) {
 	fe.log.Debug("Edit book")
-	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	book, err := fe.bookFromRequest(r)
 	if err != nil {
 		renderHTTPError(r, w, fmt.Errorf("could not retrieve book. %w", err))
 		return
 	}
+	fe.renderEditForm(w, r, book, nil)
+}
+
+// renderEditForm shows the edit form for the book, invalid holds the message to
+// show next to each invalid field keyed by the name of the form field.
+func (fe *frontendServer) renderEditForm(w http.ResponseWriter, r *http.Request, book *pb.Book, invalid map[string]string) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	if len(invalid) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
 	if err := bookTemplates.ExecuteTemplate(w, "edit", map[string]interface{}{
 		"session_id":    sessionID(r),
-		"request_id":    r.Context().Value(ctxKeyRequestID{}),
-		"banner_color":  common.App.CanaryColour, // illustrates canary deployments
+		"request_id":    common.RequestID(r.Context()),
+		"visitor":       visitorOf(r),
+		"banner_color":  bannerColour(), // illustrates canary deployments
 		"platform_url":  common.App.Platform.Url,
 		"platform_name": common.App.Platform.Provider,
 		"book":          book,
+		"invalid":       invalid,
 	}); err != nil {
 		log.Println(err)
 	}
 }
 
+// formErrors turns the field violations of a failed book request into errors for
+// the edit form, the form fields are named after the fields of the book.
+func formErrors(err error) map[string]string {
+	violations := fieldViolations(err)
+	if violations == nil {
+		return nil
+	}
+	invalid := map[string]string{}
+	for field, description := range violations {
+		invalid[strings.TrimPrefix(field, "book.")] = description
+	}
+	return invalid
+}
+
+// bookFormFields are the fields of a book that are on the edit form, an update
+// from the form leaves any other fields of the book alone.
+var bookFormFields = []string{"title", "author", "publishedDate", "imageURL", "description"}
+
 // bookFromForm populates the fields of a Book from form values
 // (see templates/book/edit.gohtml).
 func (fe *frontendServer) bookFromForm(r *http.Request) (*pb.Book, error) {
@@ -141,6 +248,7 @@ func (fe *frontendServer) bookFromForm(r *http.Request) (*pb.Book, error) {
 		PublishedDate: r.FormValue("publishedDate"),
 		ImageURL:      imageURL,
 		Description:   r.FormValue("description"),
+		Etag:          r.FormValue("etag"),
 	}
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	log.Info("Read from form:", book)
@@ -154,10 +262,16 @@ func (fe *frontendServer) createBook(w http.ResponseWriter, r *http.Request) {
 	book, err := fe.bookFromForm(r)
 	if err != nil {
 		renderHTTPError(r, w, fmt.Errorf("could not parse book from form: %w", err))
+		return
 	}
 	id, err := fe.AddBook(ctx, book)
+	if invalid := formErrors(err); invalid != nil {
+		fe.renderEditForm(w, r, book, invalid)
+		return
+	}
 	if err != nil {
 		renderHTTPError(r, w, fmt.Errorf("could not save book from form: %w", err))
+		return
 	}
 	http.Redirect(w, r, fmt.Sprintf("/books/%s", id), http.StatusFound)
 	//w.Header().Set("location", "/cart")
@@ -172,18 +286,30 @@ func (fe *frontendServer) updateBook(w http.ResponseWriter, r *http.Request) {
 	if id == "" {
 		fe.log.Errorf("Cannot update book: %v", ErrNeedBookID)
 		renderHTTPError(r, w, fmt.Errorf("Cannot update book: %w", ErrNeedBookID))
+		return
 	}
 	book, err := fe.bookFromForm(r)
 	if err != nil {
 		fe.log.Errorf("could not update book from form: %v", err)
 		renderHTTPError(r, w, fmt.Errorf("could not update book from form: %w", err))
+		return
 	}
 	book.Id = id
 
-	if book, err = fe.UpdateBook(ctx, book); err != nil {
+	updated, err := fe.UpdateBook(ctx, book, bookFormFields)
+	if invalid := formErrors(err); invalid != nil {
+		fe.renderEditForm(w, r, book, invalid)
+		return
+	}
+	if isConflict(err) {
+		fe.renderConflict(w, r, id, book)
+		return
+	}
+	if err != nil {
 		renderHTTPError(r, w, fmt.Errorf("could not update book: %w", err))
+		return
 	}
-	http.Redirect(w, r, fmt.Sprintf("/books/%s", book.Id), http.StatusFound)
+	http.Redirect(w, r, fmt.Sprintf("/books/%s", updated.Id), http.StatusFound)
 }
 
 // deleteBook deletes a given book.
@@ -191,12 +317,43 @@ func (fe *frontendServer) deleteBook(w http.ResponseWriter, r *http.Request) {
 	fe.log.Debug("Delete book")
 	ctx := r.Context()
 	id := mux.Vars(r)["id"]
-	if err := fe.DeleteBook(ctx, id); err != nil {
-		renderHTTPError(r, w, fmt.Errorf("could not update book: %w", err))
+	err := fe.DeleteBook(ctx, id, r.FormValue("etag"))
+	if isConflict(err) {
+		fe.renderConflict(w, r, id, nil)
+		return
+	}
+	if err != nil {
+		renderHTTPError(r, w, fmt.Errorf("could not delete book: %w", err))
+		return
 	}
 	http.Redirect(w, r, "/books", http.StatusFound)
 }
 
+// renderConflict shows the book as it is now when an update or delete of the
+// book failed because someone else changed it first, mine is the rejected
+// update or nil for a delete.
+func (fe *frontendServer) renderConflict(w http.ResponseWriter, r *http.Request, id string, mine *pb.Book) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	current, err := fe.GetBook(r.Context(), id)
+	if err != nil {
+		renderHTTPError(r, w, fmt.Errorf("could not retrieve book after a conflict: %w", err))
+		return
+	}
+	w.WriteHeader(http.StatusConflict)
+	if err := bookTemplates.ExecuteTemplate(w, "conflict", map[string]interface{}{
+		"session_id":    sessionID(r),
+		"request_id":    common.RequestID(r.Context()),
+		"visitor":       visitorOf(r),
+		"banner_color":  bannerColour(), // illustrates canary deployments
+		"platform_url":  common.App.Platform.Url,
+		"platform_name": common.App.Platform.Provider,
+		"book":          current,
+		"mine":          mine,
+	}); err != nil {
+		log.Println(err)
+	}
+}
+
 func (fe frontendServer) bookTemplates(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "%v\n", bookTemplates)
 }
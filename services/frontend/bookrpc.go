@@ -4,21 +4,28 @@ import (
 	"context"
 
 	pb "frontend/pb/pb_book_v1"
+
+	"google.golang.org/genproto/protobuf/field_mask"
 )
 
 // Lists books. The order is unspecified but deterministic. Newly created
 // books will not necessarily appear at the end of this list.
-func (fe *frontendServer) ListBooks(ctx context.Context) ([]*pb.Book, error) {
-	req := pb.ListBooksRequest{}
+// ListBooks returns the page of books that match the filter for the page token
+// along with the token for the next page, which is empty on the last page.
+func (fe *frontendServer) ListBooks(ctx context.Context, pageToken, filter, orderBy string) ([]*pb.Book, string, error) {
+	req := pb.ListBooksRequest{PageToken: pageToken, Filter: filter, OrderBy: orderBy}
 	resp, err := pb.NewBookServiceClient(fe.bookSvcConn).ListBooks(ctx, &req)
-	return resp.Books, err
+	if err != nil {
+		return nil, "", err
+	}
+	return resp.Books, resp.NextPageToken, nil
 }
 
 // Creates a book, and returns the new Book.
 func (fe *frontendServer) AddBook(ctx context.Context, b *pb.Book) (id string, err error) {
 	req := pb.CreateBookRequest{Book: b}
 	resp, err := pb.NewBookServiceClient(fe.bookSvcConn).CreateBook(ctx, &req)
-	return resp.Id, err
+	return resp.GetId(), err
 }
 
 func (fe *frontendServer) GetBook(ctx context.Context, id string) (*pb.Book, error) {
@@ -27,16 +34,17 @@ func (fe *frontendServer) GetBook(ctx context.Context, id string) (*pb.Book, err
 	return resp, err
 }
 
-// DeleteBook removes a given book by its ID.
-func (fe *frontendServer) DeleteBook(ctx context.Context, id string) error {
-	req := pb.DeleteBookRequest{Id: id}
+// DeleteBook removes a given book by its ID, if the etag is set the book is only
+// removed if it hasn't changed.
+func (fe *frontendServer) DeleteBook(ctx context.Context, id, etag string) error {
+	req := pb.DeleteBookRequest{Id: id, Etag: etag}
 	_, err := pb.NewBookServiceClient(fe.bookSvcConn).DeleteBook(ctx, &req)
 	return err
 }
 
-// UpdateBook updates the entry for a given book.
-func (fe *frontendServer) UpdateBook(ctx context.Context, b *pb.Book) (*pb.Book, error) {
-	req := pb.UpdateBookRequest{Book: b}
+// UpdateBook updates the given fields of the entry for a book, e.g. "title".
+func (fe *frontendServer) UpdateBook(ctx context.Context, b *pb.Book, fields []string) (*pb.Book, error) {
+	req := pb.UpdateBookRequest{Id: b.Id, Book: b, UpdateMask: &field_mask.FieldMask{Paths: fields}}
 	resp, err := pb.NewBookServiceClient(fe.bookSvcConn).UpdateBook(ctx, &req)
 	return resp, err
 }
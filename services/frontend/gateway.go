@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"lib/common"
+)
+
+// maxBodyBytes is the largest request body the gateway reads, a book is far
+// smaller
+const maxBodyBytes = 1 << 20
+
+// gateway serves the REST/JSON API of a gRPC service from the google.api.http
+// annotations in its proto, e.g. GET /v1/books/1 calls BookService.GetBook with
+// the id "books/1".  Messages are read and written with protojson, so fields use
+// their JSON names, and a failed call returns the google.rpc.Status as JSON
+// with the HTTP status for its code.
+type gateway struct {
+	conn   *grpc.ClientConn
+	routes []*route
+}
+
+// route is one HTTP binding of an RPC
+type route struct {
+	method       string // The HTTP method
+	parts        []part // The segments of the path template
+	verb         string // A custom verb after the last segment, e.g. "cancel"
+	body         string // The request field the body goes in, "*" for the whole request
+	responseBody string // The response field that is returned, "" for the whole response
+	rpc          protoreflect.MethodDescriptor
+	fullMethod   string // e.g. /book.v1.BookService/GetBook
+}
+
+// part of a path template, a literal segment or a wildcard "*" or "**"
+// which, if field is set, is part of the value of a variable
+type part struct {
+	match string
+	field string
+}
+
+// newGateway makes the routes for every annotated method of the service, which
+// are called using conn.
+func newGateway(conn *grpc.ClientConn, sd protoreflect.ServiceDescriptor) (*gateway, error) {
+	g := &gateway{conn: conn}
+	methods := sd.Methods()
+	for i := 0; i < methods.Len(); i++ {
+		m := methods.Get(i)
+		rule, ok := proto.GetExtension(m.Options(), annotations.E_Http).(*annotations.HttpRule)
+		if !ok || rule == nil {
+			continue
+		}
+		for _, r := range append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...) {
+			rt, err := newRoute(r, m)
+			if err != nil {
+				return nil, fmt.Errorf("gateway: %s: %w", m.FullName(), err)
+			}
+			rt.fullMethod = fmt.Sprintf("/%s/%s", sd.FullName(), m.Name())
+			g.routes = append(g.routes, rt)
+		}
+	}
+	return g, nil
+}
+
+func newRoute(rule *annotations.HttpRule, m protoreflect.MethodDescriptor) (*route, error) {
+	rt := &route{body: rule.GetBody(), responseBody: rule.GetResponseBody(), rpc: m}
+	var tmpl string
+	switch p := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		rt.method, tmpl = http.MethodGet, p.Get
+	case *annotations.HttpRule_Put:
+		rt.method, tmpl = http.MethodPut, p.Put
+	case *annotations.HttpRule_Post:
+		rt.method, tmpl = http.MethodPost, p.Post
+	case *annotations.HttpRule_Delete:
+		rt.method, tmpl = http.MethodDelete, p.Delete
+	case *annotations.HttpRule_Patch:
+		rt.method, tmpl = http.MethodPatch, p.Patch
+	case *annotations.HttpRule_Custom:
+		rt.method, tmpl = p.Custom.GetKind(), p.Custom.GetPath()
+	default:
+		return nil, fmt.Errorf("no pattern in http rule")
+	}
+	var err error
+	if rt.parts, rt.verb, err = parseTemplate(tmpl); err != nil {
+		return nil, err
+	}
+	return rt, nil
+}
+
+// parseTemplate parses a path template such as /v1/{id=books/*}:verb
+func parseTemplate(tmpl string) ([]part, string, error) {
+	if !strings.HasPrefix(tmpl, "/") {
+		return nil, "", fmt.Errorf("path template %q must start with /", tmpl)
+	}
+	s := tmpl[1:]
+	verb := ""
+	if i := strings.LastIndex(s, ":"); i > strings.LastIndex(s, "}") {
+		s, verb = s[:i], s[i+1:]
+	}
+	var parts []part
+	for s != "" {
+		if s[0] == '{' {
+			end := strings.IndexByte(s, '}')
+			if end < 0 {
+				return nil, "", fmt.Errorf("path template %q has an unclosed variable", tmpl)
+			}
+			field, pattern := s[1:end], "*"
+			if i := strings.IndexByte(field, '='); i >= 0 {
+				field, pattern = field[:i], field[i+1:]
+			}
+			for _, m := range strings.Split(pattern, "/") {
+				parts = append(parts, part{match: m, field: field})
+			}
+			s = s[end+1:]
+		} else {
+			end := strings.IndexByte(s, '/')
+			if end < 0 {
+				end = len(s)
+			}
+			parts = append(parts, part{match: s[:end]})
+			s = s[end:]
+		}
+		s = strings.TrimPrefix(s, "/")
+	}
+	return parts, verb, nil
+}
+
+// match returns the values of the variables in the path if it fits the template
+func (rt *route) match(segments []string) (map[string]string, bool) {
+	if rt.verb != "" {
+		last := len(segments) - 1
+		if last < 0 || !strings.HasSuffix(segments[last], ":"+rt.verb) {
+			return nil, false
+		}
+		segments = append(segments[:last:last], strings.TrimSuffix(segments[last], ":"+rt.verb))
+	}
+	vars := map[string][]string{}
+	i := 0
+	for n, p := range rt.parts {
+		var matched []string
+		switch {
+		case p.match == "**":
+			if n != len(rt.parts)-1 {
+				return nil, false // ** is only allowed at the end
+			}
+			matched, i = segments[i:], len(segments)
+		case i >= len(segments):
+			return nil, false
+		case p.match == "*" || p.match == segments[i]:
+			matched, i = segments[i:i+1], i+1
+		default:
+			return nil, false
+		}
+		if p.field != "" {
+			vars[p.field] = append(vars[p.field], matched...)
+		}
+	}
+	if i != len(segments) {
+		return nil, false
+	}
+	values := map[string]string{}
+	for field, v := range vars {
+		values[field] = strings.Join(v, "/")
+	}
+	return values, true
+}
+
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var segments []string
+	for _, s := range strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/") {
+		u, err := url.PathUnescape(s)
+		if err != nil {
+			g.writeError(w, r, status.Newf(codes.InvalidArgument, "bad path: %v", err))
+			return
+		}
+		segments = append(segments, u)
+	}
+	found := false
+	for _, rt := range g.routes {
+		vars, ok := rt.match(segments)
+		if !ok {
+			continue
+		}
+		found = true
+		if rt.method == r.Method {
+			g.call(w, r, rt, vars)
+			return
+		}
+	}
+	if found {
+		w.Header().Set("Allow", strings.Join(g.methods(segments), ", "))
+		g.write(w, r, http.StatusMethodNotAllowed, status.New(codes.Unimplemented, http.StatusText(http.StatusMethodNotAllowed)).Proto())
+		return
+	}
+	g.writeError(w, r, status.New(codes.NotFound, http.StatusText(http.StatusNotFound)))
+}
+
+// methods are the HTTP methods of the routes that match the path
+func (g *gateway) methods(segments []string) []string {
+	var methods []string
+	for _, rt := range g.routes {
+		if _, ok := rt.match(segments); ok {
+			methods = append(methods, rt.method)
+		}
+	}
+	return methods
+}
+
+// call makes the RPC of the route from the body, path variables and query
+// parameters of the request and writes the response
+func (g *gateway) call(w http.ResponseWriter, r *http.Request, rt *route, vars map[string]string) {
+	in, err := newMessage(rt.rpc.Input())
+	if err != nil {
+		g.writeError(w, r, status.New(codes.Internal, err.Error()))
+		return
+	}
+	if err := readBody(w, r, in, rt.body); err != nil {
+		g.writeError(w, r, status.Newf(codes.InvalidArgument, "bad request body: %v", err))
+		return
+	}
+	for field, value := range vars {
+		if err := setField(in, field, []string{value}); err != nil {
+			g.writeError(w, r, status.Newf(codes.InvalidArgument, "bad path: %v", err))
+			return
+		}
+	}
+	if rt.body != "*" {
+		for key, values := range r.URL.Query() {
+			if err := setField(in, key, values); err != nil {
+				g.writeError(w, r, status.Newf(codes.InvalidArgument, "bad query parameter: %v", err))
+				return
+			}
+		}
+	}
+	if rt.method == http.MethodPut {
+		replaceAll(in)
+	}
+	out, err := newMessage(rt.rpc.Output())
+	if err != nil {
+		g.writeError(w, r, status.New(codes.Internal, err.Error()))
+		return
+	}
+	// The caller's token is forwarded by common.UnaryClientMetadata
+	if err := g.conn.Invoke(r.Context(), rt.fullMethod, in.Interface(), out.Interface()); err != nil {
+		g.writeError(w, r, status.Convert(err))
+		return
+	}
+	resp := out
+	if rt.responseBody != "" {
+		fd := out.Descriptor().Fields().ByName(protoreflect.Name(rt.responseBody))
+		if fd == nil || fd.Kind() != protoreflect.MessageKind || fd.IsList() || fd.IsMap() {
+			g.writeError(w, r, status.Newf(codes.Internal, "bad response_body %q", rt.responseBody))
+			return
+		}
+		resp = out.Get(fd).Message()
+	}
+	g.write(w, r, http.StatusOK, resp.Interface())
+}
+
+// replaceAll sets the update_mask of a PUT to "*", if the request has one and
+// the query didn't set it, so the whole resource is replaced rather than the
+// fields in the body
+func replaceAll(in protoreflect.Message) {
+	fd := in.Descriptor().Fields().ByName("update_mask")
+	if fd == nil || fd.Message() == nil || fd.Message().FullName() != "google.protobuf.FieldMask" || in.Has(fd) {
+		return
+	}
+	mask := in.Mutable(fd).Message()
+	paths := mask.Mutable(mask.Descriptor().Fields().ByName("paths")).List()
+	paths.Append(protoreflect.ValueOfString("*"))
+}
+
+// newMessage makes an empty message of the generated type for the descriptor
+func newMessage(md protoreflect.MessageDescriptor) (protoreflect.Message, error) {
+	mt, err := protoregistry.GlobalTypes.FindMessageByName(md.FullName())
+	if err != nil {
+		return nil, fmt.Errorf("no type for %s: %w", md.FullName(), err)
+	}
+	return mt.New(), nil
+}
+
+// readBody reads the JSON body into the field of the request named by body,
+// "*" is the whole request and "" means there is no body.  A body larger than
+// maxBodyBytes is an error.
+func readBody(w http.ResponseWriter, r *http.Request, in protoreflect.Message, body string) error {
+	if body == "" {
+		return nil
+	}
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil || len(b) == 0 {
+		return err
+	}
+	m := in
+	if body != "*" {
+		fd := in.Descriptor().Fields().ByName(protoreflect.Name(body))
+		if fd == nil || fd.Kind() != protoreflect.MessageKind || fd.IsList() || fd.IsMap() {
+			return fmt.Errorf("body field %q is not a message", body)
+		}
+		m = in.Mutable(fd).Message()
+	}
+	return protojson.Unmarshal(b, m.Interface())
+}
+
+// setField sets the field given by a dotted path, e.g. "book.id", from strings
+// in a path or query.  A field can be named by its proto or JSON name.
+func setField(m protoreflect.Message, path string, values []string) error {
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		fields := m.Descriptor().Fields()
+		fd := fields.ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = fields.ByJSONName(name)
+		}
+		if fd == nil {
+			return fmt.Errorf("%s has no field %q", m.Descriptor().FullName(), path)
+		}
+		if i < len(names)-1 {
+			if fd.Kind() != protoreflect.MessageKind || fd.IsList() || fd.IsMap() {
+				return fmt.Errorf("field %q is not a message", name)
+			}
+			m = m.Mutable(fd).Message()
+			continue
+		}
+		if fd.Kind() == protoreflect.MessageKind && fd.Message().FullName() == "google.protobuf.FieldMask" {
+			// A field mask is written as a comma separated list of paths, which
+			// are kept as they are rather than changed from JSON names like protojson
+			mask := m.Mutable(fd).Message()
+			paths := mask.Mutable(mask.Descriptor().Fields().ByName("paths")).List()
+			for _, v := range values {
+				for _, p := range strings.Split(v, ",") {
+					paths.Append(protoreflect.ValueOfString(strings.TrimSpace(p)))
+				}
+			}
+			return nil
+		}
+		if fd.IsMap() || (!fd.IsList() && len(values) != 1) {
+			return fmt.Errorf("field %q can't be set from %q", path, values)
+		}
+		for _, v := range values {
+			pv, err := scalarValue(fd, v)
+			if err != nil {
+				return fmt.Errorf("field %q: %w", path, err)
+			}
+			if fd.IsList() {
+				m.Mutable(fd).List().Append(pv)
+			} else {
+				m.Set(fd, pv)
+			}
+		}
+	}
+	return nil
+}
+
+// scalarValue parses the string form of a scalar field
+func scalarValue(fd protoreflect.FieldDescriptor, s string) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(s), nil
+	case protoreflect.BytesKind:
+		b, err := base64.URLEncoding.DecodeString(s)
+		return protoreflect.ValueOfBytes(b), err
+	case protoreflect.BoolKind:
+		b, err := strconv.ParseBool(s)
+		return protoreflect.ValueOfBool(b), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		n, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfInt32(int32(n)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		n, err := strconv.ParseInt(s, 10, 64)
+		return protoreflect.ValueOfInt64(n), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		n, err := strconv.ParseUint(s, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(n)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		n, err := strconv.ParseUint(s, 10, 64)
+		return protoreflect.ValueOfUint64(n), err
+	case protoreflect.FloatKind:
+		f, err := strconv.ParseFloat(s, 32)
+		return protoreflect.ValueOfFloat32(float32(f)), err
+	case protoreflect.DoubleKind:
+		f, err := strconv.ParseFloat(s, 64)
+		return protoreflect.ValueOfFloat64(f), err
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(s)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		n, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(n)), err
+	}
+	return protoreflect.Value{}, fmt.Errorf("can't be set from %q", s)
+}
+
+// writeError writes the status as JSON with the HTTP status for its code
+func (g *gateway) writeError(w http.ResponseWriter, r *http.Request, st *status.Status) {
+	writeStatus(w, r, st)
+}
+
+func (g *gateway) write(w http.ResponseWriter, r *http.Request, code int, m proto.Message) {
+	writeJSON(w, r, code, m)
+}
+
+// writeStatus writes the status as JSON with the HTTP status for its code, as
+// the gateway returns errors
+func writeStatus(w http.ResponseWriter, r *http.Request, st *status.Status) {
+	writeJSON(w, r, common.HTTPStatusFromCode(st.Code()), st.Proto())
+}
+
+func writeJSON(w http.ResponseWriter, r *http.Request, code int, m proto.Message) {
+	b, err := protojson.Marshal(m)
+	if err != nil {
+		log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+		log.Errorf("gateway: could not marshal %T: %v", m, err)
+		code = http.StatusInternalServerError
+		b = []byte(`{"code":13,"message":"could not marshal the response"}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
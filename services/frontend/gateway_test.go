@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	pb "frontend/pb/pb_book_v1"
+	"lib/common"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/empty"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/genproto/protobuf/field_mask"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeBooks records the last request and answers with book or err
+type fakeBooks struct {
+	pb.UnimplementedBookServiceServer
+	last proto.Message
+	auth []string // The authorization metadata of the last CreateBook
+	book *pb.Book
+	err  error
+}
+
+func (f *fakeBooks) CreateBook(ctx context.Context, req *pb.CreateBookRequest) (*pb.Book, error) {
+	f.last = req
+	md, _ := metadata.FromIncomingContext(ctx)
+	f.auth = md.Get(common.AuthorizationKey)
+	return f.book, f.err
+}
+
+func (f *fakeBooks) GetBook(_ context.Context, req *pb.GetBookRequest) (*pb.Book, error) {
+	f.last = req
+	return f.book, f.err
+}
+
+func (f *fakeBooks) ListBooks(_ context.Context, req *pb.ListBooksRequest) (*pb.ListBooksResponse, error) {
+	f.last = req
+	return &pb.ListBooksResponse{Books: []*pb.Book{f.book}}, f.err
+}
+
+func (f *fakeBooks) UpdateBook(_ context.Context, req *pb.UpdateBookRequest) (*pb.Book, error) {
+	f.last = req
+	return f.book, f.err
+}
+
+func (f *fakeBooks) DeleteBook(_ context.Context, req *pb.DeleteBookRequest) (*empty.Empty, error) {
+	f.last = req
+	return &empty.Empty{}, f.err
+}
+
+// newTestGateway serves the fake book service over an in-memory connection
+func newTestGateway(t *testing.T, books *fakeBooks) *gateway {
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	pb.RegisterBookServiceServer(s, books)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	conn, err := grpc.Dial("bufconn", grpc.WithInsecure(), grpc.WithChainUnaryInterceptor(common.UnaryClientMetadata),
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	gw, err := newGateway(conn, pb.File_book_v1_proto.Services().ByName("BookService"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gw
+}
+
+func TestParseTemplate(t *testing.T) {
+	for _, test := range []struct {
+		tmpl  string
+		parts []part
+		verb  string
+	}{
+		{"/v1/books", []part{{match: "v1"}, {match: "books"}}, ""},
+		{"/v1/{id=books/*}", []part{{match: "v1"}, {match: "books", field: "id"}, {match: "*", field: "id"}}, ""},
+		{"/v1/{book.id}:cancel", []part{{match: "v1"}, {match: "*", field: "book.id"}}, "cancel"},
+		{"/v1/{name=shelves/*/books/**}", []part{{match: "v1"}, {match: "shelves", field: "name"}, {match: "*", field: "name"},
+			{match: "books", field: "name"}, {match: "**", field: "name"}}, ""},
+	} {
+		parts, verb, err := parseTemplate(test.tmpl)
+		if err != nil || !reflect.DeepEqual(parts, test.parts) || verb != test.verb {
+			t.Errorf("parseTemplate(%q) = %v, %q, %v, want %v, %q", test.tmpl, parts, verb, err, test.parts, test.verb)
+		}
+	}
+	for _, tmpl := range []string{"v1/books", "/v1/{id=books/*"} {
+		if _, _, err := parseTemplate(tmpl); err == nil {
+			t.Errorf("parseTemplate(%q) succeeded, want an error", tmpl)
+		}
+	}
+}
+
+func TestRouteMatch(t *testing.T) {
+	for _, test := range []struct {
+		tmpl string
+		path string
+		vars map[string]string // nil if it doesn't match
+	}{
+		{"/v1/{id=books/*}", "v1/books/42", map[string]string{"id": "books/42"}},
+		{"/v1/{id=books/*}", "v1/books", nil},
+		{"/v1/{id=books/*}", "v1/books/42/pages", nil},
+		{"/v1/{id=books/*}", "v1/shelves/42", nil},
+		{"/v1/{name=shelves/*/books/**}", "v1/shelves/1/books/2/3", map[string]string{"name": "shelves/1/books/2/3"}},
+		{"/v1/{id=books/*}:cancel", "v1/books/42:cancel", map[string]string{"id": "books/42"}},
+		{"/v1/{id=books/*}:cancel", "v1/books/42", nil},
+	} {
+		parts, verb, err := parseTemplate(test.tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rt := &route{parts: parts, verb: verb}
+		vars, ok := rt.match(strings.Split(test.path, "/"))
+		if ok != (test.vars != nil) || (ok && !reflect.DeepEqual(vars, test.vars)) {
+			t.Errorf("%s matching %s = %v, %v, want %v", test.tmpl, test.path, vars, ok, test.vars)
+		}
+	}
+}
+
+func TestGatewayRequests(t *testing.T) {
+	books := &fakeBooks{book: &pb.Book{Id: "books/42", Title: "Emma"}}
+	gw := newTestGateway(t, books)
+	for _, test := range []struct {
+		method, target, body string
+		want                 proto.Message
+	}{
+		{http.MethodGet, "/v1/books/42", "", &pb.GetBookRequest{Id: "books/42"}},
+		{http.MethodGet, "/v1/books?pageSize=5&page_token=abc&filter=title%3A%22map%22", "",
+			&pb.ListBooksRequest{PageSize: 5, PageToken: "abc", Filter: `title:"map"`}},
+		{http.MethodPatch, "/v1/books/42?updateMask=title,%20publishedDate", `{"title":"Emma","publishedDate":"1815"}`,
+			&pb.UpdateBookRequest{Id: "books/42", Book: &pb.Book{Title: "Emma", PublishedDate: "1815"},
+				UpdateMask: &field_mask.FieldMask{Paths: []string{"title", "publishedDate"}}}},
+		{http.MethodDelete, "/v1/books/42?etag=e1", "", &pb.DeleteBookRequest{Id: "books/42", Etag: "e1"}},
+		{http.MethodPut, "/v1/books/42", `{"title":"Emma"}`, &pb.UpdateBookRequest{Id: "books/42", Book: &pb.Book{Title: "Emma"},
+			UpdateMask: &field_mask.FieldMask{Paths: []string{"*"}}}},
+		{http.MethodPut, "/v1/books/42?updateMask=title", `{"title":"Emma"}`, &pb.UpdateBookRequest{Id: "books/42",
+			Book: &pb.Book{Title: "Emma"}, UpdateMask: &field_mask.FieldMask{Paths: []string{"title"}}}},
+	} {
+		w := httptest.NewRecorder()
+		gw.ServeHTTP(w, httptest.NewRequest(test.method, test.target, strings.NewReader(test.body)))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s %s = %d %s, want 200", test.method, test.target, w.Code, w.Body)
+			continue
+		}
+		if !proto.Equal(books.last, test.want) {
+			t.Errorf("%s %s called with %v, want %v", test.method, test.target, books.last, test.want)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s %s Content-Type = %q, want application/json", test.method, test.target, ct)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	gw.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/books/42", nil))
+	var got pb.Book
+	if err := protojson.Unmarshal(w.Body.Bytes(), &got); err != nil || !proto.Equal(&got, books.book) {
+		t.Errorf("GET /v1/books/42 = %s, %v, want %v", w.Body, err, books.book)
+	}
+}
+
+func TestGatewayErrors(t *testing.T) {
+	for _, test := range []struct {
+		name                 string
+		err                  error // Returned by the service
+		method, target, body string
+		status               int
+		code                 codes.Code
+	}{
+		{"not found", status.Error(codes.NotFound, "no book"), http.MethodGet, "/v1/books/42", "", http.StatusNotFound, codes.NotFound},
+		{"stale etag", status.Error(codes.Aborted, "changed"), http.MethodDelete, "/v1/books/42", "", http.StatusConflict, codes.Aborted},
+		{"denied", status.Error(codes.PermissionDenied, "no"), http.MethodDelete, "/v1/books/42", "", http.StatusForbidden, codes.PermissionDenied},
+		{"invalid", status.Error(codes.InvalidArgument, "bad title"), http.MethodPatch, "/v1/books/42", `{}`, http.StatusBadRequest, codes.InvalidArgument},
+		{"unavailable", status.Error(codes.Unavailable, "down"), http.MethodGet, "/v1/books", "", http.StatusServiceUnavailable, codes.Unavailable},
+		{"no route", nil, http.MethodGet, "/v1/shelves/1", "", http.StatusNotFound, codes.NotFound},
+		{"wrong method", nil, http.MethodPost, "/v1/books/42", "", http.StatusMethodNotAllowed, codes.Unimplemented},
+		{"bad query", nil, http.MethodGet, "/v1/books?pageSize=many", "", http.StatusBadRequest, codes.InvalidArgument},
+		{"unknown query", nil, http.MethodGet, "/v1/books?colour=red", "", http.StatusBadRequest, codes.InvalidArgument},
+		{"bad body", nil, http.MethodPatch, "/v1/books/42", `{"title":`, http.StatusBadRequest, codes.InvalidArgument},
+		{"unknown field", nil, http.MethodPatch, "/v1/books/42", `{"colour":"red"}`, http.StatusBadRequest, codes.InvalidArgument},
+		{"large body", nil, http.MethodPatch, "/v1/books/42", `{"title":"` + strings.Repeat("a", maxBodyBytes) + `"}`, http.StatusBadRequest, codes.InvalidArgument},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			gw := newTestGateway(t, &fakeBooks{book: &pb.Book{}, err: test.err})
+			w := httptest.NewRecorder()
+			gw.ServeHTTP(w, httptest.NewRequest(test.method, test.target, strings.NewReader(test.body)))
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+			var st spb.Status
+			if err := protojson.Unmarshal(w.Body.Bytes(), &st); err != nil {
+				t.Fatalf("the body %s isn't a google.rpc.Status: %v", w.Body, err)
+			}
+			if codes.Code(st.Code) != test.code {
+				t.Errorf("code = %v, want %v", codes.Code(st.Code), test.code)
+			}
+		})
+	}
+
+	gw := newTestGateway(t, &fakeBooks{})
+	w := httptest.NewRecorder()
+	gw.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/books/42", nil))
+	if allow := w.Header().Get("Allow"); allow != "GET, DELETE, PATCH, PUT" {
+		t.Errorf("Allow = %q, want GET, DELETE, PATCH, PUT", allow)
+	}
+}
+
+func TestRequireEditorAPI(t *testing.T) {
+	l := &login{users: localUsers{}, editorRole: "editor"}
+	reader := &visitor{User: &User{Username: "bob"}}
+	editor := &visitor{User: &User{Username: "alice", Roles: []string{"editor"}}, CanEdit: true}
+	for _, test := range []struct {
+		method  string
+		visitor *visitor // nil if not logged in
+		status  int
+	}{
+		{http.MethodGet, nil, http.StatusOK},
+		{http.MethodHead, reader, http.StatusOK},
+		{http.MethodPost, nil, http.StatusUnauthorized},
+		{http.MethodPatch, nil, http.StatusUnauthorized},
+		{http.MethodDelete, nil, http.StatusUnauthorized},
+		{http.MethodDelete, reader, http.StatusForbidden},
+		{http.MethodPatch, editor, http.StatusOK},
+		{http.MethodDelete, editor, http.StatusOK},
+	} {
+		r := httptest.NewRequest(test.method, "/v1/books/42", nil)
+		if test.visitor != nil {
+			r = r.WithContext(context.WithValue(r.Context(), ctxKeyVisitor{}, test.visitor))
+		}
+		w := httptest.NewRecorder()
+		l.requireEditorAPI(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s by %v = %d, want %d", test.method, test.visitor, w.Code, test.status)
+		}
+	}
+}
+
+func TestGatewayBearerToken(t *testing.T) {
+	l := newTestLogin(t)
+	books := &fakeBooks{book: &pb.Book{Id: "1", Title: "Emma"}}
+	handler := l.ensureSession(forwardToken(l.requireEditorAPI(newTestGateway(t, books))))
+	for _, test := range []struct {
+		auth   string
+		status int
+		want   []string // The authorization the book service gets
+	}{
+		{"", http.StatusUnauthorized, nil},
+		{"Bearer the.jwt.token", http.StatusOK, []string{"Bearer the.jwt.token"}},
+		{"bearer the.jwt.token", http.StatusOK, []string{"Bearer the.jwt.token"}},
+		{"Basic YWxpY2U6c2VjcmV0", http.StatusUnauthorized, nil},
+	} {
+		books.auth = nil
+		r := httptest.NewRequest(http.MethodPost, "/v1/books", strings.NewReader(`{"title":"Emma"}`))
+		if test.auth != "" {
+			r.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("POST with %q = %d, want %d", test.auth, w.Code, test.status)
+		}
+		if !reflect.DeepEqual(books.auth, test.want) {
+			t.Errorf("POST with %q reached the book service with %q, want %q", test.auth, books.auth, test.want)
+		}
+	}
+}
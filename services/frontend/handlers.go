@@ -1,14 +1,23 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"html/template"
 	"lib/common"
 	"net/http"
+	"sort"
 	"time"
 )
 
+// healthzTimeout is how long /_healthz waits for the services to answer
+const healthzTimeout = 2 * time.Second
+
 var (
 	templates = template.Must(template.New("").
 		Funcs(template.FuncMap{
@@ -19,6 +28,7 @@ var (
 func (fe *frontendServer) logoutHandler(w http.ResponseWriter, r *http.Request) {
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	log.Debug("logging out")
+	fe.login.logout(r)
 	for _, c := range r.Cookies() {
 		c.Expires = time.Now().Add(-time.Hour * 24 * 365)
 		c.MaxAge = -1
@@ -32,28 +42,158 @@ func renderHTTPError(r *http.Request, w http.ResponseWriter, err error) {
 	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
 	log.Errorf("Rendering the error")
 	statusCode := http.StatusInternalServerError
+	if st, ok := grpcStatus(err); ok {
+		statusCode = common.HTTPStatusFromCode(st.Code())
+	}
 	log.WithField("error", err).Error("request error")
+	if statusCode == http.StatusServiceUnavailable || statusCode == http.StatusGatewayTimeout {
+		renderUnavailable(r, w, statusCode)
+		return
+	}
 	errMsg := fmt.Sprintf("%+v", err)
 
 	w.WriteHeader(statusCode)
 	templates.ExecuteTemplate(w, "error", map[string]interface{}{
 		"session_id":    sessionID(r),
-		"request_id":    r.Context().Value(ctxKeyRequestID{}),
+		"request_id":    common.RequestID(r.Context()),
+		"visitor":       visitorOf(r),
 		"error":         errMsg,
 		"status_code":   statusCode,
 		"status":        http.StatusText(statusCode),
-		"banner_color":  common.App.CanaryColour, // illustrates canary deployments
+		"banner_color":  bannerColour(), // illustrates canary deployments
 		"platform_url":  common.App.Platform.Url,
 		"platform_name": common.App.Platform.Provider,
 	})
 }
 
-func sessionID(r *http.Request) string {
-	v := r.Context().Value(ctxKeySessionID{})
-	if v != nil {
-		return v.(string)
+// unavailableRetryAfter is how long the degraded page asks the browser to
+// wait, about as long as the circuit breaker stays open
+const unavailableRetryAfter = "10"
+
+// renderUnavailable shows a degraded page rather than the error when a service
+// is down or too slow, the user can try again shortly.
+func renderUnavailable(r *http.Request, w http.ResponseWriter, statusCode int) {
+	retryURL := r.URL.String()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// A form post can't be repeated by a link, go back to the form
+		if retryURL = r.Referer(); retryURL == "" {
+			retryURL = "/books"
+		}
+	}
+	w.Header().Set("Retry-After", unavailableRetryAfter)
+	w.WriteHeader(statusCode)
+	templates.ExecuteTemplate(w, "unavailable", map[string]interface{}{
+		"session_id":    sessionID(r),
+		"request_id":    common.RequestID(r.Context()),
+		"visitor":       visitorOf(r),
+		"retry_url":     retryURL,
+		"banner_color":  bannerColour(), // illustrates canary deployments
+		"platform_url":  common.App.Platform.Url,
+		"platform_name": common.App.Platform.Provider,
+	})
+}
+
+// grpcStatus finds the status of a failed gRPC call in the chain of wrapped errors
+func grpcStatus(err error) (*status.Status, bool) {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if se, ok := err.(interface{ GRPCStatus() *status.Status }); ok {
+			return se.GRPCStatus(), true
+		}
+	}
+	return nil, false
+}
+
+// fieldViolations returns the description of each invalid field of a failed
+// gRPC request by field name, e.g. "book.title"
+func fieldViolations(err error) map[string]string {
+	st, ok := grpcStatus(err)
+	if !ok || st.Code() != codes.InvalidArgument {
+		return nil
+	}
+	violations := map[string]string{}
+	for _, d := range st.Details() {
+		if br, ok := d.(*errdetails.BadRequest); ok {
+			for _, v := range br.GetFieldViolations() {
+				violations[v.GetField()] = v.GetDescription()
+			}
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return violations
+}
+
+// isConflict reports if a gRPC request failed because the etag was out of date
+func isConflict(err error) bool {
+	st, ok := grpcStatus(err)
+	return ok && st.Code() == codes.Aborted
+}
+
+// healthz is ok if every gRPC service the frontend uses is SERVING, otherwise
+// it is 503 Service Unavailable.  Each service is listed with its health.
+func (fe *frontendServer) healthz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthzTimeout)
+	defer cancel()
+	errs := fe.config.CheckHealth(ctx)
+	names := make([]string, 0, len(errs))
+	statusCode := http.StatusOK
+	for name, err := range errs {
+		names = append(names, name)
+		if err != nil {
+			statusCode = http.StatusServiceUnavailable
+		}
+	}
+	sort.Strings(names)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(statusCode)
+	if statusCode == http.StatusOK {
+		fmt.Fprintln(w, "ok")
+	} else {
+		fmt.Fprintln(w, "unhealthy")
+	}
+	for _, name := range names {
+		if err := errs[name]; err != nil {
+			fmt.Fprintf(w, "%s: %v\n", name, err)
+		} else {
+			fmt.Fprintf(w, "%s: ok\n", name)
+		}
 	}
-	return ""
+}
+
+// serviceStatus is a row of the status page
+type serviceStatus struct {
+	common.ConnState
+	Health  error
+	Healthy bool
+}
+
+// status shows the state of the connection to each gRPC service and its health
+func (fe *frontendServer) status(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), healthzTimeout)
+	defer cancel()
+	health := fe.config.CheckHealth(ctx)
+	var services []serviceStatus
+	for _, s := range fe.config.ConnStates() {
+		err := health[s.Name]
+		services = append(services, serviceStatus{ConnState: s, Health: err, Healthy: err == nil})
+	}
+	if err := templates.ExecuteTemplate(w, "status", map[string]interface{}{
+		"session_id":    sessionID(r),
+		"request_id":    common.RequestID(r.Context()),
+		"visitor":       visitorOf(r),
+		"version":       version,
+		"services":      services,
+		"banner_color":  bannerColour(), // illustrates canary deployments
+		"platform_url":  common.App.Platform.Url,
+		"platform_name": common.App.Platform.Provider,
+	}); err != nil {
+		renderHTTPError(r, w, fmt.Errorf("could not render the status: %w", err))
+	}
+}
+
+func sessionID(r *http.Request) string {
+	return common.SessionID(r.Context())
 }
 
 func renderTime() string {
@@ -0,0 +1,136 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// HealthPath serves the health of a gRPC service on the admin port, for the
+// probes that can't call it over TLS, e.g. a Kubernetes httpGet probe
+const HealthPath = "/healthz"
+
+// Health is the grpc.health.v1.Health service of a gRPC server, it answers
+// Check and Watch for each service and for the server as a whole, which is
+// the empty service name.  Every service starts as NOT_SERVING, the server is
+// SERVING once all of its services are.
+type Health struct {
+	srv *health.Server
+
+	mu       sync.Mutex
+	serving  map[string]bool
+	shutdown bool
+}
+
+// RegisterHealth registers the health service on the gRPC server for the named
+// services, e.g. "book.v1.BookService"
+func RegisterHealth(s *grpc.Server, services ...string) *Health {
+	h := &Health{srv: health.NewServer(), serving: map[string]bool{}}
+	for _, service := range services {
+		h.serving[service] = false
+		h.srv.SetServingStatus(service, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	h.srv.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(s, h.srv)
+	return h
+}
+
+// Serving marks the service as ready, e.g. once its data is loaded
+func (h *Health) Serving(service string) {
+	h.set(service, true)
+}
+
+// NotServing marks the service as not able to take requests
+func (h *Health) NotServing(service string) {
+	h.set(service, false)
+}
+
+func (h *Health) set(service string, serving bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.shutdown {
+		return
+	}
+	h.serving[service] = serving
+	h.srv.SetServingStatus(service, servingStatus(serving))
+	all := true
+	for _, s := range h.serving {
+		all = all && s
+	}
+	h.srv.SetServingStatus("", servingStatus(all))
+}
+
+// Shutdown marks every service NOT_SERVING for good, so load balancers stop
+// sending requests while the server drains
+func (h *Health) Shutdown() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.shutdown = true
+	h.srv.Shutdown()
+}
+
+// Handler answers 200 while the server, or the service named by the service
+// parameter, is SERVING and 503 otherwise, with the status in the body
+func (h *Health) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, err := h.srv.Check(r.Context(), &healthpb.HealthCheckRequest{Service: r.FormValue("service")})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if resp.Status != healthpb.HealthCheckResponse_SERVING {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		fmt.Fprintln(w, resp.Status)
+	})
+}
+
+func servingStatus(serving bool) healthpb.HealthCheckResponse_ServingStatus {
+	if serving {
+		return healthpb.HealthCheckResponse_SERVING
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING
+}
+
+// CheckHealth asks the health service at the other end of each connection in
+// SvcConn if the server is SERVING, the error for a service is nil if it is.
+// A service isn't asked while it isn't connected or its circuit breaker is open.
+func (c *AppConfig) CheckHealth(ctx context.Context) map[string]error {
+	errs := make(map[string]error, len(c.SvcConn))
+	for _, s := range c.ConnStates() {
+		switch {
+		case s.BreakerOpen:
+			errs[s.Name] = errors.New("circuit breaker open")
+		case !s.Ready():
+			errs[s.Name] = fmt.Errorf("connection %s", s.State)
+		default:
+			errs[s.Name] = CheckConnHealth(ctx, c.SvcConn[s.Name])
+		}
+	}
+	return errs
+}
+
+// CheckConnHealth checks the health of the server at the other end of conn
+func CheckConnHealth(ctx context.Context, conn *grpc.ClientConn) error {
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	if err != nil {
+		return err
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return &HealthError{Status: resp.Status.String()}
+	}
+	return nil
+}
+
+// HealthError is the status of a server that isn't SERVING
+type HealthError struct {
+	Status string
+}
+
+func (e *HealthError) Error() string { return "health status " + e.Status }
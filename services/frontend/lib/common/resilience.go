@@ -0,0 +1,302 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+// ClientConfig is how a client calls a gRPC service, it is read from the
+// service's keys, e.g. book.call_timeout, by AppConfig.ClientConfig
+type ClientConfig struct {
+	DialTimeout time.Duration // dial_timeout, how long to wait for the connection
+	// dial_block, wait for the connection at startup rather than connect in the
+	// background, when the service doesn't have to be up first
+	Block               bool
+	ReconnectMaxBackoff time.Duration // reconnect_max_backoff, the longest wait between reconnects
+	CallTimeout         time.Duration // call_timeout, the deadline of calls that don't have one
+
+	// Retries, see https://github.com/grpc/proposal/blob/master/A6-client-retries.md
+	// gRPC 1.29 only retries if the GRPC_GO_RETRY environment variable is on.
+	RetryMaxAttempts       int           // retry_max_attempts, 1 or less is no retries
+	RetryInitialBackoff    time.Duration // retry_initial_backoff
+	RetryMaxBackoff        time.Duration // retry_max_backoff
+	RetryBackoffMultiplier float64       // retry_backoff_multiplier
+	RetryCodes             []string      // retry_codes, e.g. UNAVAILABLE,RESOURCE_EXHAUSTED
+
+	KeepaliveTime    time.Duration // keepalive_time, ping an idle connection this often
+	KeepaliveTimeout time.Duration // keepalive_timeout, close it if a ping isn't answered
+
+	// The circuit breaker opens after BreakerFailures UNAVAILABLE errors in a
+	// row, calls then fail straight away for BreakerReset
+	BreakerFailures int           // breaker_failures, 0 turns the breaker off
+	BreakerReset    time.Duration // breaker_reset
+}
+
+// DefaultClientConfig is used for the keys a service doesn't set
+var DefaultClientConfig = ClientConfig{
+	DialTimeout:            5 * time.Second,
+	Block:                  true,
+	ReconnectMaxBackoff:    10 * time.Second,
+	CallTimeout:            10 * time.Second,
+	RetryMaxAttempts:       3,
+	RetryInitialBackoff:    100 * time.Millisecond,
+	RetryMaxBackoff:        time.Second,
+	RetryBackoffMultiplier: 2,
+	RetryCodes:             []string{"UNAVAILABLE"},
+	KeepaliveTime:          30 * time.Second,
+	KeepaliveTimeout:       10 * time.Second,
+	BreakerFailures:        5,
+	BreakerReset:           10 * time.Second,
+}
+
+// ClientConfig reads the client config of a service, whose keys must have
+// been chosen with KeyPrefix
+func (c *AppConfig) ClientConfig() ClientConfig {
+	d := DefaultClientConfig
+	cc := ClientConfig{
+		DialTimeout:            c.GetDurationKey("dial_timeout", d.DialTimeout),
+		Block:                  d.Block,
+		ReconnectMaxBackoff:    c.GetDurationKey("reconnect_max_backoff", d.ReconnectMaxBackoff),
+		CallTimeout:            c.GetDurationKey("call_timeout", d.CallTimeout),
+		RetryMaxAttempts:       d.RetryMaxAttempts,
+		RetryInitialBackoff:    c.GetDurationKey("retry_initial_backoff", d.RetryInitialBackoff),
+		RetryMaxBackoff:        c.GetDurationKey("retry_max_backoff", d.RetryMaxBackoff),
+		RetryBackoffMultiplier: d.RetryBackoffMultiplier,
+		RetryCodes:             d.RetryCodes,
+		KeepaliveTime:          c.GetDurationKey("keepalive_time", d.KeepaliveTime),
+		KeepaliveTimeout:       c.GetDurationKey("keepalive_timeout", d.KeepaliveTimeout),
+		BreakerFailures:        d.BreakerFailures,
+		BreakerReset:           c.GetDurationKey("breaker_reset", d.BreakerReset),
+	}
+	if c.GetStringKey("dial_block") != "" {
+		cc.Block = c.GetBoolKey("dial_block")
+	}
+	if c.GetStringKey("retry_max_attempts") != "" {
+		cc.RetryMaxAttempts = c.GetIntKey("retry_max_attempts")
+	}
+	if m := c.GetFloatKey("retry_backoff_multiplier"); m > 0 {
+		cc.RetryBackoffMultiplier = m
+	}
+	if s := c.GetStringKey("retry_codes"); s != "" {
+		cc.RetryCodes = strings.Split(strings.ReplaceAll(s, " ", ""), ",")
+	}
+	if c.GetStringKey("breaker_failures") != "" {
+		cc.BreakerFailures = c.GetIntKey("breaker_failures")
+	}
+	return cc
+}
+
+// serviceConfig is the gRPC service config with the retry policy for the
+// methods of the gRPC services, e.g. book.v1.BookService
+func (cc ClientConfig) serviceConfig(grpcServices []string) (string, error) {
+	if cc.RetryMaxAttempts <= 1 || len(grpcServices) == 0 {
+		return "", nil
+	}
+	type name struct {
+		Service string `json:"service"`
+	}
+	names := make([]name, len(grpcServices))
+	for i, s := range grpcServices {
+		names[i] = name{s}
+	}
+	retryCodes := make([]string, len(cc.RetryCodes))
+	for i, code := range cc.RetryCodes {
+		retryCodes[i] = strings.ToUpper(code)
+	}
+	sc := map[string]interface{}{
+		"methodConfig": []interface{}{map[string]interface{}{
+			"name": names,
+			"retryPolicy": map[string]interface{}{
+				"maxAttempts":          cc.RetryMaxAttempts,
+				"initialBackoff":       seconds(cc.RetryInitialBackoff),
+				"maxBackoff":           seconds(cc.RetryMaxBackoff),
+				"backoffMultiplier":    cc.RetryBackoffMultiplier,
+				"retryableStatusCodes": retryCodes,
+			},
+		}},
+	}
+	b, err := json.Marshal(sc)
+	return string(b), err
+}
+
+// seconds is a duration as the service config wants it, e.g. 0.1s
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%gs", d.Seconds())
+}
+
+// dialOptions are the options that make calls with the client config, the
+// timeout of calls can change while the connection is in use
+func (cc ClientConfig) dialOptions(breaker *CircuitBreaker, timeout *callTimeout, grpcServices []string) ([]grpc.DialOption, error) {
+	reconnect := backoff.DefaultConfig
+	reconnect.MaxDelay = cc.ReconnectMaxBackoff
+	opts := []grpc.DialOption{
+		grpc.WithConnectParams(grpc.ConnectParams{Backoff: reconnect, MinConnectTimeout: cc.DialTimeout}),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                cc.KeepaliveTime,
+			Timeout:             cc.KeepaliveTimeout,
+			PermitWithoutStream: true,
+		}),
+		grpc.WithChainUnaryInterceptor(timeout.Unary, breaker.Unary),
+		grpc.WithChainStreamInterceptor(breaker.Stream),
+	}
+	if cc.Block {
+		opts = append(opts, grpc.WithBlock())
+	}
+	sc, err := cc.serviceConfig(grpcServices)
+	if err != nil {
+		return nil, err
+	}
+	if sc != "" {
+		opts = append(opts, grpc.WithDefaultServiceConfig(sc))
+	}
+	return opts, nil
+}
+
+// callTimeout gives calls without a deadline the CallTimeout, which changes
+// with the config
+type callTimeout struct {
+	timeout int64 // A time.Duration, atomic
+}
+
+// callTimeoutConfig is the key of the CallTimeout
+type callTimeoutConfig struct {
+	CallTimeout time.Duration `config:"call_timeout"`
+}
+
+func newCallTimeout(d time.Duration) *callTimeout {
+	return &callTimeout{timeout: int64(d)}
+}
+
+func (t *callTimeout) set(d time.Duration) {
+	atomic.StoreInt64(&t.timeout, int64(d))
+}
+
+func (t *callTimeout) get() time.Duration {
+	return time.Duration(atomic.LoadInt64(&t.timeout))
+}
+
+// Unary is the grpc.UnaryClientInterceptor
+func (t *callTimeout) Unary(ctx context.Context, method string, req, reply interface{}, conn *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if _, ok := ctx.Deadline(); !ok && t.get() > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.get())
+		defer cancel()
+	}
+	return invoker(ctx, method, req, reply, conn, opts...)
+}
+
+// CircuitBreaker is a client interceptor of calls and streams, once a service
+// has failed with UNAVAILABLE too many times in a row calls to it fail
+// straight away for a while rather than wait for it.  Then one call is let
+// through to see if it is back.
+type CircuitBreaker struct {
+	name     string
+	failures int
+	reset    time.Duration
+
+	mu        sync.Mutex
+	failed    int       // UNAVAILABLE errors in a row
+	openUntil time.Time // Calls fail until then
+}
+
+// NewCircuitBreaker makes a breaker for the named service that opens after
+// failures UNAVAILABLE errors in a row, for reset.  It never opens if failures
+// is 0.
+func NewCircuitBreaker(name string, failures int, reset time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{name: name, failures: failures, reset: reset}
+}
+
+// Unary is the grpc.UnaryClientInterceptor
+func (b *CircuitBreaker) Unary(ctx context.Context, method string, req, reply interface{}, conn *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if b.failures <= 0 {
+		return invoker(ctx, method, req, reply, conn, opts...)
+	}
+	if !b.allow() {
+		return status.Errorf(codes.Unavailable, "%s is unavailable, not calling it for a while", b.name)
+	}
+	err := invoker(ctx, method, req, reply, conn, opts...)
+	b.record(err)
+	return err
+}
+
+// Stream is the grpc.StreamClientInterceptor, a stream fails if it can't be
+// opened or it ends with UNAVAILABLE, and works once a message is received
+func (b *CircuitBreaker) Stream(ctx context.Context, desc *grpc.StreamDesc, conn *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if b.failures <= 0 {
+		return streamer(ctx, desc, conn, method, opts...)
+	}
+	if !b.allow() {
+		return nil, status.Errorf(codes.Unavailable, "%s is unavailable, not calling it for a while", b.name)
+	}
+	s, err := streamer(ctx, desc, conn, method, opts...)
+	if err != nil {
+		b.record(err)
+		return nil, err
+	}
+	return &breakerStream{ClientStream: s, breaker: b}, nil
+}
+
+// breakerStream records how a stream went with its breaker
+type breakerStream struct {
+	grpc.ClientStream
+	breaker  *CircuitBreaker
+	received sync.Once
+}
+
+func (s *breakerStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == nil || err == io.EOF {
+		s.received.Do(func() { s.breaker.record(nil) })
+	} else {
+		s.breaker.record(err)
+	}
+	return err
+}
+
+// allow says if a call can be made, when the breaker has been open for long
+// enough one call is allowed and it opens again unless that call works
+func (b *CircuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if now.Before(b.openUntil) {
+		return false
+	}
+	if b.failed >= b.failures {
+		b.openUntil = now.Add(b.reset) // Half open, let this call try
+	}
+	return true
+}
+
+func (b *CircuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if status.Code(err) != codes.Unavailable {
+		b.failed = 0
+		b.openUntil = time.Time{}
+		return
+	}
+	b.failed++
+	if b.failed >= b.failures {
+		b.openUntil = time.Now().Add(b.reset)
+	}
+}
+
+// Open says if calls are failing straight away
+func (b *CircuitBreaker) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().Before(b.openUntil)
+}
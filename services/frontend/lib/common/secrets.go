@@ -0,0 +1,273 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SecretPrefix starts a config value that is a reference to a secret, e.g.
+// page_token_secret: secret://k8s/page-token-secret, rather than the secret
+const SecretPrefix = "secret://"
+
+// Secret sources, what follows the SecretPrefix
+const (
+	SecretFile = "file" // secret://file/run/secrets/db, the contents of /run/secrets/db
+	SecretEnv  = "env"  // secret://env/DB_PASSWORD, an environment variable
+	SecretK8s  = "k8s"  // secret://k8s/db, the file db of secrets_dir, where a Kubernetes secret is mounted
+)
+
+const (
+	// DefaultSecretsDir is where a Kubernetes secret is mounted if secrets_dir
+	// isn't set
+	DefaultSecretsDir = "/etc/secrets"
+	// DefaultSecretsRefresh is how often the file secrets are read again, for
+	// when they are rotated, if secrets_refresh isn't set
+	DefaultSecretsRefresh = time.Minute
+)
+
+// redacted is logged and printed in place of a secret
+const redacted = "<redacted>"
+
+// IsSecretRef says if a config value is a reference to a secret
+func IsSecretRef(s string) bool {
+	return strings.HasPrefix(s, SecretPrefix)
+}
+
+// Secrets resolves references to secrets.  The values are cached, those of
+// files for the refresh interval, then they are read again so a rotated
+// secret is picked up.
+type Secrets struct {
+	dir     string
+	refresh time.Duration
+
+	mu    sync.Mutex
+	cache map[string]*cachedSecret // By reference
+}
+
+type cachedSecret struct {
+	value string
+	path  string // The file, empty for an environment variable
+	read  time.Time
+}
+
+// NewSecrets resolves references with the Kubernetes secrets mounted on dir,
+// and reads file secrets again after refresh
+func NewSecrets(dir string, refresh time.Duration) *Secrets {
+	if dir == "" {
+		dir = DefaultSecretsDir
+	}
+	if refresh <= 0 {
+		refresh = DefaultSecretsRefresh
+	}
+	return &Secrets{dir: dir, refresh: refresh, cache: make(map[string]*cachedSecret)}
+}
+
+// defaultSecrets resolve the references of an AppConfig that wasn't loaded
+// by LoadConfig
+var defaultSecrets = NewSecrets(DefaultSecretsDir, DefaultSecretsRefresh)
+
+// secretStore is the Secrets the config's references are resolved with
+func (c *AppConfig) secretStore() *Secrets {
+	if c.secrets == nil {
+		return defaultSecrets
+	}
+	return c.secrets
+}
+
+// Path is the file a reference to a file or Kubernetes secret names, for the
+// keys whose values are files, e.g. auth_key_file
+func (s *Secrets) Path(ref string) (string, error) {
+	source, name, err := parseSecretRef(ref)
+	if err != nil {
+		return "", err
+	}
+	switch source {
+	case SecretFile:
+		return "/" + name, nil
+	case SecretK8s:
+		if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+			return "", fmt.Errorf("%s isn't the name of a secret in %s", ref, s.dir)
+		}
+		return filepath.Join(s.dir, name), nil
+	}
+	return "", fmt.Errorf("%s isn't a file", ref)
+}
+
+// Resolve returns the value of the secret a reference names, with any
+// trailing newline of a file removed
+func (s *Secrets) Resolve(ref string) (string, error) {
+	s.mu.Lock()
+	cached, ok := s.cache[ref]
+	s.mu.Unlock()
+	if ok && (cached.path == "" || time.Since(cached.read) < s.refresh) {
+		return cached.value, nil
+	}
+
+	source, name, err := parseSecretRef(ref)
+	if err != nil {
+		return "", err
+	}
+	secret := &cachedSecret{read: time.Now()}
+	if source == SecretEnv {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("%s: the environment variable isn't set", ref)
+		}
+		secret.value = value
+	} else {
+		if secret.path, err = s.Path(ref); err != nil {
+			return "", err
+		}
+		if secret.value, err = readSecret(secret.path); err != nil {
+			return "", fmt.Errorf("%s: %w", ref, err)
+		}
+	}
+	s.mu.Lock()
+	s.cache[ref] = secret
+	s.mu.Unlock()
+	return secret.value, nil
+}
+
+func parseSecretRef(ref string) (source, name string, err error) {
+	if !IsSecretRef(ref) {
+		return "", "", fmt.Errorf("%q isn't a reference to a secret, e.g. %sk8s/name", ref, SecretPrefix)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(ref, SecretPrefix), "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("%s doesn't name a secret", ref)
+	}
+	switch parts[0] {
+	case SecretFile, SecretEnv, SecretK8s:
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf("%s: unknown source %q, use %s, %s or %s", ref, parts[0], SecretFile, SecretEnv, SecretK8s)
+}
+
+func readSecret(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// Refresh reads the cached file secrets again and returns the references of
+// those that were rotated, whose values changed
+func (s *Secrets) Refresh() []string {
+	s.mu.Lock()
+	refs := make([]string, 0, len(s.cache))
+	for ref, cached := range s.cache {
+		if cached.path != "" {
+			refs = append(refs, ref)
+		}
+	}
+	s.mu.Unlock()
+
+	var rotated []string
+	for _, ref := range refs {
+		s.mu.Lock()
+		cached := s.cache[ref]
+		s.mu.Unlock()
+		value, err := readSecret(cached.path)
+		if err != nil {
+			continue // Mid rotation perhaps, the cached value is still used
+		}
+		s.mu.Lock()
+		s.cache[ref] = &cachedSecret{value: value, path: cached.path, read: time.Now()}
+		s.mu.Unlock()
+		if value != cached.value {
+			rotated = append(rotated, ref)
+		}
+	}
+	sort.Strings(rotated)
+	return rotated
+}
+
+// Watch calls Refresh every refresh interval and onRotate with the references
+// of the secrets that were rotated, until the Closer is closed
+func (s *Secrets) Watch(onRotate func(refs []string)) Closer {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(s.refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if rotated := s.Refresh(); len(rotated) > 0 {
+					onRotate(rotated)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return CloserFunc(func(context.Context) error {
+		close(done)
+		<-stopped
+		return nil
+	})
+}
+
+// resolveValue resolves the value of a key if it is a reference to a secret,
+// to the file it names for the keys whose values are files, e.g. key_file
+func (c *AppConfig) resolveValue(key, value string) (string, error) {
+	if !IsSecretRef(value) {
+		return value, nil
+	}
+	if strings.HasSuffix(key, "_file") {
+		return c.secretStore().Path(value)
+	}
+	return c.secretStore().Resolve(value)
+}
+
+// secretKeyWords are in the names of the keys whose values are logged as
+// <redacted>, e.g. auth_key, the keys naming files, e.g. auth_key_file, aren't
+var secretKeyWords = []string{"secret", "password", "passwd", "token", "key", "credential", "dsn"}
+
+// isSecretKey says if the key's value shouldn't be logged
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	if strings.HasSuffix(key, "_file") {
+		return false
+	}
+	for _, word := range secretKeyWords {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactValue is the value of the key as it can be logged, a reference to a
+// secret is shown as it isn't the secret
+func redactValue(key string, value interface{}) interface{} {
+	if s, ok := value.(string); ok && (s == "" || IsSecretRef(s)) {
+		return value
+	}
+	if isSecretKey(key) && value != nil {
+		return redacted
+	}
+	return value
+}
+
+// redactSettings is a copy of viper's AllSettings with the secrets redacted
+func redactSettings(settings map[string]interface{}) map[string]interface{} {
+	copy := make(map[string]interface{}, len(settings))
+	for key, value := range settings {
+		if nested, ok := value.(map[string]interface{}); ok {
+			copy[key] = redactSettings(nested)
+		} else {
+			copy[key] = redactValue(key, value)
+		}
+	}
+	return copy
+}
@@ -0,0 +1,320 @@
+package common_test_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"lib/common"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func claims(sub string, roles ...string) *common.Claims {
+	return &common.Claims{Subject: sub, Roles: roles, ExpiresAt: time.Now().Add(time.Hour).Unix()}
+}
+
+func sign(t *testing.T, key interface{}, kid string, cl *common.Claims) string {
+	signer, err := common.NewTokenSigner(key, kid)
+	require.NoError(t, err)
+	token, err := signer.Sign(cl)
+	require.NoError(t, err)
+	return token
+}
+
+func verifier(t *testing.T, keys map[string]interface{}) *common.TokenVerifier {
+	v, err := common.NewTokenVerifier(keys, "", "")
+	require.NoError(t, err)
+	return v
+}
+
+func TestTokenAlgorithms(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		name        string
+		signer, pub interface{}
+	}{
+		{"HS256", testSecret, testSecret},
+		{"RS256", rsaKey, &rsaKey.PublicKey},
+		{"ES256", ecKey, &ecKey.PublicKey},
+	} {
+		token := sign(t, tc.signer, "", claims("alice", "editor"))
+		got, err := verifier(t, map[string]interface{}{"": tc.pub}).Verify(token)
+		if assert.NoError(t, err, tc.name) {
+			assert.Equal(t, "alice", got.Subject, tc.name)
+			assert.True(t, got.HasRole("editor"), tc.name)
+		}
+	}
+}
+
+func TestTokenRejected(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	v := verifier(t, map[string]interface{}{"": testSecret, "rsa": &rsaKey.PublicKey})
+	// RSA-PSS isn't one of the algorithms that are accepted
+	pss := jwt.NewWithClaims(jwt.SigningMethodPS256, jwt.MapClaims{"sub": "alice", "exp": time.Now().Add(time.Hour).Unix()})
+	pss.Header["kid"] = "rsa"
+	pssToken, err := pss.SignedString(rsaKey)
+	require.NoError(t, err)
+	expired := claims("alice")
+	expired.ExpiresAt = time.Now().Add(-time.Hour).Unix()
+	noExpiry := claims("alice")
+	noExpiry.ExpiresAt = 0
+	good := sign(t, testSecret, "", claims("alice"))
+	for name, token := range map[string]string{
+		"expired":        sign(t, testSecret, "", expired),
+		"no expiry":      sign(t, testSecret, "", noExpiry),
+		"other key":      sign(t, []byte("another secret that is long enough!"), "", claims("alice")),
+		"changed claims": good[:len(good)-2] + "xx",
+		"malformed":      "not.a-token",
+		"alg none":       base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"alice"}`)) + ".",
+		"PS256":          pssToken,
+	} {
+		_, err := v.Verify(token)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestTokenAlgorithmMustMatchKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	// An HS256 token whose secret is the RSA public key, which verifiers that
+	// trust the alg header accept
+	pub, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+	token := sign(t, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), "", claims("mallory", "editor"))
+	_, err = verifier(t, map[string]interface{}{"": &rsaKey.PublicKey}).Verify(token)
+	assert.Error(t, err)
+}
+
+func TestTokenIssuerAndAudience(t *testing.T) {
+	v, err := common.NewTokenVerifier(map[string]interface{}{"": testSecret}, "frontend", "book")
+	require.NoError(t, err)
+	cl := claims("alice")
+	cl.Issuer, cl.Audience = "frontend", common.Audience{"book", "route-guide"}
+	_, err = v.Verify(sign(t, testSecret, "", cl))
+	assert.NoError(t, err)
+	cl.Audience = common.Audience{"route-guide"}
+	_, err = v.Verify(sign(t, testSecret, "", cl))
+	assert.Error(t, err, "another audience")
+	cl.Issuer, cl.Audience = "someone", common.Audience{"book"}
+	_, err = v.Verify(sign(t, testSecret, "", cl))
+	assert.Error(t, err, "another issuer")
+}
+
+func TestJWKS(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks := fmt.Sprintf(`{"keys":[
+		{"kty":"EC","kid":"ec-1","use":"sig","crv":"P-256","x":"%s","y":"%s"},
+		{"kty":"oct","kid":"hmac-1","k":"%s"},
+		{"kty":"RSA","kid":"enc-1","use":"enc","n":"AQAB","e":"AQAB"}]}`,
+		b64(ecKey.X.Bytes()), b64(ecKey.Y.Bytes()), b64(testSecret))
+	keys, err := common.ParseJWKS([]byte(jwks))
+	require.NoError(t, err)
+	assert.Len(t, keys, 2, "the encryption key is left out")
+	v := verifier(t, keys)
+
+	_, err = v.Verify(sign(t, ecKey, "ec-1", claims("alice")))
+	assert.NoError(t, err)
+	_, err = v.Verify(sign(t, testSecret, "hmac-1", claims("alice")))
+	assert.NoError(t, err)
+	_, err = v.Verify(sign(t, ecKey, "hmac-1", claims("alice")))
+	assert.Error(t, err, "signed with another key than its kid")
+	_, err = v.Verify(sign(t, ecKey, "", claims("alice")))
+	assert.Error(t, err, "no kid with several keys")
+}
+
+func TestTokenVerifierFromConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	require.NoError(t, err)
+	keyFile := filepath.Join(dir, "signing.key")
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+
+	c := tlsConfig("book", nil)
+	v, err := c.TokenVerifier()
+	assert.NoError(t, err)
+	assert.Nil(t, v, "auth is off without a key")
+
+	// The signer's own key file verifies its tokens
+	c.V.Set("book.auth_key_file", keyFile)
+	v, err = c.TokenVerifier()
+	require.NoError(t, err)
+	signer, err := common.LoadTokenSigner(keyFile, "", "")
+	require.NoError(t, err)
+	token, err := signer.Sign(claims("alice"))
+	require.NoError(t, err)
+	_, err = v.Verify(token)
+	assert.NoError(t, err)
+}
+
+func TestKeyType(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pub, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	require.NoError(t, err)
+	pemFile := filepath.Join(dir, "auth.pem")
+	require.NoError(t, ioutil.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}), 0600))
+	secretFile := filepath.Join(dir, "auth.secret")
+	require.NoError(t, ioutil.WriteFile(secretFile, append(testSecret, '\n'), 0600))
+
+	for _, tc := range []struct {
+		file, keyType string
+		ok            bool
+	}{
+		{pemFile, "", true},
+		{pemFile, common.KeyTypePEM, true},
+		{pemFile, common.KeyTypeHMAC, false}, // A public key isn't a secret
+		{secretFile, "", false},              // Nor is a mistyped key
+		{secretFile, common.KeyTypePEM, false},
+		{secretFile, common.KeyTypeHMAC, true},
+		{secretFile, "jwk", false},
+	} {
+		c := tlsConfig("book", map[string]string{"auth_key_file": tc.file, "auth_key_type": tc.keyType})
+		v, err := c.TokenVerifier()
+		if !tc.ok {
+			assert.Error(t, err, "%s as %q", tc.file, tc.keyType)
+			continue
+		}
+		require.NoError(t, err, "%s as %q", tc.file, tc.keyType)
+		key := interface{}(rsaKey)
+		if tc.file == secretFile {
+			key = testSecret
+		}
+		_, err = v.Verify(sign(t, key, "", claims("alice")))
+		assert.NoError(t, err, "%s as %q", tc.file, tc.keyType)
+	}
+
+	_, err = common.LoadTokenSigner(secretFile, "", "")
+	assert.Error(t, err, "a secret without the hmac key type")
+	signer, err := common.LoadTokenSigner(secretFile, common.KeyTypeHMAC, "")
+	require.NoError(t, err)
+	token, err := signer.Sign(claims("alice"))
+	require.NoError(t, err)
+	_, err = verifier(t, map[string]interface{}{"": testSecret}).Verify(token)
+	assert.NoError(t, err)
+}
+
+// authorize calls method through the auth interceptor as the holder of token
+func authorize(auth *common.Auth, method, token string) (*common.Claims, error) {
+	ctx := context.Background()
+	if token != "" {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(common.AuthorizationKey, "Bearer "+token))
+	}
+	var caller *common.Claims
+	_, err := auth.Unary(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			caller = common.Caller(ctx)
+			return nil, nil
+		})
+	return caller, err
+}
+
+func TestAuthPolicy(t *testing.T) {
+	auth := common.NewAuth(verifier(t, map[string]interface{}{"": testSecret}), []common.MethodPolicy{
+		{Method: "/book.v1.BookService/DeleteBook", Roles: []string{"editor", "admin"}},
+		{Method: "/book.v1.BookService/GetBook", Public: true},
+		{Method: "/admin.v1.AdminService/*", Roles: []string{"admin"}},
+	})
+	editor := sign(t, testSecret, "", claims("alice", "editor"))
+	reader := sign(t, testSecret, "", claims("bob"))
+
+	for _, tc := range []struct {
+		method, token string
+		code          codes.Code
+	}{
+		{"/book.v1.BookService/DeleteBook", editor, codes.OK},
+		{"/book.v1.BookService/DeleteBook", reader, codes.PermissionDenied},
+		{"/book.v1.BookService/DeleteBook", "", codes.Unauthenticated},
+		{"/book.v1.BookService/DeleteBook", "garbage", codes.Unauthenticated},
+		{"/book.v1.BookService/ListBooks", reader, codes.OK},
+		{"/book.v1.BookService/ListBooks", "", codes.Unauthenticated},
+		{"/book.v1.BookService/GetBook", "", codes.OK},
+		{"/admin.v1.AdminService/Reset", editor, codes.PermissionDenied},
+		{"/grpc.health.v1.Health/Check", "", codes.OK},
+	} {
+		_, err := authorize(auth, tc.method, tc.token)
+		assert.Equal(t, tc.code, status.Code(err), "%s %s", tc.method, tc.token)
+	}
+
+	caller, err := authorize(auth, "/book.v1.BookService/GetBook", editor)
+	assert.NoError(t, err)
+	if assert.NotNil(t, caller, "a public method still knows the caller") {
+		assert.Equal(t, "alice", caller.Subject)
+	}
+}
+
+func TestAuthPolicyFromConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "secret")
+	require.NoError(t, ioutil.WriteFile(keyFile, append(testSecret, '\n'), 0600))
+
+	c := tlsConfig("book", map[string]string{"auth_key_file": keyFile, "auth_key_type": common.KeyTypeHMAC})
+	c.V.Set("book.auth_policy", []interface{}{
+		map[interface{}]interface{}{"method": "/book.v1.BookService/DeleteBook", "roles": []interface{}{"editor"}},
+	})
+	auth, err := c.Auth()
+	require.NoError(t, err)
+	_, err = authorize(auth, "/book.v1.BookService/DeleteBook", sign(t, testSecret, "", claims("bob")))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestCallerLogged(t *testing.T) {
+	c := tlsConfig("book", nil)
+	var buf bytes.Buffer
+	c.Log.Out = &buf
+	auth := common.NewAuth(verifier(t, map[string]interface{}{"": testSecret}), nil)
+	ctx := metadata.NewIncomingContext(context.Background(),
+		metadata.Pairs(common.AuthorizationKey, "Bearer "+sign(t, testSecret, "", claims("alice"))))
+	info := &grpc.UnaryServerInfo{FullMethod: "/book.v1.BookService/ListBooks"}
+	// The logging interceptor runs before auth, as it does in a Service
+	_, err := c.UnaryServerInterceptors()[0](ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return auth.Unary(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil })
+	})
+	require.NoError(t, err)
+	assert.Contains(t, buf.String(), "user=alice")
+}
+
+func TestTokenForwarded(t *testing.T) {
+	ctx := common.WithToken(context.Background(), "abc.def.ghi")
+	var md metadata.MD
+	_ = common.UnaryClientMetadata(ctx, "/test.Test/Call", nil, nil, nil,
+		func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+			md, _ = metadata.FromOutgoingContext(ctx)
+			return nil
+		})
+	assert.Equal(t, []string{"Bearer abc.def.ghi"}, md.Get(common.AuthorizationKey))
+}
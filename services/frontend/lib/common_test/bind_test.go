@@ -0,0 +1,129 @@
+package common_test_test
+
+import (
+	"errors"
+	"lib/common"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+type bindConfig struct {
+	Port      int           `config:"port" required:"true" min:"1" max:"65535"`
+	Driver    string        `config:"db_driver" default:"memory" oneof:"memory sqlite3"`
+	Timeout   time.Duration `config:"call_timeout" default:"5s" min:"1ms"`
+	Rate      float64       `config:"sample_rate" default:"1" min:"0" max:"1"`
+	Debug     bool          `config:"debug"`
+	Audiences []string      `config:"audience"`
+	Secret    string        `config:"secret" secret:"true"`
+	Unbound   string
+}
+
+func TestBind(t *testing.T) {
+	c := tlsConfig("book", map[string]string{"port": "8086", "db_driver": "sqlite3", "debug": "true", "secret": "s3cret"})
+	c.V.Set("book.audience", []interface{}{"book", "frontend"})
+	var cfg bindConfig
+	require.NoError(t, c.Bind("book", &cfg))
+	assert.Equal(t, bindConfig{
+		Port:      8086,
+		Driver:    "sqlite3",
+		Timeout:   5 * time.Second,
+		Rate:      1,
+		Debug:     true,
+		Audiences: []string{"book", "frontend"},
+		Secret:    "s3cret",
+	}, cfg)
+
+	assert.Equal(t, `book.port = 8086
+book.db_driver = sqlite3
+book.call_timeout = 5s
+book.sample_rate = 1
+book.debug = true
+book.audience = book,frontend
+book.secret = <redacted>
+`, common.FormatConfig("book", &cfg))
+}
+
+func TestBindEnv(t *testing.T) {
+	os.Setenv("BOOK_PORT", "9000")
+	os.Setenv("BOOK_AUDIENCE", "book, frontend")
+	defer os.Unsetenv("BOOK_PORT")
+	defer os.Unsetenv("BOOK_AUDIENCE")
+	c := tlsConfig("book", map[string]string{"port": "8086"})
+	var cfg bindConfig
+	require.NoError(t, c.Bind("book", &cfg))
+	assert.Equal(t, 9000, cfg.Port, "the environment takes priority")
+	assert.Equal(t, []string{"book", "frontend"}, cfg.Audiences)
+}
+
+func TestBindErrors(t *testing.T) {
+	c := tlsConfig("book", map[string]string{
+		"db_driver":    "mongo",
+		"call_timeout": "5",
+		"sample_rate":  "2",
+		"debug":        "maybe",
+	})
+	var cfg bindConfig
+	err := c.Bind("book", &cfg)
+	var invalid common.ConfigErrors
+	require.True(t, errors.As(err, &invalid), "%v", err)
+	assert.Equal(t, `5 config keys are invalid:
+	book.port is required
+	book.db_driver: "mongo" isn't one of memory, sqlite3
+	book.call_timeout: "5" isn't a duration, e.g. 1.5s
+	book.sample_rate: 2 is more than the max 1
+	book.debug: "maybe" isn't true or false`, err.Error())
+
+	c = tlsConfig("book", map[string]string{"port": "0"})
+	assert.EqualError(t, c.Bind("book", &cfg), "a config key is invalid:\n\tbook.port: 0 is less than the min 1")
+	assert.Error(t, c.Bind("book", cfg), "not a pointer")
+}
+
+// lookupConfig is a key that is set at every level in TestLookupOrder
+type lookupConfig struct {
+	Level string `config:"level"`
+}
+
+func TestLookupOrder(t *testing.T) {
+	for _, test := range []struct {
+		env, prefixed, top string
+		want               string
+	}{
+		{"env", "book", "top", "env"},
+		{"", "book", "top", "book"},
+		{"", "", "top", "top"},
+		{"", "", "", ""},
+	} {
+		c := tlsConfig("book", nil)
+		if test.env != "" {
+			os.Setenv("BOOK_LEVEL", test.env)
+		}
+		if test.prefixed != "" {
+			c.V.Set("book.level", test.prefixed)
+		}
+		if test.top != "" {
+			c.V.Set("level", test.top)
+		}
+		var cfg lookupConfig
+		require.NoError(t, c.Bind("book", &cfg))
+		assert.Equal(t, test.want, cfg.Level, "Bind with %+v", test)
+		assert.Equal(t, test.want, c.GetStringKey("level"), "GetStringKey with %+v", test)
+		os.Unsetenv("BOOK_LEVEL")
+	}
+}
+
+func TestConnGRPCKeepsKeyPrefix(t *testing.T) {
+	c := tlsConfig("frontend", map[string]string{"service_addr": "frontend:8080"})
+	c.V.Set("book.service_addr", "127.0.0.1:1")
+	c.V.Set("book.dial_block", "false")
+	c.SvcConn = map[string]*grpc.ClientConn{}
+	c.SvcBreaker = map[string]*common.CircuitBreaker{}
+	c.ConnGRPC("book")
+	defer c.SvcConn["book"].Close()
+	assert.Equal(t, "127.0.0.1:1", c.SvcConn["book"].Target(), "dialled with the keys of book")
+	assert.Equal(t, "frontend:8080", c.ServiceAddress(), "the keys are still those of frontend")
+}
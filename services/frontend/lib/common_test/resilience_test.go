@@ -0,0 +1,112 @@
+package common_test_test
+
+import (
+	"context"
+	"io"
+	"lib/common"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// invoker fails with the code and counts the calls
+func invoker(code codes.Code, calls *int) grpc.UnaryInvoker {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		*calls++
+		return status.Error(code, "test")
+	}
+}
+
+func TestCircuitBreakerOpens(t *testing.T) {
+	b := common.NewCircuitBreaker("test", 3, time.Hour)
+	calls := 0
+	for i := 0; i < 5; i++ {
+		err := b.Unary(context.Background(), "/test.Test/Call", nil, nil, nil, invoker(codes.Unavailable, &calls))
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	}
+	assert.Equal(t, 3, calls, "calls after the breaker opened")
+	assert.True(t, b.Open())
+}
+
+func TestCircuitBreakerOtherErrors(t *testing.T) {
+	b := common.NewCircuitBreaker("test", 2, time.Hour)
+	calls := 0
+	for i := 0; i < 4; i++ {
+		code := codes.Unavailable
+		if i%2 == 1 {
+			code = codes.NotFound // Not a failure of the service, starts the count again
+		}
+		_ = b.Unary(context.Background(), "/test.Test/Call", nil, nil, nil, invoker(code, &calls))
+	}
+	assert.Equal(t, 4, calls)
+	assert.False(t, b.Open())
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	b := common.NewCircuitBreaker("test", 1, 10*time.Millisecond)
+	calls := 0
+	_ = b.Unary(context.Background(), "/test.Test/Call", nil, nil, nil, invoker(codes.Unavailable, &calls))
+	assert.True(t, b.Open())
+	time.Sleep(20 * time.Millisecond)
+	err := b.Unary(context.Background(), "/test.Test/Call", nil, nil, nil, invoker(codes.OK, &calls))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, calls)
+	assert.False(t, b.Open())
+}
+
+// clientStream is a stream whose RecvMsg returns the errors in turn
+type clientStream struct {
+	grpc.ClientStream
+	errs []error
+}
+
+func (s *clientStream) RecvMsg(m interface{}) error {
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	return err
+}
+
+// streamer opens a stream that receives the errors, or fails with the code
+// if it isn't OK, and counts the streams
+func streamer(code codes.Code, calls *int, errs ...error) grpc.Streamer {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		*calls++
+		if code != codes.OK {
+			return nil, status.Error(code, "test")
+		}
+		return &clientStream{errs: errs}, nil
+	}
+}
+
+func TestCircuitBreakerStream(t *testing.T) {
+	desc := &grpc.StreamDesc{ServerStreams: true}
+	b := common.NewCircuitBreaker("test", 2, time.Hour)
+	calls := 0
+	_, err := b.Stream(context.Background(), desc, nil, "/test.Test/Stream", streamer(codes.Unavailable, &calls))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	s, err := b.Stream(context.Background(), desc, nil, "/test.Test/Stream", streamer(codes.OK, &calls, status.Error(codes.Unavailable, "test")))
+	assert.Nil(t, err)
+	assert.Equal(t, codes.Unavailable, status.Code(s.RecvMsg(nil)))
+	assert.True(t, b.Open(), "a stream that ends with UNAVAILABLE is a failure")
+	_, err = b.Stream(context.Background(), desc, nil, "/test.Test/Stream", streamer(codes.OK, &calls))
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	assert.Equal(t, 2, calls, "streams after the breaker opened")
+}
+
+func TestCircuitBreakerStreamWorks(t *testing.T) {
+	desc := &grpc.StreamDesc{ServerStreams: true}
+	b := common.NewCircuitBreaker("test", 2, time.Hour)
+	calls := 0
+	_, _ = b.Stream(context.Background(), desc, nil, "/test.Test/Stream", streamer(codes.Unavailable, &calls))
+	s, err := b.Stream(context.Background(), desc, nil, "/test.Test/Stream", streamer(codes.OK, &calls, nil, io.EOF))
+	assert.Nil(t, err)
+	assert.Nil(t, s.RecvMsg(nil))
+	assert.Equal(t, io.EOF, s.RecvMsg(nil))
+	_, _ = b.Stream(context.Background(), desc, nil, "/test.Test/Stream", streamer(codes.Unavailable, &calls))
+	assert.False(t, b.Open(), "a message received starts the count again")
+	assert.Equal(t, 3, calls)
+}
@@ -0,0 +1,164 @@
+package common_test_test
+
+import (
+	"context"
+	"io/ioutil"
+	"lib/common"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// certValidity is how long the test certificates are valid for
+const certValidity = time.Hour
+
+func newTestCA(t *testing.T) *common.DevCA {
+	ca, err := common.NewDevCA("test CA", certValidity)
+	require.NoError(t, err)
+	return ca
+}
+
+func writeCert(t *testing.T, ca *common.DevCA, dir, name string) {
+	err := ca.WriteCert(name, []string{"localhost", "127.0.0.1"}, certValidity,
+		filepath.Join(dir, name+".pem"), filepath.Join(dir, name+".key"))
+	require.NoError(t, err)
+}
+
+// tlsConfig is an AppConfig with the keys under the service name
+func tlsConfig(service string, keys map[string]string) *common.AppConfig {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	c := &common.AppConfig{V: viper.New(), Log: log}
+	c.KeyPrefix(service)
+	for k, v := range keys {
+		c.V.Set(service+"."+k, v)
+	}
+	return c
+}
+
+// serveTLS serves the health service with the server's credentials
+func serveTLS(t *testing.T, server *common.AppConfig) string {
+	creds, err := server.ServerCredentials()
+	require.NoError(t, err)
+	s := grpc.NewServer(grpc.Creds(creds))
+	common.RegisterHealth(s).Serving("")
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	return lis.Addr().String()
+}
+
+// callTLS makes a call to addr with the client's credentials
+func callTLS(t *testing.T, client *common.AppConfig, addr string) error {
+	creds, err := client.ClientCredentials(addr)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(creds), grpc.WithBlock(),
+		grpc.FailOnNonTempDialError(true))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	return err
+}
+
+// testPKI writes a CA and certificates for a server and two clients to dir
+func testPKI(t *testing.T) (dir string, ca *common.DevCA) {
+	dir, err := ioutil.TempDir("", "tls_test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	ca = newTestCA(t)
+	require.NoError(t, ca.WriteCA(filepath.Join(dir, "ca.pem"), ""))
+	for _, name := range []string{"server", "frontend", "other"} {
+		writeCert(t, ca, dir, name)
+	}
+	return dir, ca
+}
+
+func serverKeys(dir string) map[string]string {
+	return map[string]string{
+		"cert_file": filepath.Join(dir, "server.pem"),
+		"key_file":  filepath.Join(dir, "server.key"),
+		"ca_file":   filepath.Join(dir, "ca.pem"),
+	}
+}
+
+func clientKeys(dir, name string) map[string]string {
+	return map[string]string{
+		"cert_file": filepath.Join(dir, name+".pem"),
+		"key_file":  filepath.Join(dir, name+".key"),
+		"ca_file":   filepath.Join(dir, "ca.pem"),
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir, _ := testPKI(t)
+	addr := serveTLS(t, tlsConfig("server", serverKeys(dir)))
+
+	assert.NoError(t, callTLS(t, tlsConfig("server", clientKeys(dir, "frontend")), addr))
+	noCert := map[string]string{"ca_file": filepath.Join(dir, "ca.pem")}
+	assert.Error(t, callTLS(t, tlsConfig("server", noCert), addr), "a client without a certificate")
+}
+
+func TestAllowedClients(t *testing.T) {
+	dir, _ := testPKI(t)
+	keys := serverKeys(dir)
+	keys["allowed_clients"] = "frontend, routeguide"
+	addr := serveTLS(t, tlsConfig("server", keys))
+
+	assert.NoError(t, callTLS(t, tlsConfig("server", clientKeys(dir, "frontend")), addr))
+	assert.Error(t, callTLS(t, tlsConfig("server", clientKeys(dir, "other")), addr))
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir, _ := testPKI(t)
+	addr := serveTLS(t, tlsConfig("server", serverKeys(dir)))
+	client := tlsConfig("server", clientKeys(dir, "frontend"))
+	require.NoError(t, callTLS(t, client, addr))
+
+	// The server's certificate is rotated to one from a CA the client doesn't
+	// trust, so new connections fail without a restart of the server
+	other := newTestCA(t)
+	writeCert(t, other, dir, "server")
+	assert.Error(t, callTLS(t, client, addr))
+
+	// Then the client's CA bundle is rotated too
+	require.NoError(t, other.WriteCA(filepath.Join(dir, "ca.pem"), ""))
+	writeCert(t, other, dir, "frontend")
+	assert.NoError(t, callTLS(t, client, addr))
+}
+
+func TestLoadDevCA(t *testing.T) {
+	dir, ca := testPKI(t)
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca.key")
+	require.NoError(t, ca.WriteCA(certFile, keyFile))
+	loaded, err := common.LoadDevCA(certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, ca.Cert.Raw, loaded.Cert.Raw)
+
+	_, err = common.LoadDevCA(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"))
+	assert.Error(t, err, "not a CA")
+}
+
+func TestDefaultCertFiles(t *testing.T) {
+	c := tlsConfig("book", nil)
+	assert.Equal(t, "", c.CertFile(), "not a service's config")
+	c.ServiceName = "frontend"
+	assert.Equal(t, filepath.Join(common.CertDir, "frontend.pem"), c.CertFile())
+	assert.Equal(t, filepath.Join(common.CertDir, "frontend.key"), c.KeyFile())
+	assert.Equal(t, filepath.Join(common.CertDir, "ca.pem"), c.CAFile())
+	c.V.Set("book.cert_file", "/etc/certs/frontend.pem")
+	assert.Equal(t, "/etc/certs/frontend.pem", c.CertFile())
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"lib/common"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v2"
+)
+
+// loginConfig are the frontend's login keys, the token_* ones are for the
+// token the services are called with
+type loginConfig struct {
+	UsersFile           string        `config:"users_file"` // Login is off if empty
+	CookieSecret        string        `config:"cookie_secret" secret:"true"`
+	CookieSecure        bool          `config:"cookie_secure"` // Secure cookies even if the request isn't TLS
+	SessionTTL          time.Duration `config:"session_ttl" default:"8h" min:"1m"`
+	EditorRole          string        `config:"editor_role" default:"editor"`
+	TokenSigningKeyFile string        `config:"token_signing_key_file"`
+	TokenSigningKeyType string        `config:"token_signing_key_type" default:"pem" oneof:"pem hmac"`
+	TokenIssuer         string        `config:"token_issuer" default:"frontend"`
+	TokenAudience       []string      `config:"token_audience"`
+}
+
+// errBadLogin doesn't say if it was the username or the password
+var errBadLogin = errors.New("invalid username or password")
+
+// User is who is logged in
+type User struct {
+	Username string
+	Name     string
+	Roles    []string
+}
+
+// HasRole reports if the user has the role
+func (u *User) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// usersFile is the users_file, e.g.
+//
+//	users:
+//	  - username: alice
+//	    name: Alice Smith
+//	    password_hash: $2a$10$...
+//	    roles: [editor]
+//
+// The hashes are bcrypt, htpasswd -nbB alice <password> makes one.
+type usersFile struct {
+	Users []struct {
+		Username     string   `yaml:"username"`
+		Name         string   `yaml:"name"`
+		PasswordHash string   `yaml:"password_hash"`
+		Roles        []string `yaml:"roles"`
+	} `yaml:"users"`
+}
+
+type localUser struct {
+	User
+	hash []byte
+}
+
+// localUsers are the users who can log in, by username
+type localUsers map[string]localUser
+
+// dummyHash is compared with the password of an unknown user so it takes as
+// long as a wrong password, which doesn't give away who has an account
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("not a password"), bcrypt.DefaultCost)
+
+func loadUsers(file string) (localUsers, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var f usersFile
+	if err := yaml.UnmarshalStrict(b, &f); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	users := localUsers{}
+	for _, u := range f.Users {
+		if u.Username == "" {
+			return nil, fmt.Errorf("%s: a user without a username", file)
+		}
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("%s: %s: password_hash: %w", file, u.Username, err)
+		}
+		if u.Name == "" {
+			u.Name = u.Username
+		}
+		users[u.Username] = localUser{
+			User: User{Username: u.Username, Name: u.Name, Roles: u.Roles},
+			hash: []byte(u.PasswordHash),
+		}
+	}
+	return users, nil
+}
+
+// authenticate returns the user if the password is theirs
+func (lu localUsers) authenticate(username, password string) (*User, error) {
+	u, ok := lu[username]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, errBadLogin
+	}
+	if err := bcrypt.CompareHashAndPassword(u.hash, []byte(password)); err != nil {
+		return nil, errBadLogin
+	}
+	user := u.User
+	return &user, nil
+}
+
+// login is the users, their sessions and the session cookie.  Without a
+// users_file nobody logs in and everyone can add, edit and delete books, as
+// the services decide who can do what.
+type login struct {
+	users      localUsers // nil if login is off
+	sessions   SessionStore
+	cookies    *cookieSigner
+	secure     bool // Secure cookies, e.g. behind a proxy that ends the TLS
+	ttl        time.Duration
+	editorRole string
+
+	// Mints the token the gRPC services are called with for the user, nil if
+	// the users' calls don't carry one
+	tokens   *common.TokenSigner
+	issuer   string
+	audience common.Audience
+
+	log *logrus.Logger
+}
+
+// newLogin sets up the login from its keys
+func newLogin(cfg *loginConfig, sessions SessionStore, log *logrus.Logger) (*login, error) {
+	cookies, err := newCookieSigner(cfg.CookieSecret)
+	if err != nil {
+		return nil, err
+	}
+	l := &login{
+		sessions:   sessions,
+		cookies:    cookies,
+		secure:     cfg.CookieSecure,
+		ttl:        cfg.SessionTTL,
+		editorRole: cfg.EditorRole,
+		issuer:     cfg.TokenIssuer,
+		audience:   cfg.TokenAudience,
+		log:        log,
+	}
+	if cfg.UsersFile != "" {
+		if l.users, err = loadUsers(cfg.UsersFile); err != nil {
+			return nil, err
+		}
+		log.Infof("Login is on with %d users from %s", len(l.users), cfg.UsersFile)
+	}
+	if cfg.TokenSigningKeyFile != "" {
+		if l.tokens, err = common.LoadTokenSigner(cfg.TokenSigningKeyFile, cfg.TokenSigningKeyType, ""); err != nil {
+			return nil, fmt.Errorf("token_signing_key_file: %w", err)
+		}
+	}
+	return l, nil
+}
+
+// enabled reports if users can log in
+func (l *login) enabled() bool {
+	return l.users != nil
+}
+
+// visitor is who is making the request, for the handlers and templates
+type visitor struct {
+	User     *User // nil if not logged in
+	CanEdit  bool  // Can add, edit and delete books
+	CanLogin bool  // Login is on and User isn't logged in
+}
+
+type ctxKeyVisitor struct{}
+
+// visitorOf returns who is making the request
+func visitorOf(r *http.Request) *visitor {
+	if v, ok := r.Context().Value(ctxKeyVisitor{}).(*visitor); ok {
+		return v
+	}
+	return &visitor{}
+}
+
+// setSessionCookie sends the session ID, signed, to the browser, only over
+// HTTPS if the request is or cookie_secure is on
+func (l *login) setSessionCookie(w http.ResponseWriter, r *http.Request, id string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookieSessionID,
+		Value:    l.cookies.sign(id),
+		Path:     "/",
+		MaxAge:   cookieMaxAge,
+		HttpOnly: true,
+		Secure:   l.secure || r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// ensureSession gives every browser a session ID, which is forwarded to the
+// gRPC services, and puts the visitor in the request's context.  The token of
+// a logged in user is forwarded too.
+func (l *login) ensureSession(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var sessionID string
+		if c, err := r.Cookie(cookieSessionID); err == nil {
+			sessionID, _ = l.cookies.verify(c.Value)
+		}
+		if sessionID == "" {
+			sessionID = newSessionID()
+			l.setSessionCookie(w, r, sessionID)
+		}
+		ctx := common.WithSessionID(r.Context(), sessionID)
+
+		v := &visitor{CanEdit: !l.enabled()}
+		if l.enabled() {
+			s, err := l.sessions.Get(sessionID)
+			if err != nil {
+				l.log.WithError(err).Warn("cannot get the session")
+			}
+			if s != nil && s.User != nil {
+				v.User = s.User
+				v.CanEdit = s.User.HasRole(l.editorRole)
+				if s.Token != "" {
+					ctx = common.WithToken(ctx, s.Token)
+				}
+			}
+			v.CanLogin = v.User == nil
+		}
+		ctx = context.WithValue(ctx, ctxKeyVisitor{}, v)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+func newSessionID() string {
+	u, _ := uuid.NewRandom()
+	return u.String()
+}
+
+// requireEditor only lets visitors who can edit books through, anyone else is
+// asked to log in, or refused if they have
+func (l *login) requireEditor(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := visitorOf(r)
+		switch {
+		case v.CanEdit:
+			next(w, r)
+		case v.User == nil:
+			back := r.URL.RequestURI()
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				// A form post can't be repeated by a redirect, go back to the form
+				back = ""
+				if u, err := url.Parse(r.Referer()); err == nil && u.Path != "" {
+					back = u.RequestURI()
+				}
+			}
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(safeNext(back)), http.StatusFound)
+		default:
+			renderHTTPError(r, w, status.Errorf(codes.PermissionDenied,
+				"%s can't change books, it needs the %s role", v.User.Username, l.editorRole))
+		}
+	}
+}
+
+// requireEditorAPI is requireEditor for the REST API, the methods that read
+// books are open to all and the rest need a visitor who can edit books, anyone
+// else gets the JSON error rather than the login page.  A request with a
+// bearer token, e.g. from a script, is left to the auth_policy of the book
+// service, which checks the token forwardToken passes on.
+func (l *login) requireEditorAPI(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		v := visitorOf(r)
+		switch {
+		case r.Method == http.MethodGet || r.Method == http.MethodHead || v.CanEdit || bearerToken(r) != "":
+			next.ServeHTTP(w, r)
+		case v.User == nil:
+			writeStatus(w, r, status.New(codes.Unauthenticated, "log in to change books"))
+		default:
+			writeStatus(w, r, status.Newf(codes.PermissionDenied,
+				"%s can't change books, it needs the %s role", v.User.Username, l.editorRole))
+		}
+	}
+}
+
+// loginPage shows the login form
+func (l *login) loginPage(w http.ResponseWriter, r *http.Request) {
+	l.renderLogin(w, r, http.StatusOK, "", safeNext(r.URL.Query().Get("next")))
+}
+
+func (l *login) renderLogin(w http.ResponseWriter, r *http.Request, statusCode int, username, next string) {
+	data := map[string]interface{}{
+		"session_id":    sessionID(r),
+		"request_id":    common.RequestID(r.Context()),
+		"visitor":       visitorOf(r),
+		"username":      username,
+		"next":          next,
+		"banner_color":  bannerColour(), // illustrates canary deployments
+		"platform_url":  common.App.Platform.Url,
+		"platform_name": common.App.Platform.Provider,
+	}
+	if statusCode == http.StatusUnauthorized {
+		data["error"] = "Invalid username or password"
+	}
+	w.WriteHeader(statusCode)
+	if err := templates.ExecuteTemplate(w, "login", data); err != nil {
+		l.log.WithError(err).Error("could not render the login page")
+	}
+}
+
+// loginHandler checks the username and password of the login form and starts
+// a new session for the user, under a new ID so that one the browser was given
+// before, perhaps by someone else, isn't logged in
+func (l *login) loginHandler(w http.ResponseWriter, r *http.Request) {
+	log := r.Context().Value(ctxKeyLog{}).(logrus.FieldLogger)
+	username, next := r.PostFormValue("username"), safeNext(r.PostFormValue("next"))
+	user, err := l.users.authenticate(username, r.PostFormValue("password"))
+	if err != nil {
+		log.WithField("username", username).Warn("failed login")
+		l.renderLogin(w, r, http.StatusUnauthorized, username, next)
+		return
+	}
+
+	s := &Session{ID: newSessionID(), User: user, Expires: time.Now().Add(l.ttl)}
+	if l.tokens != nil {
+		if s.Token, err = l.tokens.Sign(&common.Claims{
+			Subject:   user.Username,
+			Issuer:    l.issuer,
+			Audience:  l.audience,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: s.Expires.Unix(),
+			Name:      user.Name,
+			Roles:     user.Roles,
+		}); err != nil {
+			renderHTTPError(r, w, fmt.Errorf("could not make the token: %w", err))
+			return
+		}
+	}
+	if err := l.sessions.Save(s); err != nil {
+		renderHTTPError(r, w, fmt.Errorf("could not save the session: %w", err))
+		return
+	}
+	_ = l.sessions.Delete(sessionID(r))
+	l.setSessionCookie(w, r, s.ID)
+	log.WithField("username", username).Info("logged in")
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// logout ends the session
+func (l *login) logout(r *http.Request) {
+	if err := l.sessions.Delete(sessionID(r)); err != nil {
+		l.log.WithError(err).Warn("cannot delete the session")
+	}
+}
+
+// safeNext is where to go after logging in, only a path on this site so the
+// login page can't be used to send people elsewhere
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/books"
+	}
+	return next
+}
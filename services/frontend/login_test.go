@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// writeUsersFile writes a users_file of alice, an editor, and bob, a reader, whose
+// passwords are their names backwards
+func writeUsersFile(t *testing.T, cost int) string {
+	var b strings.Builder
+	b.WriteString("users:\n")
+	for _, u := range []struct{ username, password, roles string }{{"alice", "ecila", "[editor]"}, {"bob", "bob", "[]"}} {
+		hash, err := bcrypt.GenerateFromPassword([]byte(u.password), cost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.WriteString("  - username: " + u.username + "\n    password_hash: " + string(hash) + "\n    roles: " + u.roles + "\n")
+	}
+	return writeFile(t, b.String())
+}
+
+func writeFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "login_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	file := filepath.Join(dir, "users.yaml")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// newTestLogin is a login with the users of writeUsersFile
+func newTestLogin(t *testing.T) *login {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	l, err := newLogin(&loginConfig{UsersFile: writeUsersFile(t, bcrypt.MinCost), CookieSecret: "secret",
+		SessionTTL: time.Hour, EditorRole: "editor"}, newMemorySessionStore(), log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// withLog puts the request logger the handlers expect in the context
+func withLog(r *http.Request) *http.Request {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	return r.WithContext(context.WithValue(r.Context(), ctxKeyLog{}, logrus.FieldLogger(log)))
+}
+
+func TestLoadUsers(t *testing.T) {
+	users, err := loadUsers(writeUsersFile(t, bcrypt.MinCost))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := users["alice"].User, users["bob"].User
+	if len(users) != 2 || alice.Name != "alice" || !alice.HasRole("editor") || bob.HasRole("editor") {
+		t.Errorf("loadUsers = %v, want alice the editor and bob", users)
+	}
+	for name, content := range map[string]string{
+		"no username":   "users:\n  - password_hash: $2a$04$abc\n",
+		"not bcrypt":    "users:\n  - username: alice\n    password_hash: hunter2\n",
+		"unknown field": "users:\n  - username: alice\n    password: hunter2\n",
+	} {
+		if _, err := loadUsers(writeFile(t, content)); err == nil {
+			t.Errorf("%s: loadUsers succeeded, want an error", name)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	users, err := loadUsers(writeUsersFile(t, bcrypt.MinCost))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, err := users.authenticate("alice", "ecila"); err != nil || u.Username != "alice" {
+		t.Errorf("authenticate(alice) = %v, %v, want alice", u, err)
+	}
+	for _, test := range []struct{ username, password string }{{"alice", "alice"}, {"alice", ""}, {"carol", "lorac"}, {"", ""}} {
+		if u, err := users.authenticate(test.username, test.password); err != errBadLogin || u != nil {
+			t.Errorf("authenticate(%q, %q) = %v, %v, want %v", test.username, test.password, u, err, errBadLogin)
+		}
+	}
+}
+
+func TestDummyHash(t *testing.T) {
+	if cost, err := bcrypt.Cost(dummyHash); err != nil || cost != bcrypt.DefaultCost {
+		t.Fatalf("the dummy hash's cost is %d, %v, want %d like the users' hashes", cost, err, bcrypt.DefaultCost)
+	}
+	users, err := loadUsers(writeUsersFile(t, bcrypt.DefaultCost))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	users.authenticate("alice", "wrong")
+	wrongPassword := time.Since(start)
+	start = time.Now()
+	users.authenticate("carol", "wrong")
+	unknownUser := time.Since(start)
+	if unknownUser < wrongPassword/2 {
+		t.Errorf("an unknown user took %v and a wrong password %v, which gives away who has an account", unknownUser, wrongPassword)
+	}
+}
+
+func TestSafeNext(t *testing.T) {
+	for next, want := range map[string]string{
+		"/books/1":           "/books/1",
+		"/books?page=2":      "/books?page=2",
+		"":                   "/books",
+		"books":              "/books",
+		"//evil.example":     "/books",
+		"/\\evil.example":    "/books",
+		"https://evil.com/":  "/books",
+		"javascript:alert()": "/books",
+	} {
+		if got := safeNext(next); got != want {
+			t.Errorf("safeNext(%q) = %q, want %q", next, got, want)
+		}
+	}
+}
+
+func TestRequireEditor(t *testing.T) {
+	l := newTestLogin(t)
+	reader := &visitor{User: &User{Username: "bob"}}
+	editor := &visitor{User: &User{Username: "alice", Roles: []string{"editor"}}, CanEdit: true}
+	for _, test := range []struct {
+		method, target, referer string
+		visitor                 *visitor // nil if not logged in
+		status                  int
+		location                string
+	}{
+		{http.MethodGet, "/books/add", "", editor, http.StatusOK, ""},
+		{http.MethodPost, "/books/1", "", editor, http.StatusOK, ""},
+		{http.MethodGet, "/books/add", "", nil, http.StatusFound, "/login?next=" + url.QueryEscape("/books/add")},
+		{http.MethodPost, "/books/1", "http://shop/books/1/edit", nil, http.StatusFound, "/login?next=" + url.QueryEscape("/books/1/edit")},
+		{http.MethodPost, "/books/1", "http://evil.example//evil.example/", nil, http.StatusFound, "/login?next=" + url.QueryEscape("/books")},
+		{http.MethodGet, "/books/add", "", reader, http.StatusForbidden, ""},
+		{http.MethodPost, "/books/1:delete", "", reader, http.StatusForbidden, ""},
+	} {
+		r := withLog(httptest.NewRequest(test.method, test.target, nil))
+		r.Header.Set("Referer", test.referer)
+		if test.visitor != nil {
+			r = r.WithContext(context.WithValue(r.Context(), ctxKeyVisitor{}, test.visitor))
+		}
+		w := httptest.NewRecorder()
+		l.requireEditor(func(http.ResponseWriter, *http.Request) {})(w, r)
+		if w.Code != test.status || w.Header().Get("Location") != test.location {
+			t.Errorf("%s %s by %v = %d %s, want %d %s", test.method, test.target, test.visitor,
+				w.Code, w.Header().Get("Location"), test.status, test.location)
+		}
+	}
+}
+
+// sessionCookie is the session cookie the response sets, nil if it doesn't
+func sessionCookie(w *httptest.ResponseRecorder) *http.Cookie {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == cookieSessionID {
+			return c
+		}
+	}
+	return nil
+}
+
+// visitorWith is who ensureSession says is making a request with the cookie,
+// and the session cookie it sets, if any
+func visitorWith(l *login, cookie string) (*visitor, *http.Cookie) {
+	r := httptest.NewRequest(http.MethodGet, "/books", nil)
+	if cookie != "" {
+		r.AddCookie(&http.Cookie{Name: cookieSessionID, Value: cookie})
+	}
+	var v *visitor
+	w := httptest.NewRecorder()
+	l.ensureSession(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) { v = visitorOf(r) }))(w, r)
+	return v, sessionCookie(w)
+}
+
+func TestEnsureSession(t *testing.T) {
+	l := newTestLogin(t)
+	for _, s := range []*Session{
+		{ID: "alice-session", User: &User{Username: "alice", Roles: []string{"editor"}}, Expires: time.Now().Add(time.Hour)},
+		{ID: "bob-session", User: &User{Username: "bob"}, Expires: time.Now().Add(time.Hour)},
+		{ID: "expired", User: &User{Username: "alice", Roles: []string{"editor"}}, Expires: time.Now().Add(-time.Second)},
+	} {
+		if err := l.sessions.Save(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	forged := strings.Replace(l.cookies.sign("bob-session"), "bob", "alice", 1)
+	for _, test := range []struct {
+		name, cookie string
+		user         string // Who is logged in, empty if nobody
+		canEdit      bool
+		newCookie    bool
+	}{
+		{"editor", l.cookies.sign("alice-session"), "alice", true, false},
+		{"reader", l.cookies.sign("bob-session"), "bob", false, false},
+		{"expired", l.cookies.sign("expired"), "", false, false},
+		{"no cookie", "", "", false, true},
+		{"unsigned", "alice-session", "", false, true},
+		{"forged", forged, "", false, true},
+	} {
+		v, cookie := visitorWith(l, test.cookie)
+		user := ""
+		if v.User != nil {
+			user = v.User.Username
+		}
+		if user != test.user {
+			t.Errorf("%s: %q is logged in, want %q", test.name, user, test.user)
+		}
+		if v.CanEdit != test.canEdit || v.CanLogin != (test.user == "") {
+			t.Errorf("%s: CanEdit %v and CanLogin %v, want %v and %v", test.name, v.CanEdit, v.CanLogin, test.canEdit, test.user == "")
+		}
+		if (cookie != nil) != test.newCookie {
+			t.Errorf("%s: set the cookie %v, want a new one %v", test.name, cookie, test.newCookie)
+		}
+		if cookie != nil && (!cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Secure) {
+			t.Errorf("%s: the cookie %v isn't HttpOnly and SameSite=Lax or is Secure over HTTP", test.name, cookie)
+		}
+	}
+
+	l.users = nil
+	if v, _ := visitorWith(l, ""); !v.CanEdit || v.CanLogin {
+		t.Errorf("with login off CanEdit %v and CanLogin %v, want everyone to edit", v.CanEdit, v.CanLogin)
+	}
+}
+
+func TestSecureCookie(t *testing.T) {
+	l := newTestLogin(t)
+	for _, test := range []struct {
+		secure, https, want bool
+	}{
+		{false, false, false},
+		{false, true, true},
+		{true, false, true},
+	} {
+		l.secure = test.secure
+		target := "http://shop/books"
+		if test.https {
+			target = "https://shop/books"
+		}
+		w := httptest.NewRecorder()
+		l.setSessionCookie(w, httptest.NewRequest(http.MethodGet, target, nil), "id")
+		if c := sessionCookie(w); c == nil || c.Secure != test.want {
+			t.Errorf("cookie_secure %v over %s set %v, want Secure %v", test.secure, target, c, test.want)
+		}
+	}
+}
+
+func TestLoginHandler(t *testing.T) {
+	l := newTestLogin(t)
+	_, cookie := visitorWith(l, "")
+	before, _ := l.cookies.verify(cookie.Value)
+	if err := l.sessions.Save(&Session{ID: before, Expires: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		username, password, next string
+		status                   int
+		location                 string
+	}{
+		{"alice", "alice", "/books/1", http.StatusUnauthorized, ""},
+		{"carol", "lorac", "/books/1", http.StatusUnauthorized, ""},
+		{"alice", "ecila", "//evil.example", http.StatusFound, "/books"},
+		{"alice", "ecila", "/books/1", http.StatusFound, "/books/1"},
+	} {
+		form := url.Values{"username": {test.username}, "password": {test.password}, "next": {test.next}}
+		r := withLog(httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode())))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		l.ensureSession(http.HandlerFunc(l.loginHandler))(w, r)
+		if w.Code != test.status || w.Header().Get("Location") != test.location {
+			t.Errorf("logging in %s with %q = %d %s, want %d %s", test.username, test.password,
+				w.Code, w.Header().Get("Location"), test.status, test.location)
+		}
+		if w.Code != http.StatusFound {
+			continue
+		}
+		after := sessionCookie(w)
+		if after == nil || after.Value == cookie.Value {
+			t.Fatalf("logging in kept the session cookie %v, want a new session ID", after)
+		}
+		if v, _ := visitorWith(l, after.Value); v.User == nil || v.User.Username != "alice" || !v.CanEdit {
+			t.Errorf("the new session is of %v, want alice the editor", v.User)
+		}
+		if s, _ := l.sessions.Get(before); s != nil {
+			t.Errorf("the session from before logging in is still there")
+		}
+	}
+}
@@ -2,15 +2,14 @@ package main
 
 import (
 	"cloud.google.com/go/storage"
-	"flag"
+	pb "frontend/pb/pb_book_v1"
 	"fmt"
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
-	"go.opencensus.io/plugin/ochttp"
-	"go.opencensus.io/plugin/ochttp/propagation/b3"
 	"google.golang.org/grpc"
 	"lib/common"
 	"net/http"
+	"sync/atomic"
 	//"time"
 )
 
@@ -26,7 +25,20 @@ const (
 	cookieSessionID = cookiePrefix + "session-id"
 )
 
-type ctxKeySessionID struct{}
+// canary is the colour of the banner, which illustrates canary deployments,
+// from CANARY_COLOUR.  It changes with the config.
+var canary atomic.Value
+
+// canaryConfig is the key of the banner colour
+type canaryConfig struct {
+	Colour string `config:"canary_colour"`
+}
+
+// bannerColour is the colour of the banner on every page
+func bannerColour() string {
+	colour, _ := canary.Load().(string)
+	return colour
+}
 
 type frontendServer struct {
 	bookSvcConn *grpc.ClientConn
@@ -34,78 +46,93 @@ type frontendServer struct {
 	StorageBucket     *storage.BucketHandle
 	StorageBucketName string
 
-	log *logrus.Logger
+	login *login
+
+	log    *logrus.Logger
+	config *common.AppConfig
 }
 
 func main() {
-	//ctx := context.Background()
-	// Command line stuff
-	showversion := flag.Bool("version", false, "display version")
-	flag.Parse()
-	if *showversion {
-		fmt.Printf("Version %s\n", version)
-		return
-	}
-
-	// Load configuration & Service details
-	var c, err = common.LoadConfig(serviceName, "")
-	if err != nil {
-		fmt.Printf("Cannot load the configuration: %s", err)
-	}
-
-	// Create connections to the RPC services
-	c.ConnGRPC(svcBook)
-	svc := new(frontendServer)
-	svc.bookSvcConn = c.SvcConn[svcBook]
-	svc.log = c.Log
-	svc.registerHandlers(c)
-	svc.log.Debug("Connected to book service")
+	var cfg loginConfig
+	common.NewService(serviceName, version).
+		BindConfig(&cfg).
+		HandleHTTP(func(svc *common.Service) (http.Handler, error) {
+			c := &svc.Config
+			// Create connections to the RPC services
+			c.ConnGRPC(svcBook, string(pb.File_book_v1_proto.Services().ByName("BookService").FullName()))
+			fe := &frontendServer{bookSvcConn: c.SvcConn[svcBook], config: c, log: c.Log}
+			fe.log.Debug("Connected to book service")
+			canary.Store(c.CanaryColour)
+			err := c.OnConfigChange("", func(cfg *canaryConfig) {
+				canary.Store(cfg.Colour)
+				c.Log.Infof("The banner colour is now %q", cfg.Colour)
+			})
+			if err != nil {
+				return nil, err
+			}
+			if fe.login, err = newLogin(&cfg, newMemorySessionStore(), c.Log); err != nil {
+				return nil, fmt.Errorf("login: %w", err)
+			}
+			err = svc.OnConfigChange(func(cfg *cookieConfig) {
+				if fe.login.cookies.rotate(cfg.Secret) {
+					c.Log.Info("The cookie secret was rotated")
+				}
+			})
+			if err != nil {
+				return nil, err
+			}
+			return fe.registerHandlers(c)
+		}).
+		Run()
 }
 
-func (fe frontendServer) registerHandlers(c common.AppConfig) {
+// registerHandlers makes the handler of every page
+func (fe *frontendServer) registerHandlers(c *common.AppConfig) (http.Handler, error) {
 	// Use gorilla/mux for rich routing.
 	// See https://www.gorillatoolkit.org/pkg/mux.
 	r := mux.NewRouter()
 	r.StrictSlash(true) // Odd that this is true when now the strictness is false
+	r.Use(routeMetrics)
 	// Homepage redirects to /books
 	r.Handle("/", http.RedirectHandler("/books", http.StatusFound))
 
 	// GET books, HEAD is like GET but without the body returned
 	r.HandleFunc("/books", fe.listBook).Methods(http.MethodGet, http.MethodHead)
-	r.HandleFunc("/books/add", fe.addBook).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc("/books/add", fe.login.requireEditor(fe.addBook)).Methods(http.MethodGet, http.MethodHead)
 	r.HandleFunc("/books/templates", fe.bookTemplates).Methods(http.MethodGet, http.MethodHead)
 	r.HandleFunc("/books/{id:[0-9a-zA-Z_\\-]+}", fe.bookDetail).Methods(http.MethodGet, http.MethodHead)
-	r.HandleFunc("/books/{id:[0-9a-zA-Z_\\-]+}/edit", fe.editBook).Methods(http.MethodGet, http.MethodHead)
+	r.HandleFunc("/books/{id:[0-9a-zA-Z_\\-]+}/edit", fe.login.requireEditor(fe.editBook)).Methods(http.MethodGet, http.MethodHead)
 
 	// POST/PUT books
-	r.HandleFunc("/books/add", fe.createBook).Methods(http.MethodPost)
-	r.HandleFunc("/books/{id:[0-9a-zA-Z_\\-]+}", fe.updateBook).Methods(http.MethodPost, http.MethodPut)
-	r.HandleFunc("/books/{id:[0-9a-zA-Z_\\-]+}:delete", fe.deleteBook).Methods(http.MethodPost)
+	r.HandleFunc("/books/add", fe.login.requireEditor(fe.createBook)).Methods(http.MethodPost)
+	r.HandleFunc("/books/{id:[0-9a-zA-Z_\\-]+}", fe.login.requireEditor(fe.updateBook)).Methods(http.MethodPost, http.MethodPut)
+	r.HandleFunc("/books/{id:[0-9a-zA-Z_\\-]+}:delete", fe.login.requireEditor(fe.deleteBook)).Methods(http.MethodPost)
+
+	// REST/JSON API of the book service, from the google.api.http annotations
+	gw, err := newGateway(fe.bookSvcConn, pb.File_book_v1_proto.Services().ByName("BookService"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create the REST gateway: %w", err)
+	}
+	r.PathPrefix("/v1/").Handler(fe.login.requireEditorAPI(gw))
 
 	// Admin stuff
 	r.HandleFunc("/version", fe.version).Methods(http.MethodGet, http.MethodHead)
-	r.HandleFunc("/logout", fe.logoutHandler).Methods(http.MethodGet)
+	if fe.login.enabled() {
+		r.HandleFunc("/login", fe.login.loginPage).Methods(http.MethodGet, http.MethodHead)
+		r.HandleFunc("/login", fe.login.loginHandler).Methods(http.MethodPost)
+	}
+	// A POST so another site can't log people out with a link or an image
+	r.HandleFunc("/logout", fe.logoutHandler).Methods(http.MethodPost)
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static/"))))
 	r.HandleFunc("/robots.txt", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "User-agent: *\nDisallow: /") })
-	r.HandleFunc("/_healthz", func(w http.ResponseWriter, _ *http.Request) { fmt.Fprint(w, "ok") })
+	r.HandleFunc("/_healthz", fe.healthz)
+	r.HandleFunc("/_status", fe.status).Methods(http.MethodGet, http.MethodHead)
 
 	var handler http.Handler = r
+	handler = forwardToken(handler)                  // pass the caller's token on
 	handler = &logHandler{log: c.Log, next: handler} // add logging
-	handler = ensureSessionID(handler)               // add session ID
-	handler = &ochttp.Handler{                       // add opencensus instrumentation
-		Handler:     handler,
-		Propagation: &b3.HTTPFormat{}}
-
-	c.KeyPrefix("frontend")
-	addr := c.ListenAddress()
-	port := c.Port()
-	c.Log.Infof("starting server on %s:%v", addr, port)
-
-	c.KeyPrefix("frontend")
-	c.Log.Printf("Listening on http://%s:%v", common.GetLocalIP(), c.Port())
-	c.Log.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", c.Port()), handler))
-
-	//c.Log.Fatal(http.ListenAndServe(addr+":"+port, handler))
+	handler = fe.login.ensureSession(handler)        // add session ID and user
+	return handler, nil
 
 	//r.Methods("GET").Path("/logs").Handler(appHandler(fe.sendLog))
 	//r.Methods("GET").Path("/errors").Handler(appHandler(fe.sendError))
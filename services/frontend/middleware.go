@@ -16,15 +16,17 @@ package main
 
 import (
 	"context"
+	"lib/common"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 )
 
 type ctxKeyLog struct{}
-type ctxKeyRequestID struct{}
 
 type logHandler struct {
 	log  *logrus.Logger
@@ -56,7 +58,8 @@ func (r *responseRecorder) WriteHeader(statusCode int) {
 func (lh *logHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	requestID, _ := uuid.NewRandom()
-	ctx = context.WithValue(ctx, ctxKeyRequestID{}, requestID.String())
+	// The request ID and session ID are forwarded to the gRPC services
+	ctx = common.WithRequestID(ctx, requestID.String())
 
 	start := time.Now()
 	rr := &responseRecorder{w: w}
@@ -65,9 +68,12 @@ func (lh *logHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		"http.req.method": r.Method,
 		"http.req.id":     requestID.String(),
 	})
-	if v, ok := r.Context().Value(ctxKeySessionID{}).(string); ok {
+	if v := common.SessionID(ctx); v != "" {
 		log = log.WithField("session", v)
 	}
+	if u := visitorOf(r).User; u != nil {
+		log = log.WithField("user", u.Username)
+	}
 	log.Debug("request started")
 	defer func() {
 		log.WithFields(logrus.Fields{
@@ -81,25 +87,61 @@ func (lh *logHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	lh.next.ServeHTTP(rr, r)
 }
 
-func ensureSessionID(next http.Handler) http.HandlerFunc {
+// forwardToken passes the caller's token, a bearer token in the Authorization
+// header, on to the gRPC services, which check it against their auth_policy
+func forwardToken(next http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		var sessionID string
-		c, err := r.Cookie(cookieSessionID)
-		if err == http.ErrNoCookie {
-			u, _ := uuid.NewRandom()
-			sessionID = u.String()
-			http.SetCookie(w, &http.Cookie{
-				Name:   cookieSessionID,
-				Value:  sessionID,
-				MaxAge: cookieMaxAge,
-			})
-		} else if err != nil {
-			return
-		} else {
-			sessionID = c.Value
+		if token := bearerToken(r); token != "" {
+			r = r.WithContext(common.WithToken(r.Context(), token))
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// bearerToken is the token in the Authorization header, empty if there isn't one
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// routeMetrics names the request's route in the metrics by the path template
+// it matched, e.g. /books/{id}
+func routeMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tmpl, err := mux.CurrentRoute(r).GetPathTemplate(); err == nil {
+			common.SetRoute(r.Context(), stripPatterns(tmpl))
 		}
-		ctx := context.WithValue(r.Context(), ctxKeySessionID{}, sessionID)
-		r = r.WithContext(ctx)
 		next.ServeHTTP(w, r)
+	})
+}
+
+// stripPatterns drops the patterns of the variables in a path template,
+// /books/{id:[0-9]+} is /books/{id}
+func stripPatterns(tmpl string) string {
+	var b strings.Builder
+	depth := 0
+	skip := false
+	for _, c := range tmpl {
+		switch {
+		case c == '{':
+			depth++
+			if depth == 1 {
+				skip = false
+			}
+		case c == '}':
+			depth--
+			if depth == 0 {
+				skip = false
+			}
+		case c == ':' && depth == 1:
+			skip = true
+		}
+		if !skip {
+			b.WriteRune(c)
+		}
 	}
+	return b.String()
 }
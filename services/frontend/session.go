@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session is what the frontend keeps about a browser between requests, by
+// the session ID in its cookie
+type Session struct {
+	ID      string
+	User    *User     // Who logged in
+	Token   string    // The JWT the gRPC services are called with for the user, if any
+	Expires time.Time // When the user has to log in again
+}
+
+// SessionStore keeps the sessions of the logged in users.  The in-memory
+// store loses them on a restart and every replica of the frontend has its
+// own, a shared store, e.g. Redis, can be plugged in for more than one.
+type SessionStore interface {
+	// Get returns the session, or nil if there isn't one or it has expired
+	Get(id string) (*Session, error)
+	Save(s *Session) error
+	Delete(id string) error
+}
+
+// sweepInterval is how often the in-memory store drops expired sessions
+const sweepInterval = time.Minute
+
+type memorySessionStore struct {
+	mu        sync.Mutex
+	sessions  map[string]Session
+	lastSweep time.Time
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: map[string]Session{}, lastSweep: time.Now()}
+}
+
+func (m *memorySessionStore) Get(id string) (*Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, nil
+	}
+	if time.Now().After(s.Expires) {
+		delete(m.sessions, id)
+		return nil, nil
+	}
+	return &s, nil
+}
+
+func (m *memorySessionStore) Save(s *Session) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if now.Sub(m.lastSweep) > sweepInterval {
+		for id, s := range m.sessions {
+			if now.After(s.Expires) {
+				delete(m.sessions, id)
+			}
+		}
+		m.lastSweep = now
+	}
+	m.sessions[s.ID] = *s
+	return nil
+}
+
+func (m *memorySessionStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+// cookieSigner signs cookie values with HMAC-SHA256, <value>.<signature>, so
+// a browser can't make up a session ID
+type cookieSigner struct {
+	mu     sync.RWMutex
+	secret string // The secret the key was made from, empty for a random key
+	key    []byte
+	prev   []byte // The key before the secret was rotated, its cookies still verify
+}
+
+// cookieConfig is the key of the cookie secret, which can be rotated
+type cookieConfig struct {
+	Secret string `config:"cookie_secret" secret:"true"`
+}
+
+// newCookieSigner signs with the secret, or a random key if it is empty, which
+// logs everyone out on a restart
+func newCookieSigner(secret string) (*cookieSigner, error) {
+	key, err := cookieKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &cookieSigner{secret: secret, key: key}, nil
+}
+
+func cookieKey(secret string) ([]byte, error) {
+	if secret != "" {
+		return []byte(secret), nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// rotate signs cookies with a new secret, the cookies signed before still
+// verify until the next rotation so nobody is logged out.  It is false if the
+// secret is the same, or empty which keeps the key there is.
+func (c *cookieSigner) rotate(secret string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if secret == "" || secret == c.secret {
+		return false
+	}
+	c.secret, c.key, c.prev = secret, []byte(secret), c.key
+	return true
+}
+
+func mac(key []byte, value string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(value))
+	return h.Sum(nil)
+}
+
+func (c *cookieSigner) sign(value string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return value + "." + base64.RawURLEncoding.EncodeToString(mac(c.key, value))
+}
+
+// verify returns the value of a signed cookie, false if the signature is wrong
+func (c *cookieSigner) verify(signed string) (string, bool) {
+	i := strings.LastIndex(signed, ".")
+	if i < 0 {
+		return "", false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(signed[i+1:])
+	if err != nil {
+		return "", false
+	}
+	value := signed[:i]
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if !hmac.Equal(sig, mac(c.key, value)) && (c.prev == nil || !hmac.Equal(sig, mac(c.prev, value))) {
+		return "", false
+	}
+	return value, true
+}
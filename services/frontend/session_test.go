@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCookieRotation(t *testing.T) {
+	c, err := newCookieSigner("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := c.sign("session")
+	if !c.rotate("second") {
+		t.Fatal("rotate(second) = false, want true")
+	}
+	second := c.sign("session")
+	if first == second {
+		t.Fatal("the cookie is signed with the old secret after rotating it")
+	}
+	for _, signed := range []string{first, second} {
+		if v, ok := c.verify(signed); !ok || v != "session" {
+			t.Errorf("verify(%q) = %q, %v after one rotation, want session, true", signed, v, ok)
+		}
+	}
+	if !c.rotate("third") {
+		t.Fatal("rotate(third) = false, want true")
+	}
+	if _, ok := c.verify(first); ok {
+		t.Errorf("verify(%q) is still true two rotations later", first)
+	}
+	if c.rotate("third") || !verifies(c, second) {
+		t.Errorf("rotating to the same secret dropped the previous one")
+	}
+}
+
+func TestCookieReloadWithoutSecret(t *testing.T) {
+	for _, secret := range []string{"", "secret"} {
+		c, err := newCookieSigner(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed := c.sign("session")
+		// A reload, e.g. SIGHUP to change the log level, calls rotate with the
+		// secret there is, or none
+		for _, reload := range []string{secret, "", secret, ""} {
+			if c.rotate(reload) {
+				t.Errorf("rotate(%q) = true with the secret %q, want false", reload, secret)
+			}
+		}
+		if !verifies(c, signed) || c.sign("session") != signed {
+			t.Errorf("the cookie doesn't verify after reloads with the secret %q", secret)
+		}
+	}
+}
+
+func verifies(c *cookieSigner, signed string) bool {
+	_, ok := c.verify(signed)
+	return ok
+}
+
+func TestCookieTampering(t *testing.T) {
+	c, err := newCookieSigner("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := newCookieSigner("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := c.sign("session")
+	sig := signed[len("session."):]
+	for name, cookie := range map[string]string{
+		"another value":     "session2." + sig,
+		"another signature": "session." + strings.ToUpper(sig),
+		"truncated":         signed[:len(signed)-1],
+		"no signature":      "session",
+		"empty signature":   "session.",
+		"not base64":        "session.!!",
+		"another secret":    other.sign("session"),
+		"empty":             "",
+	} {
+		if v, ok := c.verify(cookie); ok {
+			t.Errorf("%s: verify(%q) = %q, true, want false", name, cookie, v)
+		}
+	}
+	if v, ok := c.verify(signed); !ok || v != "session" {
+		t.Errorf("verify(%q) = %q, %v, want session, true", signed, v, ok)
+	}
+}
@@ -0,0 +1,151 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DevCA is a certificate authority for development and tests, it issues the
+// certificates cmd/devcerts writes to each service's CertDir.  It is not
+// meant for production, where the certificates come from a real CA.
+type DevCA struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// NewDevCA makes a self-signed CA valid for validFor
+func NewDevCA(name string, validFor time.Duration) (*DevCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour), // Allow for clock skew
+		NotAfter:              time.Now().Add(validFor),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &DevCA{Cert: cert, Key: key}, nil
+}
+
+// LoadDevCA reads a CA written by WriteCA
+func LoadDevCA(certFile, keyFile string) (*DevCA, error) {
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok || !cert.IsCA {
+		return nil, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+	return &DevCA{Cert: cert, Key: key}, nil
+}
+
+// WriteCA writes the CA certificate, and its key if keyFile isn't empty
+func (ca *DevCA) WriteCA(certFile, keyFile string) error {
+	if err := writePEM(certFile, "CERTIFICATE", ca.Cert.Raw, 0644); err != nil {
+		return err
+	}
+	if keyFile == "" {
+		return nil
+	}
+	return writeKey(keyFile, ca.Key)
+}
+
+// WriteCert issues a certificate for name, valid for validFor, and writes it
+// and its key.  The certificate can be used by a server or a client.  name is
+// its common name, the identity AllowedClients checks, and a DNS SAN along
+// with the hosts, which may be IP addresses.
+func (ca *DevCA) WriteCert(name string, hosts []string, validFor time.Duration, certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := serialNumber()
+	if err != nil {
+		return err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validFor),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	seen := map[string]bool{}
+	for _, h := range append([]string{name}, hosts...) {
+		if h == "" || seen[h] {
+			continue
+		}
+		seen[h] = true
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, key.Public(), ca.Key)
+	if err != nil {
+		return err
+	}
+	// A server that reloads between the two writes keeps its old pair, as the
+	// new key doesn't match the old certificate
+	if err := writeKey(keyFile, key); err != nil {
+		return err
+	}
+	return writePEM(certFile, "CERTIFICATE", der, 0644)
+}
+
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func writeKey(file string, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	return writePEM(file, "PRIVATE KEY", der, 0600)
+}
+
+// writePEM writes the file, creating its directory
+func writePEM(file, kind string, der []byte, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), perm)
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"sort"
+	"sync"
+)
+
+// Features are the feature flags of a service, the names listed in its
+// features key, e.g. features: [bulk_import].  If the config is watched they
+// change with it, so a feature can be turned on or off without a restart.
+type Features struct {
+	mu sync.RWMutex
+	on map[string]bool
+}
+
+// featuresConfig is the features key
+type featuresConfig struct {
+	Names []string `config:"features"`
+}
+
+// NewFeatures turns the named features on
+func NewFeatures(names ...string) *Features {
+	f := &Features{}
+	f.set(names)
+	return f
+}
+
+// Enabled says if the feature is on
+func (f *Features) Enabled(name string) bool {
+	if f == nil {
+		return false
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.on[name]
+}
+
+// Names are the features that are on, sorted
+func (f *Features) Names() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	names := make([]string, 0, len(f.on))
+	for name := range f.on {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *Features) set(names []string) {
+	on := make(map[string]bool, len(names))
+	for _, name := range names {
+		on[name] = true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.on = on
+}
+
+// Features reads the features key of prefix and, if the config is watched,
+// keeps them up to date
+func (c *AppConfig) Features(prefix string) (*Features, error) {
+	var cfg featuresConfig
+	if err := c.Bind(prefix, &cfg); err != nil {
+		return nil, err
+	}
+	f := NewFeatures(cfg.Names...)
+	err := c.OnConfigChange(prefix, func(cfg *featuresConfig) {
+		f.set(cfg.Names)
+		c.Log.Infof("The features are now %v", f.Names())
+	})
+	return f, err
+}
@@ -0,0 +1,212 @@
+package common
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Metadata keys that follow a request through every service it reaches
+const (
+	RequestIDKey = "x-request-id" // The ID of the request to the frontend
+	SessionIDKey = "x-session-id" // The frontend session making the request
+)
+
+type ctxKeyRequestID struct{}
+type ctxKeySessionID struct{}
+type ctxKeyLoggedCaller struct{}
+
+// RequestID is the ID of the request being served, empty if there isn't one
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKeyRequestID{}).(string)
+	return id
+}
+
+// WithRequestID returns a context that carries the request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKeyRequestID{}, id)
+}
+
+// SessionID is the session the request being served is part of, empty if
+// there isn't one
+func SessionID(ctx context.Context) string {
+	id, _ := ctx.Value(ctxKeySessionID{}).(string)
+	return id
+}
+
+// WithSessionID returns a context that carries the session ID
+func WithSessionID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, ctxKeySessionID{}, id)
+}
+
+// LogFields are the request and session IDs, the caller if they were
+// authenticated and the trace ID if the trace is sampled, in the context for
+// logging, so the logs of every service a request reaches can be matched up
+func LogFields(ctx context.Context) logrus.Fields {
+	fields := logrus.Fields{}
+	if id := RequestID(ctx); id != "" {
+		fields["request_id"] = id
+	}
+	if id := SessionID(ctx); id != "" {
+		fields["session"] = id
+	}
+	caller := Caller(ctx)
+	if logged, ok := ctx.Value(ctxKeyLoggedCaller{}).(**Claims); ok && caller == nil {
+		caller = *logged
+	}
+	if caller != nil {
+		fields["user"] = caller.Subject
+	}
+	if span := trace.FromContext(ctx); span != nil && span.SpanContext().IsSampled() {
+		fields["trace_id"] = span.SpanContext().TraceID.String()
+	}
+	return fields
+}
+
+// NewRequestID makes a random request ID
+func NewRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestContext adds the request and session IDs from the incoming metadata
+// to the context, a new request ID if the client didn't send one, and sends
+// the request ID back to the client in the header.  The caller is logged once
+// auth finds out who they are.
+func requestContext(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if ids := md.Get(SessionIDKey); len(ids) > 0 && ids[0] != "" {
+		ctx = WithSessionID(ctx, ids[0])
+	}
+	id := NewRequestID()
+	if ids := md.Get(RequestIDKey); len(ids) > 0 && ids[0] != "" {
+		id = ids[0]
+	}
+	_ = grpc.SetHeader(ctx, metadata.Pairs(RequestIDKey, id))
+	ctx = context.WithValue(ctx, ctxKeyLoggedCaller{}, new(*Claims)) // Set by WithCaller
+	return WithRequestID(ctx, id)
+}
+
+// outgoingContext adds the request and session IDs and the caller's token in
+// the context to the outgoing metadata of a call to another service
+func outgoingContext(ctx context.Context) context.Context {
+	var kv []string
+	if id := RequestID(ctx); id != "" {
+		kv = append(kv, RequestIDKey, id)
+	}
+	if id := SessionID(ctx); id != "" {
+		kv = append(kv, SessionIDKey, id)
+	}
+	if token := Token(ctx); token != "" {
+		kv = append(kv, AuthorizationKey, "Bearer "+token)
+	}
+	if len(kv) == 0 {
+		return ctx
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...)
+}
+
+// UnaryClientMetadata is a client interceptor that forwards the request and
+// session IDs and the caller's token to the service called
+func UnaryClientMetadata(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(outgoingContext(ctx), method, req, reply, cc, opts...)
+}
+
+// StreamClientMetadata is UnaryClientMetadata for streaming calls
+func StreamClientMetadata(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(outgoingContext(ctx), desc, cc, method, opts...)
+}
+
+// UnaryServerInterceptors are the interceptors every gRPC server has, they
+// add the request and session IDs, log each RPC and recover from panics
+func (c *AppConfig) UnaryServerInterceptors() []grpc.UnaryServerInterceptor {
+	return []grpc.UnaryServerInterceptor{c.unaryLog, c.unaryRecover}
+}
+
+// StreamServerInterceptors are UnaryServerInterceptors for streaming RPCs
+func (c *AppConfig) StreamServerInterceptors() []grpc.StreamServerInterceptor {
+	return []grpc.StreamServerInterceptor{c.streamLog, c.streamRecover}
+}
+
+func (c *AppConfig) unaryLog(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx = requestContext(ctx)
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	c.logRPC(ctx, info.FullMethod, start, err)
+	return resp, err
+}
+
+func (c *AppConfig) streamLog(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx := requestContext(ss.Context())
+	start := time.Now()
+	err := handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	c.logRPC(ctx, info.FullMethod, start, err)
+	return err
+}
+
+// logRPC logs a finished RPC, errors that are the server's fault are logged
+// as errors and those that are the client's as warnings
+func (c *AppConfig) logRPC(ctx context.Context, method string, start time.Time, err error) {
+	code := status.Code(err)
+	log := c.Log.WithFields(LogFields(ctx)).WithFields(logrus.Fields{
+		"grpc.method":  method,
+		"grpc.code":    code.String(),
+		"grpc.took_ms": int64(time.Since(start) / time.Millisecond),
+	})
+	if p, ok := peer.FromContext(ctx); ok {
+		log = log.WithField("grpc.peer", p.Addr.String())
+	}
+	switch {
+	case code == codes.OK:
+		log.Info("rpc complete")
+	case serverFault(code):
+		log.WithError(err).Error("rpc failed")
+	default:
+		log.WithError(err).Warn("rpc failed")
+	}
+}
+
+func (c *AppConfig) unaryRecover(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); CheckPanic(r) {
+			err = c.panicError(ctx, info.FullMethod, r)
+		}
+	}()
+	return handler(ctx, req)
+}
+
+func (c *AppConfig) streamRecover(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); CheckPanic(r) {
+			err = c.panicError(ss.Context(), info.FullMethod, r)
+		}
+	}()
+	return handler(srv, ss)
+}
+
+// panicError logs a panic, CheckPanic has already printed its stack, and
+// turns it into an INTERNAL error so the server carries on
+func (c *AppConfig) panicError(ctx context.Context, method string, r interface{}) error {
+	c.Log.WithFields(LogFields(ctx)).WithField("grpc.method", method).Errorf("panic: %v", r)
+	return status.Errorf(codes.Internal, "internal error, request ID %s", RequestID(ctx))
+}
+
+// serverStream is a grpc.ServerStream with a different context
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context { return s.ctx }
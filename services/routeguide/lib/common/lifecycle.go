@@ -0,0 +1,160 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// DefaultShutdownTimeout is how long in-flight requests get to finish when a
+// server is stopped, if shutdown_timeout isn't set
+const DefaultShutdownTimeout = 10 * time.Second
+
+// DefaultShutdownDrain is how long a gRPC server keeps taking RPCs once it is
+// NOT_SERVING, if shutdown_drain isn't set
+const DefaultShutdownDrain = 5 * time.Second
+
+// stopSignals stop a server, Kubernetes sends SIGTERM and then SIGKILL once
+// terminationGracePeriodSeconds have passed
+var stopSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// Closer is a resource that is released once the server has stopped, e.g. a
+// BookDatabase
+type Closer interface {
+	Close(ctx context.Context) error
+}
+
+// CloserFunc lets an ordinary function be a Closer
+type CloserFunc func(ctx context.Context) error
+
+// Close calls f(ctx)
+func (f CloserFunc) Close(ctx context.Context) error { return f(ctx) }
+
+// How long in-flight requests get to finish when the server is stopped, e.g. 15s
+func (c *AppConfig) ShutdownTimeout() time.Duration {
+	return c.GetDurationKey("shutdown_timeout", DefaultShutdownTimeout)
+}
+
+// How long a gRPC server keeps taking RPCs once its health is NOT_SERVING, so
+// the readiness probes and load balancers see it and stop sending RPCs before
+// the server stops listening, e.g. 5s or 0s for none.  It is part of the
+// ShutdownTimeout and at most half of it.
+func (c *AppConfig) ShutdownDrain() time.Duration {
+	d := DefaultShutdownDrain
+	if s := c.GetStringKey("shutdown_drain"); s != "" {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil || d < 0 {
+			c.Log.Warnf("shutdown_drain: %q isn't a duration, using %v", s, DefaultShutdownDrain)
+			d = DefaultShutdownDrain
+		}
+	}
+	if max := c.ShutdownTimeout() / 2; d > max {
+		d = max
+	}
+	return d
+}
+
+// ServeGRPC serves gRPC on lis until the process gets SIGINT or SIGTERM.  Then
+// health, if not nil, goes NOT_SERVING and the server carries on taking RPCs
+// for ShutdownDrain before it stops taking new ones.  The RPCs in flight,
+// streams included, have the rest of the ShutdownTimeout to finish before
+// they are cancelled.  Last the SvcConn connections and the closers are closed.
+func (c *AppConfig) ServeGRPC(s *grpc.Server, lis net.Listener, health *Health, closers ...Closer) error {
+	serve := func() error { return s.Serve(lis) }
+	shutdown := func(ctx context.Context) {
+		if health != nil {
+			health.Shutdown()
+			if drain := c.ShutdownDrain(); drain > 0 {
+				c.Log.Infof("NOT_SERVING, taking RPCs for %v more before stopping", drain)
+				select {
+				case <-time.After(drain):
+				case <-ctx.Done():
+				}
+			}
+		}
+		stopped := make(chan struct{})
+		go func() {
+			s.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			c.Log.Warn("RPCs still running at the shutdown deadline, cancelling them")
+			s.Stop()
+			<-stopped
+		}
+	}
+	return c.serveUntilStopped(serve, shutdown, closers)
+}
+
+// ListenAndServe serves HTTP until the process gets SIGINT or SIGTERM.  Then
+// the server stops taking new connections and the requests in flight have
+// ShutdownTimeout to finish before their connections are closed.  Last the
+// SvcConn connections and the closers are closed.
+func (c *AppConfig) ListenAndServe(srv *http.Server, closers ...Closer) error {
+	serve := func() error {
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}
+	shutdown := func(ctx context.Context) {
+		if err := srv.Shutdown(ctx); err != nil {
+			c.Log.Warnf("Requests still running at the shutdown deadline, closing them: %v", err)
+			srv.Close()
+		}
+	}
+	return c.serveUntilStopped(serve, shutdown, closers)
+}
+
+// serveUntilStopped runs serve until it fails or a stop signal arrives, when
+// shutdown is given ShutdownTimeout to stop the server
+func (c *AppConfig) serveUntilStopped(serve func() error, shutdown func(ctx context.Context), closers []Closer) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, stopSignals...)
+	defer signal.Stop(sigs)
+
+	served := make(chan error, 1)
+	go func() { served <- serve() }()
+
+	var err error
+	select {
+	case err = <-served:
+	case sig := <-sigs:
+		timeout := c.ShutdownTimeout()
+		c.Log.Infof("Received %v, shutting down within %v", sig, timeout)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		shutdown(ctx)
+		cancel()
+		err = <-served
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.ShutdownTimeout())
+	defer cancel()
+	c.close(ctx, closers)
+	c.Log.Info("Shut down")
+	return err
+}
+
+// close closes the connections to other services and then the closers, in
+// the order given, logging any errors
+func (c *AppConfig) close(ctx context.Context, closers []Closer) {
+	for name, conn := range c.SvcConn {
+		if err := conn.Close(); err != nil {
+			c.Log.Errorf("Closing the connection to %s: %v", name, err)
+		}
+	}
+	for _, closer := range closers {
+		if err := closer.Close(ctx); err != nil {
+			c.Log.Errorf("Closing %T: %v", closer, err)
+		}
+	}
+}
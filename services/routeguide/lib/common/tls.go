@@ -0,0 +1,256 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/credentials"
+)
+
+// CertDir is where a service's certificates are if cert_file, key_file and
+// ca_file aren't set, cmd/devcerts writes development certificates there
+const CertDir = "certs"
+
+// devCertsHint is added to errors loading certificates
+const devCertsHint = "for development certificates run go run ./cmd/devcerts in lib"
+
+// certPath is the file set by the key, or else the file in CertDir if the
+// config was loaded for a service
+func (c *AppConfig) certPath(key, file string) string {
+	if s := c.GetStringKey(key); s != "" || c.ServiceName == "" {
+		return s
+	}
+	return filepath.Join(CertDir, file)
+}
+
+// certReloader holds a key pair and a CA bundle read from files, it reads
+// them again when the files change so rotated certificates are used without
+// a restart.  If the new files can't be read the old ones are kept.
+type certReloader struct {
+	certFile, keyFile, caFile string
+	log                       *logrus.Logger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate // nil if there's no key pair
+	pool    *x509.CertPool   // nil if there's no CA bundle
+	version string           // The sizes and modification times of the files
+}
+
+func newCertReloader(certFile, keyFile, caFile string, log *logrus.Logger) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile, log: log}
+	if err := r.load(r.fileVersion()); err != nil {
+		return nil, fmt.Errorf("%w, %s", err, devCertsHint)
+	}
+	return r, nil
+}
+
+// fileVersion changes when any of the files changes
+func (r *certReloader) fileVersion() string {
+	var sb strings.Builder
+	for _, name := range []string{r.certFile, r.keyFile, r.caFile} {
+		if name == "" {
+			continue
+		}
+		if fi, err := os.Stat(name); err == nil {
+			fmt.Fprintf(&sb, "%d@%d;", fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+	return sb.String()
+}
+
+func (r *certReloader) load(version string) error {
+	var cert *tls.Certificate
+	if r.certFile != "" || r.keyFile != "" {
+		c, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return fmt.Errorf("loading the key pair %s, %s: %w", r.certFile, r.keyFile, err)
+		}
+		cert = &c
+	}
+	var pool *x509.CertPool
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("loading the CA bundle: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in the CA bundle %s", r.caFile)
+		}
+	}
+	r.cert, r.pool, r.version = cert, pool, version
+	return nil
+}
+
+// current reloads the files if they have changed and returns the key pair
+// and the CA pool
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if version := r.fileVersion(); version != r.version {
+		if err := r.load(version); err != nil {
+			r.log.Errorf("Keeping the old certificates: %v", err)
+		} else {
+			r.log.Infof("Reloaded the certificates %s", r.certFile)
+		}
+	}
+	return r.cert, r.pool
+}
+
+func (r *certReloader) certificate() (*tls.Certificate, error) {
+	cert, _ := r.current()
+	if cert == nil {
+		return nil, errors.New("no certificate")
+	}
+	return cert, nil
+}
+
+// The file containing the CA certificates that peers' certificates are
+// verified against, a server with a CA file requires client certificates.
+// certs/ca.pem if not set.
+func (c *AppConfig) CAFile() string {
+	return c.certPath("ca_file", "ca.pem")
+}
+
+// The identities, common names or SANs, of the clients a server accepts.  Any
+// client with a certificate from the CA is accepted if there are none.
+func (c *AppConfig) AllowedClients() []string {
+	var ids []string
+	for _, id := range strings.Split(c.GetStringKey("allowed_clients"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// ServerCredentials are the TLS credentials of a gRPC server from CertFile
+// and KeyFile.  If there is a CAFile clients must present a certificate from
+// it, whose identity is one of the AllowedClients if there are any.  The files
+// are read again when they change.
+func (c *AppConfig) ServerCredentials() (credentials.TransportCredentials, error) {
+	if c.CertFile() == "" || c.KeyFile() == "" {
+		return nil, fmt.Errorf("tls is on but cert_file and key_file aren't both set, %s", devCertsHint)
+	}
+	r, err := newCertReloader(c.CertFile(), c.KeyFile(), c.CAFile(), c.Log)
+	if err != nil {
+		return nil, err
+	}
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"h2"},
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return r.certificate()
+		},
+	}
+	if c.CAFile() != "" {
+		base.ClientAuth = tls.RequireAndVerifyClientCert
+		if allowed := c.AllowedClients(); len(allowed) > 0 {
+			base.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+				return checkIdentity(chains[0][0], allowed)
+			}
+		}
+	}
+	config := &tls.Config{
+		// Each handshake gets the CA pool as it is now
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			_, pool := r.current()
+			cfg := base.Clone()
+			cfg.ClientCAs = pool
+			return cfg, nil
+		},
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// checkIdentity checks that a verified client certificate is for one of the
+// allowed identities
+func checkIdentity(cert *x509.Certificate, allowed []string) error {
+	ids := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, u := range cert.URIs {
+		ids = append(ids, u.String())
+	}
+	for _, id := range ids {
+		for _, a := range allowed {
+			if id == a {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("client %q is not allowed", cert.Subject.CommonName)
+}
+
+// ClientCredentials are the TLS credentials to call the service at addr,
+// whose certificate is verified against the CAFile for the host name of addr
+// or HostOverride.  The client presents the CertFile and KeyFile if they are
+// set.  The files are read again when they change.
+func (c *AppConfig) ClientCredentials(addr string) (credentials.TransportCredentials, error) {
+	if c.CAFile() == "" {
+		return nil, fmt.Errorf("tls is on but ca_file isn't set, %s", devCertsHint)
+	}
+	r, err := newCertReloader(c.CertFile(), c.KeyFile(), c.CAFile(), c.Log)
+	if err != nil {
+		return nil, err
+	}
+	serverName := c.HostOverride()
+	if serverName == "" {
+		serverName = addr
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			serverName = host
+		}
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert, _ := r.current(); cert != nil {
+				return cert, nil
+			}
+			return &tls.Certificate{}, nil // No certificate, the server decides
+		},
+		// The server certificate is verified below against the CA pool as it is
+		// now, rather than the pool when the connection was made
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, pool := r.current()
+			return verifyServer(rawCerts, pool, serverName)
+		},
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// verifyServer does what crypto/tls does when InsecureSkipVerify is false
+func verifyServer(rawCerts [][]byte, roots *x509.CertPool, serverName string) error {
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("bad server certificate: %w", err)
+		}
+		certs[i] = cert
+	}
+	if len(certs) == 0 {
+		return errors.New("no server certificate")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   time.Now(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
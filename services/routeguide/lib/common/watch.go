@@ -0,0 +1,258 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// ConfigDebounce is how long the config files must be left alone before they
+// are read again, an editor or a ConfigMap update changes them several times
+const ConfigDebounce = time.Second
+
+// ConfigWatcher reads the config files again when they change or the process
+// gets SIGHUP.  If every subscription's keys are still valid the ones whose
+// values changed, or all of them on SIGHUP, are called with them, otherwise
+// the errors are logged and nothing changes.  The config loaded at start, read
+// by e.g. GetStringKey, stays as it was, only the subscriptions see changes.
+type ConfigWatcher struct {
+	c *AppConfig
+
+	mu   sync.Mutex
+	subs []*subscription
+
+	files *fsnotify.Watcher // nil unless WatchFiles is called
+	hup   chan os.Signal
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// subscription is a struct that Bind fills from the keys of a prefix and the
+// func it is passed to when they change
+type subscription struct {
+	prefix   string
+	typ      reflect.Type  // The struct
+	onChange reflect.Value // func(*struct), or not valid to only check the keys
+	last     interface{}   // The *struct it was last called with
+}
+
+// WatchConfig makes the ConfigWatcher of the config, which reads it again on
+// SIGHUP, and WatchFiles when the files change.  The Closer stops it.
+func (c *AppConfig) WatchConfig() *ConfigWatcher {
+	w := &ConfigWatcher{c: c, hup: make(chan os.Signal, 1), done: make(chan struct{})}
+	c.watcher = w
+	signal.Notify(w.hup, syscall.SIGHUP)
+	w.wg.Add(1)
+	go w.run()
+	return w
+}
+
+// WatchFiles reads the config again once the files in its directories, the
+// configPaths and ./cfg, haven't changed for debounce.  A Kubernetes
+// ConfigMap's files are swapped in by renaming its ..data link, which is
+// watched too.
+func (w *ConfigWatcher) WatchFiles(debounce time.Duration) error {
+	files, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dirs := 0
+	for _, dir := range append(append([]string{}, w.c.configPaths...), "./cfg") {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := files.Add(dir); err != nil {
+			files.Close()
+			return fmt.Errorf("cannot watch %s: %w", dir, err)
+		}
+		dirs++
+	}
+	if dirs == 0 {
+		files.Close()
+		return errors.New("there are no config directories to watch")
+	}
+	w.files = files
+	w.wg.Add(1)
+	go w.watchFiles(debounce)
+	return nil
+}
+
+// configFile says if a change to the file could change the config
+func (w *ConfigWatcher) configFile(name string) bool {
+	switch filepath.Base(name) {
+	case "defaultConfig.yaml", w.c.ServiceName + ".yaml", "..data":
+		return true
+	}
+	return false
+}
+
+func (w *ConfigWatcher) watchFiles(debounce time.Duration) {
+	defer w.wg.Done()
+	var settled <-chan time.Time
+	for {
+		select {
+		case event, ok := <-w.files.Events:
+			if !ok {
+				return
+			}
+			if w.configFile(event.Name) {
+				settled = time.After(debounce) // Starts again with every change
+			}
+		case err, ok := <-w.files.Errors:
+			if !ok {
+				return
+			}
+			w.c.Log.Warnf("Watching the config files: %v", err)
+		case <-settled:
+			settled = nil
+			w.reload("the files changed", false)
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *ConfigWatcher) run() {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.hup:
+			w.reload("SIGHUP", true)
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *ConfigWatcher) reload(why string, all bool) {
+	changed, err := w.load(all)
+	var invalid ConfigErrors
+	if errors.As(err, &invalid) {
+		for _, err := range invalid {
+			w.c.Log.Error(err)
+		}
+		w.c.Log.Errorf("The config read again as %s isn't used, see the keys above", why)
+		return
+	} else if err != nil {
+		w.c.Log.Errorf("The config read again as %s isn't used: %v", why, err)
+		return
+	}
+	w.c.Log.Infof("Read the config again as %s, %d subscriptions were called", why, changed)
+}
+
+// Subscribe calls onChange, a func(cfg *T) where T is a struct Bind can fill,
+// with the keys of prefix each time they change.  The keys are checked now, it
+// isn't called with them.  onChange mustn't subscribe.
+func (w *ConfigWatcher) Subscribe(prefix string, onChange interface{}) error {
+	fn := reflect.ValueOf(onChange)
+	if !fn.IsValid() || fn.Kind() != reflect.Func {
+		return fmt.Errorf("Subscribe needs a func(*struct), not %T", onChange)
+	}
+	t := fn.Type()
+	if t.NumIn() != 1 || t.NumOut() != 0 || t.In(0).Kind() != reflect.Ptr || t.In(0).Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("Subscribe needs a func(*struct), not %T", onChange)
+	}
+	return w.subscribe(prefix, t.In(0).Elem(), fn)
+}
+
+// check has the keys of the struct cfg points to checked before a change is
+// used, without subscribing to them
+func (w *ConfigWatcher) check(prefix string, cfg interface{}) error {
+	return w.subscribe(prefix, reflect.TypeOf(cfg).Elem(), reflect.Value{})
+}
+
+func (w *ConfigWatcher) subscribe(prefix string, t reflect.Type, onChange reflect.Value) error {
+	cfg := reflect.New(t).Interface()
+	if err := w.c.Bind(prefix, cfg); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.subs = append(w.subs, &subscription{prefix: prefix, typ: t, onChange: onChange, last: cfg})
+	return nil
+}
+
+// Reload reads the config files again and, if every subscription's keys are
+// valid, calls those whose values changed.  It returns how many were called.
+func (w *ConfigWatcher) Reload() (int, error) {
+	return w.load(false)
+}
+
+// load reads the config files again and calls the subscriptions whose values
+// changed, or all of them so e.g. the log file is reopened
+func (w *ConfigWatcher) load(all bool) (int, error) {
+	v, err := readConfig(w.c.ServiceName, w.c.defaults, w.c.configPaths, w.c.Log)
+	if err != nil {
+		return 0, err
+	}
+	fresh := *w.c
+	fresh.V = v
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	cfgs := make([]interface{}, len(w.subs))
+	var errs ConfigErrors
+	seen := make(map[string]bool) // A key can be in more than one struct
+	for i, sub := range w.subs {
+		cfgs[i] = reflect.New(sub.typ).Interface()
+		err := fresh.Bind(sub.prefix, cfgs[i])
+		var invalid ConfigErrors
+		switch {
+		case errors.As(err, &invalid):
+			for _, err := range invalid {
+				if !seen[err.Error()] {
+					seen[err.Error()] = true
+					errs = append(errs, err)
+				}
+			}
+		case err != nil:
+			return 0, err
+		}
+	}
+	if len(errs) > 0 {
+		return 0, errs
+	}
+	changed := 0
+	for i, sub := range w.subs {
+		if !all && reflect.DeepEqual(cfgs[i], sub.last) {
+			continue
+		}
+		sub.last = cfgs[i]
+		if sub.onChange.IsValid() {
+			sub.onChange.Call([]reflect.Value{reflect.ValueOf(cfgs[i])})
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+// Close stops watching
+func (w *ConfigWatcher) Close(context.Context) error {
+	signal.Stop(w.hup)
+	close(w.done)
+	var err error
+	if w.files != nil {
+		err = w.files.Close()
+	}
+	w.wg.Wait()
+	return err
+}
+
+// OnConfigChange subscribes onChange, a func(cfg *T), to the keys of prefix
+// if the config is watched, see ConfigWatcher.Subscribe.  Without a watcher
+// the config never changes and onChange is never called.
+func (c *AppConfig) OnConfigChange(prefix string, onChange interface{}) error {
+	if c.watcher == nil {
+		return nil
+	}
+	return c.watcher.Subscribe(prefix, onChange)
+}
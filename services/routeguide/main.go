@@ -3,21 +3,17 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"flag"
 	"fmt"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
-	"google.golang.org/grpc/testdata"
 	"google.golang.org/protobuf/proto"
 	"io"
 	"io/ioutil"
 	"lib/common"
 	"log"
 	"math"
-	"net"
-	"net/http"
 	pb "routeguide/pb"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,6 +23,7 @@ const (
 )
 
 type routeGuideServer struct {
+	chats int64 // RouteChat streams in progress, first to be 64-bit aligned for atomic
 	pb.UnimplementedRouteGuideServer
 	savedFeatures []*pb.Feature // read-only after initialized
 
@@ -96,6 +93,8 @@ func (s *routeGuideServer) RecordRoute(stream pb.RouteGuide_RecordRouteServer) e
 // RouteChat receives a stream of message/location pairs, and responds with a stream of all
 // previous messages at each of those locations.
 func (s *routeGuideServer) RouteChat(stream pb.RouteGuide_RouteChatServer) error {
+	atomic.AddInt64(&s.chats, 1)
+	defer atomic.AddInt64(&s.chats, -1)
 	for {
 		in, err := stream.Recv()
 		if err == io.EOF {
@@ -123,6 +122,25 @@ func (s *routeGuideServer) RouteChat(stream pb.RouteGuide_RouteChatServer) error
 	}
 }
 
+// noteCount is the number of notes at every location
+func (s *routeGuideServer) noteCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, notes := range s.routeNotes {
+		n += len(notes)
+	}
+	return n
+}
+
+// registerMetrics adds the gauges of the server to the service's metrics
+func (s *routeGuideServer) registerMetrics(m *common.Metrics) {
+	m.GaugeFunc("routeguide_route_chats_active", "RouteChat streams in progress.",
+		func() float64 { return float64(atomic.LoadInt64(&s.chats)) })
+	m.GaugeFunc("routeguide_route_notes", "Route notes received by RouteChat, at every location.",
+		func() float64 { return float64(s.noteCount()) })
+}
+
 // loadFeatures loads features from a JSON file.
 func (s *routeGuideServer) loadFeatures(filePath string) {
 	var data []byte
@@ -184,62 +202,29 @@ func serialize(point *pb.Point) string {
 	return fmt.Sprintf("%d %d", point.Latitude, point.Longitude)
 }
 
-func newServer() *routeGuideServer {
+// routeGuideConfig are the route guide's own keys
+type routeGuideConfig struct {
+	FeatureFile string `config:"json_feature_file"` // The example features if empty
+}
+
+func newServer(cfg *routeGuideConfig) *routeGuideServer {
 	s := &routeGuideServer{routeNotes: make(map[string][]*pb.RouteNote)}
-	s.loadFeatures(common.App.GetStringKey("json_feature_file"))
+	s.loadFeatures(cfg.FeatureFile)
 	return s
 }
 
 func main() {
-	// Command line stuff
-	showversion := flag.Bool("version", false, "display version")
-	flag.Parse()
-	if *showversion {
-		fmt.Printf("Version %s\n", version)
-		return
-	}
-
-	// Service details
-	c, err := common.LoadConfig(serviceName, "")
-	if err != nil {
-		fmt.Printf("Cannot load the configuration: %s", err)
-	}
-
-	// Now we've parsed all the connection paramaters we can connect to the services
-	//mustConnGRPC(ctx, &servers["route-guide"].Conn, *servers["route-guide"].ServiceParams[common.ServiceAddress])
-
-	http.HandleFunc("/version", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "%s\n", version)
-	})
-
-	c.KeyPrefix("route-guide")
-	c.Log.Info(common.GetLocalIP(), ":", c.Port())
-
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%v", c.Port()))
-
-	//lis, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", *port))
-	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
-	}
-	var opts []grpc.ServerOption
-	if c.TLS() {
-		certFile := c.CertFile()
-		if certFile == "" {
-			certFile = testdata.Path("server1.pem")
-		}
-		keyFile := c.KeyFile()
-		if keyFile == "" {
-			keyFile = testdata.Path("server1.key")
-		}
-		creds, err := credentials.NewServerTLSFromFile(certFile, keyFile)
-		if err != nil {
-			c.Log.Fatalf("Failed to generate credentials ", err)
-		}
-		opts = []grpc.ServerOption{grpc.Creds(creds)}
-	}
-	grpcServer := grpc.NewServer(opts...)
-	pb.RegisterRouteGuideServer(grpcServer, newServer())
-	grpcServer.Serve(lis)
+	var cfg routeGuideConfig
+	common.NewService(serviceName, version).
+		KeyPrefix("route-guide").
+		BindConfig(&cfg).
+		RegisterGRPC(func(svc *common.Service, s *grpc.Server) error {
+			server := newServer(&cfg) // Loads the saved features
+			server.registerMetrics(svc.Metrics)
+			pb.RegisterRouteGuideServer(s, server)
+			return nil
+		}).
+		Run()
 }
 
 // exampleData is a copy of testdata/route_guide_db.json. It's to avoid
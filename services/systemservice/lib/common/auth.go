@@ -0,0 +1,563 @@
+package common
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// AuthorizationKey is the metadata key of the caller's token, sent as
+// "Bearer <token>"
+const AuthorizationKey = "authorization"
+
+// tokenLeeway allows for clock skew between the services when checking the
+// times in a token
+const tokenLeeway = 30 * time.Second
+
+// minSecretSize is the shortest HMAC secret that is accepted, as long as the
+// hash of HS256
+const minSecretSize = 32
+
+// Claims are what a token says about the caller
+type Claims struct {
+	Subject   string   `json:"sub"`            // Who the caller is, e.g. a user name
+	Issuer    string   `json:"iss,omitempty"`  // Who made the token
+	Audience  Audience `json:"aud,omitempty"`  // The services the token is for
+	ExpiresAt int64    `json:"exp"`            // Unix time, tokens must expire
+	NotBefore int64    `json:"nbf,omitempty"`  // Unix time
+	IssuedAt  int64    `json:"iat,omitempty"`  // Unix time
+	Name      string   `json:"name,omitempty"` // The caller's name to show
+	Roles     []string `json:"roles,omitempty"`
+}
+
+// HasRole says if the caller has one of the roles
+func (cl *Claims) HasRole(roles ...string) bool {
+	for _, have := range cl.Roles {
+		for _, want := range roles {
+			if have == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Audience is the aud claim, which is a string or a list of them
+type Audience []string
+
+// UnmarshalJSON reads either form
+func (a *Audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = Audience{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return errors.New("aud is neither a string nor a list of them")
+	}
+	*a = ss
+	return nil
+}
+
+// MarshalJSON writes a single audience as a string
+func (a Audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+type ctxKeyToken struct{}
+type ctxKeyClaims struct{}
+
+// Token is the caller's token to forward to other services, empty if there
+// isn't one
+func Token(ctx context.Context) string {
+	token, _ := ctx.Value(ctxKeyToken{}).(string)
+	return token
+}
+
+// WithToken returns a context whose calls to other services carry the token
+func WithToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, ctxKeyToken{}, token)
+}
+
+// Caller is who is making the request being served, from their verified
+// token, nil if the caller wasn't authenticated
+func Caller(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(ctxKeyClaims{}).(*Claims)
+	return claims
+}
+
+// WithCaller returns a context that carries the verified claims of the caller.
+// The caller is also kept for the log of the RPC, whose interceptor runs
+// before auth.
+func WithCaller(ctx context.Context, claims *Claims) context.Context {
+	if logged, ok := ctx.Value(ctxKeyLoggedCaller{}).(**Claims); ok {
+		*logged = claims
+	}
+	return context.WithValue(ctx, ctxKeyClaims{}, claims)
+}
+
+// algorithms are the JWT algorithms that are accepted
+var algorithms = []string{"HS256", "HS384", "HS512", "RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+
+// Key types of the key files, e.g. auth_key_type, which say how a file is read
+// so a public key is never taken for an HMAC secret
+const (
+	KeyTypePEM  = "pem"  // A PEM key or certificate, the default
+	KeyTypeHMAC = "hmac" // An HMAC secret, the whole file bar spaces at the ends
+)
+
+// jwtClaims are the Claims as jwt parses and signs them, the times and
+// audience are checked by checkClaims rather than jwt so there is a leeway
+// and tokens must expire
+type jwtClaims Claims
+
+// Valid is left to checkClaims
+func (*jwtClaims) Valid() error { return nil }
+
+// TokenVerifier checks that JWTs are signed by one of its keys and are valid
+// now.  Keys are HMAC secrets, []byte, or *rsa.PublicKey or *ecdsa.PublicKey,
+// and each is only used with the algorithms of its kind.
+type TokenVerifier struct {
+	keys     map[string]interface{} // By key ID, "" for a key without one
+	issuer   string
+	audience string
+	parser   *jwt.Parser
+}
+
+// NewTokenVerifier makes a verifier of tokens signed by the keys, by key ID.
+// If issuer or audience aren't empty tokens must have them.
+func NewTokenVerifier(keys map[string]interface{}, issuer, audience string) (*TokenVerifier, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no keys to verify tokens with")
+	}
+	for kid, key := range keys {
+		switch k := key.(type) {
+		case []byte:
+			if len(k) < minSecretSize {
+				return nil, fmt.Errorf("key %q: HMAC secrets must be at least %d bytes", kid, minSecretSize)
+			}
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+		default:
+			return nil, fmt.Errorf("key %q: can't verify tokens with a %T", kid, key)
+		}
+	}
+	parser := jwt.NewParser(jwt.WithValidMethods(algorithms), jwt.WithoutClaimsValidation())
+	return &TokenVerifier{keys: keys, issuer: issuer, audience: audience, parser: parser}, nil
+}
+
+// TokenVerifier is made from auth_key_file, a PEM public key or certificate,
+// or a file with an HMAC secret if auth_key_type is hmac, or auth_jwks_file,
+// a JWKS file, and auth_issuer and auth_audience.  It is nil if neither file
+// is set.
+func (c *AppConfig) TokenVerifier() (*TokenVerifier, error) {
+	keys := map[string]interface{}{}
+	if file := c.GetStringKey("auth_key_file"); file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseKey(b, c.GetStringKey("auth_key_type"))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		if signer, ok := key.(crypto.Signer); ok {
+			key = signer.Public() // Allows the signer's key file to be shared in development
+		}
+		keys[""] = key
+	}
+	if file := c.GetStringKey("auth_jwks_file"); file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		jwks, err := ParseJWKS(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		for kid, key := range jwks {
+			keys[kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	return NewTokenVerifier(keys, c.GetStringKey("auth_issuer"), c.GetStringKey("auth_audience"))
+}
+
+// Verify checks the token and returns its claims
+func (v *TokenVerifier) Verify(token string) (*Claims, error) {
+	claims := &Claims{}
+	if _, err := v.parser.ParseWithClaims(token, (*jwtClaims)(claims), v.key); err != nil {
+		return nil, err
+	}
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// key is the key of the token's kid, which must be of the kind its algorithm
+// uses, so e.g. an RSA public key is never taken for an HMAC secret
+func (v *TokenVerifier) key(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := v.keys[kid]
+	if !ok && kid != "" {
+		key, ok = v.keys[""] // A key without an ID verifies tokens with any ID
+	}
+	if !ok && kid == "" && len(v.keys) == 1 {
+		for _, k := range v.keys {
+			key, ok = k, true // The only key verifies tokens without an ID
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+	fits := false
+	switch k := key.(type) {
+	case []byte:
+		_, fits = token.Method.(*jwt.SigningMethodHMAC)
+	case *rsa.PublicKey:
+		_, fits = token.Method.(*jwt.SigningMethodRSA)
+	case *ecdsa.PublicKey:
+		fits = token.Method.Alg() == ecdsaAlgorithm(k.Curve)
+	}
+	if !fits {
+		return nil, fmt.Errorf("key %q doesn't verify %s tokens", kid, token.Method.Alg())
+	}
+	return key, nil
+}
+
+func (v *TokenVerifier) checkClaims(claims *Claims, now time.Time) error {
+	switch {
+	case claims.ExpiresAt == 0:
+		return errors.New("the token doesn't expire")
+	case now.Add(-tokenLeeway).After(time.Unix(claims.ExpiresAt, 0)):
+		return errors.New("the token has expired")
+	case claims.NotBefore != 0 && now.Add(tokenLeeway).Before(time.Unix(claims.NotBefore, 0)):
+		return errors.New("the token isn't valid yet")
+	case v.issuer != "" && claims.Issuer != v.issuer:
+		return fmt.Errorf("the token is from %q", claims.Issuer)
+	}
+	if v.audience == "" {
+		return nil
+	}
+	for _, aud := range claims.Audience {
+		if aud == v.audience {
+			return nil
+		}
+	}
+	return fmt.Errorf("the token isn't for %s", v.audience)
+}
+
+// ecdsaAlgorithm is the JWT algorithm of keys on the curve
+func ecdsaAlgorithm(curve elliptic.Curve) string {
+	switch curve {
+	case elliptic.P384():
+		return "ES384"
+	case elliptic.P521():
+		return "ES512"
+	}
+	return "ES256"
+}
+
+// TokenSigner makes JWTs, e.g. for the users who log in to the frontend
+type TokenSigner struct {
+	alg string
+	kid string
+	key interface{}
+}
+
+// NewTokenSigner makes a signer with an HMAC secret, []byte, or an
+// *rsa.PrivateKey or *ecdsa.PrivateKey.  kid, if not empty, is put in the
+// token header so verifiers with several keys know which to use.
+func NewTokenSigner(key interface{}, kid string) (*TokenSigner, error) {
+	var alg string
+	switch k := key.(type) {
+	case []byte:
+		if len(k) < minSecretSize {
+			return nil, fmt.Errorf("HMAC secrets must be at least %d bytes", minSecretSize)
+		}
+		alg = "HS256"
+	case *rsa.PrivateKey:
+		alg = "RS256"
+	case *ecdsa.PrivateKey:
+		alg = ecdsaAlgorithm(k.Curve)
+	default:
+		return nil, fmt.Errorf("can't sign tokens with a %T", key)
+	}
+	return &TokenSigner{alg: alg, kid: kid, key: key}, nil
+}
+
+// LoadTokenSigner makes a signer with the key in a file of the key type, a
+// PEM private key or, if keyType is KeyTypeHMAC, an HMAC secret
+func LoadTokenSigner(keyFile, keyType, kid string) (*TokenSigner, error) {
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parseKey(b, keyType)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyFile, err)
+	}
+	return NewTokenSigner(key, kid)
+}
+
+// Sign makes a token with the claims
+func (s *TokenSigner) Sign(claims *Claims) (string, error) {
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(s.alg), (*jwtClaims)(claims))
+	if s.kid != "" {
+		token.Header["kid"] = s.kid
+	}
+	return token.SignedString(s.key)
+}
+
+// parseKey reads a PEM key or certificate, or an HMAC secret if the key type
+// says so, the one isn't taken for the other
+func parseKey(b []byte, keyType string) (interface{}, error) {
+	block, _ := pem.Decode(b)
+	switch keyType {
+	case "", KeyTypePEM:
+		if block == nil {
+			return nil, fmt.Errorf("not a PEM key or certificate, the key type of an HMAC secret is %s", KeyTypeHMAC)
+		}
+	case KeyTypeHMAC:
+		if block != nil {
+			return nil, fmt.Errorf("a PEM %s isn't an HMAC secret", block.Type)
+		}
+		return []byte(strings.TrimSpace(string(b))), nil
+	default:
+		return nil, fmt.Errorf("unknown key type %q, use %s or %s", keyType, KeyTypePEM, KeyTypeHMAC)
+	}
+	switch block.Type {
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+// ParseJWKS reads the signing keys in a JSON Web Key Set by key ID, see
+// https://tools.ietf.org/html/rfc7517.  RSA, EC and oct (HMAC) keys are
+// supported.
+func ParseJWKS(b []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]interface{}{}
+	num := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		return new(big.Int).SetBytes(b), err
+	}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err := num(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+			}
+			e, err := num(k.E)
+			if err != nil || !e.IsInt64() {
+				return nil, fmt.Errorf("key %q: bad exponent", k.Kid)
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+			curve, ok := curves[k.Crv]
+			if !ok {
+				return nil, fmt.Errorf("key %q: unsupported curve %q", k.Kid, k.Crv)
+			}
+			x, err := num(k.X)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+			}
+			y, err := num(k.Y)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+			}
+			if !curve.IsOnCurve(x, y) {
+				return nil, fmt.Errorf("key %q: not a point on %s", k.Kid, k.Crv)
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %w", k.Kid, err)
+			}
+			keys[k.Kid] = secret
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	return keys, nil
+}
+
+// MethodPolicy says who can call the gRPC methods, it is read from the
+// service's auth_policy, e.g.
+//
+//	auth_policy:
+//	  - method: /book.v1.BookService/DeleteBook
+//	    roles: [editor]
+//	  - method: /book.v1.BookService/GetBook
+//	    public: true
+type MethodPolicy struct {
+	// The full method, e.g. /book.v1.BookService/DeleteBook, or every method of
+	// a service, /book.v1.BookService/*, or every method, *
+	Method string
+	Roles  []string // The caller must have one of the roles, any caller if empty
+	Public bool     // Callers don't need a token
+}
+
+// publicServices can always be called, the health checks of Kubernetes and
+// grpc_health_probe don't have tokens
+var publicServices = []string{"/grpc.health.v1.Health/", "/grpc.reflection.v1alpha.ServerReflection/"}
+
+// Auth is a server interceptor that authenticates the caller of each RPC with
+// the token in the authorization metadata and checks the method's policy.
+// Callers without a valid token get UNAUTHENTICATED and those without the
+// role PERMISSION_DENIED.  Methods that aren't in the policy can be called by
+// any authenticated caller.
+type Auth struct {
+	verifier *TokenVerifier
+	policies []MethodPolicy
+}
+
+// NewAuth makes the interceptor
+func NewAuth(verifier *TokenVerifier, policies []MethodPolicy) *Auth {
+	return &Auth{verifier: verifier, policies: policies}
+}
+
+// Auth is read from the TokenVerifier keys and auth_policy, it is nil if
+// there is no key, when anyone can call every method
+func (c *AppConfig) Auth() (*Auth, error) {
+	verifier, err := c.TokenVerifier()
+	if err != nil || verifier == nil {
+		return nil, err
+	}
+	var policies []MethodPolicy
+	if err := c.V.UnmarshalKey(c.keyPrefix+".auth_policy", &policies); err != nil {
+		return nil, fmt.Errorf("auth_policy: %w", err)
+	}
+	return NewAuth(verifier, policies), nil
+}
+
+// Unary is the grpc.UnaryServerInterceptor
+func (a *Auth) Unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.authorize(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// Stream is the grpc.StreamServerInterceptor
+func (a *Auth) Stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.authorize(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+}
+
+// authorize returns a context with the caller, and their token to forward,
+// if they may call the method
+func (a *Auth) authorize(ctx context.Context, method string) (context.Context, error) {
+	policy := a.policy(method)
+	token := bearerToken(ctx)
+	var claims *Claims
+	var err error
+	if token == "" {
+		err = errors.New("no token")
+	} else if claims, err = a.verifier.Verify(token); err == nil {
+		ctx = WithCaller(WithToken(ctx, token), claims)
+	}
+	switch {
+	case policy.Public:
+		return ctx, nil
+	case err != nil:
+		return nil, status.Errorf(codes.Unauthenticated, "%s: %v", method, err)
+	case len(policy.Roles) > 0 && !claims.HasRole(policy.Roles...):
+		return nil, status.Errorf(codes.PermissionDenied, "%s needs one of the roles %s", method, strings.Join(policy.Roles, ", "))
+	}
+	return ctx, nil
+}
+
+// policy finds the most specific policy of the method
+func (a *Auth) policy(method string) MethodPolicy {
+	for _, prefix := range publicServices {
+		if strings.HasPrefix(method, prefix) {
+			return MethodPolicy{Method: method, Public: true}
+		}
+	}
+	service := method[:strings.LastIndex(method, "/")+1] + "*"
+	for _, pattern := range []string{method, service, "*"} {
+		for _, p := range a.policies {
+			if p.Method == pattern {
+				return p
+			}
+		}
+	}
+	return MethodPolicy{Method: method}
+}
+
+// bearerToken is the token in the incoming authorization metadata
+func bearerToken(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get(AuthorizationKey) {
+		if len(v) > 7 && strings.EqualFold(v[:7], "bearer ") {
+			return strings.TrimSpace(v[7:])
+		}
+	}
+	return ""
+}
@@ -1,8 +1,13 @@
 package common
 
 import (
+	"context"
+	"net/http"
+	"sort"
+
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
 )
 
 //
@@ -20,11 +25,18 @@ import (
 //	c.SvcConn[serviceName] = *conn
 //}
 
-func (c *AppConfig) ConnGRPC(serviceName string) {
+// ConnGRPC connects to a service, whose address and client config are read
+// from its keys, and saves the connection in SvcConn.  The call_timeout
+// changes with the config.  The retry policy
+// applies to the methods of the gRPC services given, e.g. book.v1.BookService.
+// Unless dial_block is false it waits for the connection, otherwise it returns
+// straight away and gRPC connects, and reconnects, in the background.
+func (c *AppConfig) ConnGRPC(serviceName string, grpcServices ...string) {
 	var opts []grpc.DialOption
-	c.KeyPrefix(serviceName)
-	if c.TLS() {
-		cred, err := credentials.NewClientTLSFromFile(c.CertFile(), c.HostOverride())
+	keys := c.withKeyPrefix(serviceName) // The keys of the service, e.g. book.service_addr
+	cc := keys.ClientConfig()
+	if keys.TLS() {
+		cred, err := keys.ClientCredentials(keys.ServiceAddress())
 		if err != nil {
 			c.Log.Fatalf("Failed to create TLS credentials %v", err)
 		}
@@ -32,16 +44,113 @@ func (c *AppConfig) ConnGRPC(serviceName string) {
 	} else {
 		opts = append(opts, grpc.WithInsecure())
 	}
-	opts = append(opts, grpc.WithBlock())
-	if c.ServiceAddress() == "" {
+	opts = append(opts,
+		grpc.WithStatsHandler(ClientStatsHandler()), // the trace carries on in the service
+		grpc.WithChainUnaryInterceptor(UnaryClientMetadata),
+		grpc.WithChainStreamInterceptor(StreamClientMetadata))
+	breaker := NewCircuitBreaker(serviceName, cc.BreakerFailures, cc.BreakerReset)
+	timeout := newCallTimeout(cc.CallTimeout)
+	ccOpts, err := cc.dialOptions(breaker, timeout, grpcServices)
+	if err != nil {
+		c.Log.Fatalf("Bad client config for %s: %v", serviceName, err)
+	}
+	err = c.OnConfigChange(serviceName, func(cfg *callTimeoutConfig) {
+		if cfg.CallTimeout <= 0 {
+			cfg.CallTimeout = DefaultClientConfig.CallTimeout
+		}
+		timeout.set(cfg.CallTimeout)
+		c.Log.Infof("Calls to %s now time out after %v", serviceName, cfg.CallTimeout)
+	})
+	if err != nil {
+		c.Log.Fatalf("Bad client config for %s: %v", serviceName, err)
+	}
+	opts = append(opts, ccOpts...)
+	address := keys.ServiceAddress()
+	if address == "" {
 		c.Log.Fatalf("No service address %v", ErrNoConfigSettings)
 	}
-	conn, err := grpc.Dial(c.ServiceAddress(), opts...)
+	ctx, cancel := context.WithTimeout(context.Background(), cc.DialTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, address, opts...)
 	if err != nil {
-		c.Log.Fatalf("fail to dial %s: %v", c.ServiceAddress(), err)
+		c.Log.Fatalf("fail to dial %s: %v", address, err)
 	}
 	c.SvcConn[serviceName] = conn
-	c.Log.Infof("Established GRPC onnection to %s", serviceName)
+	c.SvcBreaker[serviceName] = breaker
+	if cc.Block {
+		c.Log.Infof("Established GRPC onnection to %s", serviceName)
+	} else {
+		c.Log.Infof("Connecting to %s in the background", serviceName)
+	}
+	go c.logConnState(serviceName, conn)
 
 	//defer c.SvcConn[serviceName].Close()
 }
+
+// logConnState logs each change of state of the connection to a service, e.g.
+// when it is lost and when it is back, until the connection is closed
+func (c *AppConfig) logConnState(serviceName string, conn *grpc.ClientConn) {
+	state := conn.GetState()
+	for state != connectivity.Shutdown && conn.WaitForStateChange(context.Background(), state) {
+		state = conn.GetState()
+		c.Log.WithField("grpc.service", serviceName).Infof("Connection is %s", state)
+	}
+}
+
+// ConnState is the state of the connection to a service
+type ConnState struct {
+	Name        string             // The service name, the key of SvcConn
+	Target      string             // The address connected to
+	State       connectivity.State // e.g. READY or TRANSIENT_FAILURE
+	BreakerOpen bool               // Calls are failing straight away
+}
+
+// Ready says if calls to the service can be made, an IDLE connection connects
+// when it is used
+func (s ConnState) Ready() bool {
+	return !s.BreakerOpen && (s.State == connectivity.Ready || s.State == connectivity.Idle)
+}
+
+// ConnStates are the states of the connections in SvcConn, by name
+func (c *AppConfig) ConnStates() []ConnState {
+	states := make([]ConnState, 0, len(c.SvcConn))
+	for name, conn := range c.SvcConn {
+		s := ConnState{Name: name, Target: conn.Target(), State: conn.GetState()}
+		if b := c.SvcBreaker[name]; b != nil {
+			s.BreakerOpen = b.Open()
+		}
+		states = append(states, s)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Name < states[j].Name })
+	return states
+}
+
+// HTTPStatusFromCode converts a gRPC error code into the HTTP status code a web
+// front end should answer with, following the mapping in google/rpc/code.proto
+func HTTPStatusFromCode(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499 // Client Closed Request, there is no constant for it
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,197 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MetricsPath is where the metrics are served in the Prometheus text format
+const MetricsPath = "/metrics"
+
+// otherRoute is the route label of requests that no route was set for, so
+// unknown paths don't make a label each
+const otherRoute = "other"
+
+// Metrics are the Prometheus metrics of a service.  Every service has the Go
+// runtime and process metrics, and the RED metrics, the rate, errors and
+// duration, of the HTTP requests or RPCs it serves.  Services add their own
+// gauges with GaugeFunc.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	httpRequests *prometheus.CounterVec   // By route, method and code
+	httpErrors   *prometheus.CounterVec   // 5xx responses by route, method and code
+	httpDuration *prometheus.HistogramVec // By route and method
+	rpcs         *prometheus.CounterVec   // By grpc_service, grpc_method and grpc_code
+	rpcErrors    *prometheus.CounterVec   // Server faults by grpc_service, grpc_method and grpc_code
+	rpcDuration  *prometheus.HistogramVec // By grpc_service and grpc_method
+}
+
+// NewMetrics makes the metrics of a service in a registry of its own
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests served, by route, method and status code.",
+		}, []string{"route", "method", "code"}),
+		httpErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_request_errors_total",
+			Help: "HTTP requests that failed with a 5xx status code.",
+		}, []string{"route", "method", "code"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "How long HTTP requests took to serve.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		rpcs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_server_handled_total",
+			Help: "RPCs completed on the server, by service, method and code.",
+		}, []string{"grpc_service", "grpc_method", "grpc_code"}),
+		rpcErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "grpc_server_errors_total",
+			Help: "RPCs that failed with a code that is the server's fault, e.g. INTERNAL or UNAVAILABLE.",
+		}, []string{"grpc_service", "grpc_method", "grpc_code"}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "grpc_server_handling_seconds",
+			Help:    "How long RPCs took to complete, streams included.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"grpc_service", "grpc_method"}),
+	}
+	m.Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.httpRequests, m.httpErrors, m.httpDuration,
+		m.rpcs, m.rpcErrors, m.rpcDuration,
+	)
+	return m
+}
+
+// Handler serves the metrics
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// GaugeFunc adds a gauge whose value is f() when the metrics are scraped, e.g.
+// the number of books in the database
+func (m *Metrics) GaugeFunc(name, help string, f func() float64) {
+	m.Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, f))
+}
+
+type ctxKeyRoute struct{}
+
+// SetRoute names the route of the HTTP request being served in the metrics,
+// e.g. /books/{id} rather than the path, which would make a label for every
+// book, and in the request's span.  Requests without a route are counted as
+// "other".
+func SetRoute(ctx context.Context, route string) {
+	if r, ok := ctx.Value(ctxKeyRoute{}).(*string); ok {
+		*r = route
+	}
+	if span := trace.FromContext(ctx); span != nil {
+		span.AddAttributes(trace.StringAttribute("http.route", route))
+	}
+}
+
+// HTTP records the metrics of the requests next serves.  If next is an
+// http.ServeMux the route is the pattern it matched, other handlers call
+// SetRoute.
+func (m *Metrics) HTTP(next http.Handler) http.Handler {
+	mux, _ := next.(*http.ServeMux)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := otherRoute
+		if mux != nil {
+			if _, pattern := mux.Handler(r); pattern != "" {
+				route = pattern
+			}
+		}
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(context.WithValue(r.Context(), ctxKeyRoute{}, &route)))
+		code := strconv.Itoa(sw.status)
+		m.httpRequests.WithLabelValues(route, r.Method, code).Inc()
+		if sw.status >= 500 {
+			m.httpErrors.WithLabelValues(route, r.Method, code).Inc()
+		}
+		m.httpDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// statusWriter remembers the status code of the response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Flush lets streamed responses through
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unary is the grpc.UnaryServerInterceptor that records the metrics of RPCs
+func (m *Metrics) Unary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	m.recordRPC(info.FullMethod, start, err)
+	return resp, err
+}
+
+// Stream is the grpc.StreamServerInterceptor that records the metrics of
+// streaming RPCs once they finish
+func (m *Metrics) Stream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	m.recordRPC(info.FullMethod, start, err)
+	return err
+}
+
+func (m *Metrics) recordRPC(fullMethod string, start time.Time, err error) {
+	service, method := splitMethod(fullMethod)
+	code := status.Code(err)
+	m.rpcs.WithLabelValues(service, method, code.String()).Inc()
+	if serverFault(code) {
+		m.rpcErrors.WithLabelValues(service, method, code.String()).Inc()
+	}
+	m.rpcDuration.WithLabelValues(service, method).Observe(time.Since(start).Seconds())
+}
+
+// splitMethod splits /book.v1.BookService/GetBook into the service and method
+func splitMethod(fullMethod string) (string, string) {
+	fullMethod = strings.TrimPrefix(fullMethod, "/")
+	if i := strings.LastIndex(fullMethod, "/"); i >= 0 {
+		return fullMethod[:i], fullMethod[i+1:]
+	}
+	return "unknown", fullMethod
+}
+
+// serverFault says if an RPC that failed with the code is the server's fault
+// rather than the client's
+func serverFault(code codes.Code) bool {
+	switch code {
+	case codes.Unknown, codes.Internal, codes.DataLoss, codes.Unimplemented, codes.Unavailable:
+		return true
+	}
+	return false
+}
+
+// The port the admin server of a gRPC service serves the metrics on, none if 0
+func (c *AppConfig) AdminPort() int {
+	return c.GetIntKey("admin_port")
+}
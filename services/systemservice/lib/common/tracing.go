@@ -0,0 +1,188 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"contrib.go.opencensus.io/exporter/jaeger"
+	"go.opencensus.io/plugin/ocgrpc"
+	"go.opencensus.io/trace"
+	"google.golang.org/grpc/stats"
+)
+
+// Trace exporters for the trace_exporter config key
+const (
+	TraceNone   = "none"   // Spans are made, so trace IDs are passed on, but not exported
+	TraceStdout = "stdout" // A JSON line per span on stdout
+	TraceFile   = "file"   // A JSON line per span appended to trace_file
+	TraceJaeger = "jaeger" // Sent to trace_jaeger_collector or trace_jaeger_agent
+)
+
+// defaultSampleRate is the fraction of new traces that are sampled if
+// trace_sample_rate isn't set, traces started by a caller keep its decision
+const defaultSampleRate = 1.0
+
+// StartTracing exports the spans of the service, picked by trace_exporter.
+// trace_sample_rate is the fraction of new traces that are sampled, 0 to 1.
+// For the older deployments DISABLE_TRACING turns tracing off and
+// JAEGER_SERVICE_ADDR, the host:port of a Jaeger collector, is used when there
+// is no trace_exporter.  The returned Closer flushes the spans not yet
+// exported.
+func (c *AppConfig) StartTracing(serviceName string) (Closer, error) {
+	exporter := strings.ToLower(c.GetStringKey("trace_exporter"))
+	collector := c.GetStringKey("trace_jaeger_collector")
+	if addr := os.Getenv("JAEGER_SERVICE_ADDR"); addr != "" && exporter == "" {
+		exporter, collector = TraceJaeger, "http://"+addr+"/api/traces"
+	}
+	if os.Getenv("DISABLE_TRACING") != "" || exporter == "" {
+		exporter = TraceNone
+	}
+
+	rate := defaultSampleRate
+	if c.GetStringKey("trace_sample_rate") != "" {
+		rate = c.GetFloatKey("trace_sample_rate")
+	}
+	if rate < 0 || rate > 1 {
+		return nil, fmt.Errorf("trace_sample_rate %v isn't between 0 and 1", rate)
+	}
+
+	var closer Closer = CloserFunc(func(context.Context) error { return nil })
+	switch exporter {
+	case TraceNone:
+		c.Log.Info("Traces aren't exported, see trace_exporter")
+		return closer, nil
+	case TraceStdout:
+		e := newJSONExporter(os.Stdout)
+		trace.RegisterExporter(e)
+	case TraceFile:
+		file := c.GetStringKey("trace_file")
+		if file == "" {
+			return nil, fmt.Errorf("trace_exporter %s needs a trace_file", TraceFile)
+		}
+		f, err := os.OpenFile(file, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		e := newJSONExporter(f)
+		trace.RegisterExporter(e)
+		closer = CloserFunc(func(context.Context) error {
+			trace.UnregisterExporter(e)
+			return f.Close()
+		})
+	case TraceJaeger:
+		agent := c.GetStringKey("trace_jaeger_agent")
+		if collector == "" && agent == "" {
+			return nil, fmt.Errorf("trace_exporter %s needs a trace_jaeger_collector or trace_jaeger_agent", TraceJaeger)
+		}
+		e, err := jaeger.NewExporter(jaeger.Options{
+			CollectorEndpoint: collector,
+			AgentEndpoint:     agent,
+			Process:           jaeger.Process{ServiceName: serviceName},
+			OnError:           func(err error) { c.Log.WithError(err).Warn("Cannot export spans to Jaeger") },
+		})
+		if err != nil {
+			return nil, fmt.Errorf("jaeger: %w", err)
+		}
+		trace.RegisterExporter(e)
+		closer = CloserFunc(func(context.Context) error {
+			e.Flush()
+			return nil
+		})
+	default:
+		return nil, fmt.Errorf("unknown trace_exporter %q", exporter)
+	}
+	trace.ApplyConfig(trace.Config{DefaultSampler: trace.ProbabilitySampler(rate)})
+	c.Log.Infof("Exporting %v of traces to %s", rate, exporter)
+	return closer, nil
+}
+
+// jsonExporter writes each span as a line of JSON, for looking at traces
+// without a tracing backend, e.g. with jq
+type jsonExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newJSONExporter(w io.Writer) *jsonExporter {
+	return &jsonExporter{enc: json.NewEncoder(w)}
+}
+
+// jsonSpan is a line of the jsonExporter
+type jsonSpan struct {
+	TraceID    string                 `json:"trace_id"`
+	SpanID     string                 `json:"span_id"`
+	ParentID   string                 `json:"parent_span_id,omitempty"`
+	Name       string                 `json:"name"`
+	Kind       string                 `json:"kind,omitempty"`
+	Start      time.Time              `json:"start"`
+	DurationMs float64                `json:"duration_ms"`
+	Status     int32                  `json:"status,omitempty"` // A gRPC code
+	Message    string                 `json:"message,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// ExportSpan is called by OpenCensus as each sampled span ends
+func (e *jsonExporter) ExportSpan(s *trace.SpanData) {
+	js := jsonSpan{
+		TraceID:    s.TraceID.String(),
+		SpanID:     s.SpanID.String(),
+		Name:       s.Name,
+		Start:      s.StartTime,
+		DurationMs: float64(s.EndTime.Sub(s.StartTime)) / float64(time.Millisecond),
+		Status:     s.Code,
+		Message:    s.Message,
+		Attributes: s.Attributes,
+	}
+	if s.ParentSpanID != (trace.SpanID{}) {
+		js.ParentID = s.ParentSpanID.String()
+	}
+	switch s.SpanKind {
+	case trace.SpanKindServer:
+		js.Kind = "server"
+	case trace.SpanKindClient:
+		js.Kind = "client"
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_ = e.enc.Encode(js)
+}
+
+type ctxKeyUntraced struct{}
+
+// untracedHealth is an ocgrpc stats handler that leaves out the health checks
+// and reflection, which the probes call every few seconds
+type untracedHealth struct {
+	stats.Handler
+}
+
+// ServerStatsHandler traces the RPCs a server serves, the trace carries on
+// from the client's span
+func ServerStatsHandler() stats.Handler {
+	return untracedHealth{&ocgrpc.ServerHandler{}}
+}
+
+// ClientStatsHandler traces the calls to a service and passes the trace on
+func ClientStatsHandler() stats.Handler {
+	return untracedHealth{&ocgrpc.ClientHandler{}}
+}
+
+func (h untracedHealth) TagRPC(ctx context.Context, info *stats.RPCTagInfo) context.Context {
+	for _, prefix := range publicServices {
+		if strings.HasPrefix(info.FullMethodName, prefix) {
+			return context.WithValue(ctx, ctxKeyUntraced{}, true)
+		}
+	}
+	return h.Handler.TagRPC(ctx, info)
+}
+
+func (h untracedHealth) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	if ctx.Value(ctxKeyUntraced{}) == nil {
+		h.Handler.HandleRPC(ctx, s)
+	}
+}